@@ -2,6 +2,7 @@ package fakes
 
 import (
 	"encoding/json"
+	"reflect"
 	"strconv"
 
 	"github.com/cloudnativego/cfmgo"
@@ -28,8 +29,17 @@ func FakeNewCollectionDialer(c interface{}) func(url, dbname, collectionname str
 //FakeCollection -
 type FakeCollection struct {
 	mgo.Collection
-	Data  []byte
-	Error error
+	Data       []byte
+	Error      error
+	Operations []Operation
+	Indexes    []mgo.Index
+}
+
+//Operation records a call made against a FakeCollection so tests can verify what was issued.
+type Operation struct {
+	Name     string
+	Selector interface{}
+	Update   interface{}
 }
 
 //Close -
@@ -44,26 +54,138 @@ func (s *FakeCollection) Wake() {
 
 //Find -- finds all records matching given selector
 func (s *FakeCollection) Find(params cfmgo.Params, result interface{}) (count int, err error) {
+	s.Operations = append(s.Operations, Operation{Name: "Find", Selector: params})
 	count = TargetCount
 	err = json.Unmarshal(s.Data, result)
 
 	return
 }
 
-//FindAndModify -
+//FindAndModify -- applies $set, $unset, $inc and $push updates to the first record matching every field of the selector
 func (s *FakeCollection) FindAndModify(selector interface{}, update interface{}, result interface{}) (info *mgo.ChangeInfo, err error) {
-	return
+	s.Operations = append(s.Operations, Operation{Name: "FindAndModify", Selector: selector, Update: update})
+	var col []map[string]interface{}
+	var query, change map[string]interface{}
+	err = remarshal(s.Data, &col)
+	if err == nil {
+		err = remarshal(selector, &query)
+	}
+	if err == nil {
+		err = remarshal(update, &change)
+	}
+	if err != nil {
+		return
+	}
+
+	for _, record := range col {
+		if !matches(record, query) {
+			continue
+		}
+		apply(record, change)
+		s.Data, err = json.Marshal(col)
+		if err == nil && result != nil {
+			err = remarshal(record, result)
+		}
+		return &mgo.ChangeInfo{Updated: 1}, err
+	}
+	return nil, mgo.ErrNotFound
+}
+
+//Remove -- deletes the first record matching every field of the selector
+func (s *FakeCollection) Remove(selector interface{}) (err error) {
+	s.Operations = append(s.Operations, Operation{Name: "Remove", Selector: selector})
+	var col []map[string]interface{}
+	var query map[string]interface{}
+	err = remarshal(s.Data, &col)
+	if err == nil {
+		err = remarshal(selector, &query)
+	}
+	if err != nil {
+		return
+	}
+
+	for i, record := range col {
+		if matches(record, query) {
+			s.Data, err = json.Marshal(append(col[:i], col[i+1:]...))
+			return
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+//EnsureIndex -
+func (s *FakeCollection) EnsureIndex(index mgo.Index) error {
+	s.Indexes = append(s.Indexes, index)
+	return s.Error
+}
+
+func matches(record map[string]interface{}, query map[string]interface{}) bool {
+	for field, value := range query {
+		if !reflect.DeepEqual(record[field], value) {
+			return false
+		}
+	}
+	return true
+}
+
+func apply(record map[string]interface{}, change map[string]interface{}) {
+	if set, ok := change["$set"].(map[string]interface{}); ok {
+		for field, value := range set {
+			record[field] = value
+		}
+	}
+	if unset, ok := change["$unset"].(map[string]interface{}); ok {
+		for field := range unset {
+			delete(record, field)
+		}
+	}
+	if inc, ok := change["$inc"].(map[string]interface{}); ok {
+		for field, value := range inc {
+			current, _ := record[field].(float64)
+			delta, _ := value.(float64)
+			record[field] = current + delta
+		}
+	}
+	if push, ok := change["$push"].(map[string]interface{}); ok {
+		for field, value := range push {
+			list, _ := record[field].([]interface{})
+			spec, _ := value.(map[string]interface{})
+			if each, ok := spec["$each"].([]interface{}); ok {
+				list = append(list, each...)
+				if keep, ok := spec["$slice"].(float64); ok && int(keep) < len(list) {
+					list = list[:int(keep)]
+				}
+			} else {
+				list = append(list, value)
+			}
+			record[field] = list
+		}
+	}
+}
+
+// remarshal copies src into dst by way of JSON, which is how the fake stores its records.
+func remarshal(src interface{}, dst interface{}) error {
+	b, ok := src.([]byte)
+	if !ok {
+		var err error
+		b, err = json.Marshal(src)
+		if err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(b, dst)
 }
 
 //UpsertID -
 func (s *FakeCollection) UpsertID(id interface{}, result interface{}) (changeInfo *mgo.ChangeInfo, err error) {
+	s.Operations = append(s.Operations, Operation{Name: "UpsertID", Selector: id, Update: result})
 	var col []interface{}
 	err = json.Unmarshal(s.Data, &col)
 	if err != nil {
 		return
 	}
 
-	col = append(col, result)
+	col = upsert(col, id, result)
 	b, err := json.Marshal(col)
 	if err != nil {
 		return
@@ -78,6 +200,23 @@ func (s *FakeCollection) UpsertID(id interface{}, result interface{}) (changeInf
 	return changeInfo, nil
 }
 
+// upsert replaces the record whose "id" matches the given id, appending it if no such record exists.
+func upsert(col []interface{}, id interface{}, result interface{}) []interface{} {
+	key, _ := json.Marshal(id)
+	for i, record := range col {
+		fields, ok := record.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		recordKey, _ := json.Marshal(fields["id"])
+		if string(recordKey) == string(key) {
+			col[i] = result
+			return col
+		}
+	}
+	return append(col, result)
+}
+
 //FindOne -
 func (s *FakeCollection) FindOne(id string, result interface{}) (err error) {
 	i, err := strconv.Atoi(id)
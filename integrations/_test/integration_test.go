@@ -28,6 +28,7 @@ func TestIntegration(t *testing.T) {
 
 	// Add first match
 	matchResponse, err := addMatch(t, firstMatchBody)
+	firstSeats := matchResponse.SeatTokens
 	if matchResponse.PlayerBlack != "Hingle McCringleberry" {
 		t.Errorf("Didn't get expected black stone player name from creation, got '%s'", matchResponse.PlayerBlack)
 	}
@@ -45,6 +46,7 @@ func TestIntegration(t *testing.T) {
 
 	// Add second match
 	matchResponse, err = addMatch(t, secondMatchBody)
+	secondSeats := matchResponse.SeatTokens
 	if matchResponse.PlayerBlack != "J'Dinkalage Morgoone" {
 		t.Errorf("Didn't get expected black stone player name from creation, got '%s'", matchResponse.PlayerBlack)
 	}
@@ -69,14 +71,14 @@ func TestIntegration(t *testing.T) {
 	secondMatch := matches[1]
 
 	// Add Move
-	addMoveToMatch(t, firstMatch.ID, []byte("{\n  \"player\": 2,\n  \"position\": {\n    \"x\": 3,\n    \"y\": 10\n  }\n}"))
+	addMoveToMatch(t, firstMatch.ID, firstSeats.Black, []byte("{\n  \"player\": 1,\n  \"position\": {\n    \"x\": 3,\n    \"y\": 10\n  }\n}"))
 
 	updatedFirstMatch, err := getMatchDetails(t, firstMatch.ID)
 	if err != nil {
 		t.Errorf("Error getting match details, %v", err)
 	}
-	if updatedFirstMatch.GameBoard[3][10] != 2 {
-		t.Errorf("Expected gameboard position 3,10 to be 2, received: %d", updatedFirstMatch.GameBoard[3][10])
+	if updatedFirstMatch.GameBoard[3][10] != 1 {
+		t.Errorf("Expected gameboard position 3,10 to be 1, received: %d", updatedFirstMatch.GameBoard[3][10])
 	}
 
 	originalSecondMatch, _ := getMatchDetails(t, secondMatch.ID)
@@ -84,16 +86,18 @@ func TestIntegration(t *testing.T) {
 		t.Errorf("Expected gameboard position 3,10 to be 0, received: %d", originalSecondMatch.GameBoard[3][10])
 	}
 
-	addMoveToMatch(t, secondMatch.ID, []byte("{\n  \"player\": 1,\n  \"position\": {\n    \"x\": 3,\n    \"y\": 10\n  }\n}"))
+	addMoveToMatch(t, secondMatch.ID, secondSeats.Black, []byte("{\n  \"player\": 1,\n  \"position\": {\n    \"x\": 3,\n    \"y\": 10\n  }\n}"))
+
+	addMoveToMatch(t, firstMatch.ID, firstSeats.White, []byte("{\n  \"player\": 2,\n  \"position\": {\n    \"x\": 3,\n    \"y\": 11\n  }\n}"))
 
 	updatedFirstMatch, _ = getMatchDetails(t, firstMatch.ID)
-	if updatedFirstMatch.GameBoard[3][10] != 2 {
-		t.Errorf("Expected gameboard position 3,10 to be 2, received: %d", updatedFirstMatch.GameBoard[3][10])
+	if updatedFirstMatch.GameBoard[3][10] != 1 || updatedFirstMatch.GameBoard[3][11] != 2 {
+		t.Errorf("Expected gameboard positions 3,10 and 3,11 to be 1 and 2, received: %d and %d", updatedFirstMatch.GameBoard[3][10], updatedFirstMatch.GameBoard[3][11])
 	}
 
 	updatedSecondMatch, _ := getMatchDetails(t, secondMatch.ID)
-	if updatedSecondMatch.GameBoard[3][10] != 1 {
-		t.Errorf("Expected gameboard position 3,10 to be 1, received: %d", updatedSecondMatch.GameBoard[3][10])
+	if updatedSecondMatch.GameBoard[3][10] != 1 || updatedSecondMatch.GameBoard[3][11] != 0 {
+		t.Errorf("Expected gameboard positions 3,10 and 3,11 to be 1 and 0, received: %d and %d", updatedSecondMatch.GameBoard[3][10], updatedSecondMatch.GameBoard[3][11])
 	}
 }
 
@@ -152,11 +156,17 @@ func getMatchDetails(t *testing.T, ID string) (match matchDetailsResponse, err e
 	return
 }
 
-func addMoveToMatch(t *testing.T, ID string, body []byte) {
+func addMoveToMatch(t *testing.T, ID string, seatToken string, body []byte) {
+	current := httptest.NewRecorder()
+	currentRequest, _ := http.NewRequest("GET", fmt.Sprintf("/matches/%s", ID), nil)
+	server.ServeHTTP(current, currentRequest)
+
 	recorder := httptest.NewRecorder()
 	requestString := fmt.Sprintf("/matches/%s/moves", ID)
 	matchMove := bytes.NewBuffer(body)
 	addMoveRequest, _ := http.NewRequest("POST", requestString, matchMove)
+	addMoveRequest.Header.Set("Authorization", "Bearer "+seatToken)
+	addMoveRequest.Header.Set("If-Match", current.Header().Get("ETag"))
 	server.ServeHTTP(recorder, addMoveRequest)
 	if recorder.Code != 201 {
 		t.Errorf("Error adding move to match: %d", recorder.Code)
@@ -173,6 +183,10 @@ type newMatchResponse struct {
 	PlayerWhite string `json:"playerWhite"`
 	PlayerBlack string `json:"playerBlack"`
 	Turn        int    `json:"turn,omitempty"`
+	SeatTokens  struct {
+		Black string `json:"black"`
+		White string `json:"white"`
+	} `json:"seatTokens"`
 }
 
 type matchDetailsResponse struct {
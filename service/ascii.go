@@ -0,0 +1,101 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+const (
+	textMediaType = "text/plain"
+	asciiFormat   = "ascii"
+)
+
+// asciiGlyph is the character each point is drawn with; star points show through as '+'.
+var asciiGlyph = map[byte]byte{
+	0:                '.',
+	gogo.PlayerBlack: 'X',
+	gogo.PlayerWhite: 'O',
+}
+
+// asciiBoard draws a position as labelled text, with columns A to T (skipping I) across the top
+// and bottom and rows numbered from the bottom on both sides. Tests use it to print boards in
+// failure messages.
+func asciiBoard(positions [][]byte) string {
+	gridSize := len(positions)
+	stars := make(map[gogo.Coordinate]bool)
+	for _, point := range starPoints(gridSize) {
+		stars[point] = true
+	}
+
+	var b bytes.Buffer
+	columns := "  "
+	for x := 0; x < gridSize; x++ {
+		columns += " " + columnLabel(x)
+	}
+	b.WriteString(columns + "\n")
+	for y := 0; y < gridSize; y++ {
+		fmt.Fprintf(&b, "%2s", rowLabel(gridSize, y))
+		for x := 0; x < gridSize; x++ {
+			glyph := asciiGlyph[positions[x][y]]
+			if positions[x][y] == 0 && stars[gogo.Coordinate{X: x, Y: y}] {
+				glyph = '+'
+			}
+			b.WriteByte(' ')
+			b.WriteByte(glyph)
+		}
+		fmt.Fprintf(&b, " %s\n", rowLabel(gridSize, y))
+	}
+	b.WriteString(columns + "\n")
+	return b.String()
+}
+
+// renderASCII draws a match as plain text: a header naming the players, the turn, captures and
+// the last move, followed by the board.
+func renderASCII(match gogo.Match, settings matchSettings, moves []matchMove) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s (X, black) vs %s (O, white)\n", match.PlayerBlack, match.PlayerWhite)
+
+	status := playerName(nextPlayer(settings, moves)) + " to play"
+	if matchStatus(moves) == matchStatusFinished {
+		status = "finished"
+		if winner := forfeitWinner(moves); winner != "" && moves[len(moves)-1].TimedOut {
+			status += ", " + winner + " wins on time"
+		} else if winner != "" {
+			status += ", " + winner + " wins by resignation"
+		}
+	}
+	captures := map[byte]int{}
+	for _, move := range moves {
+		captures[move.Player] += move.Captures
+	}
+	fmt.Fprintf(&b, "Turn %d, %s. Captures: black %d, white %d\n", match.TurnCount, status,
+		captures[gogo.PlayerBlack], captures[gogo.PlayerWhite])
+	if len(moves) > 0 {
+		fmt.Fprintf(&b, "Last move: %s\n", describeMove(match.GridSize, moves[len(moves)-1]))
+	}
+	b.WriteString("\n")
+	b.WriteString(asciiBoard(match.GameBoard.Positions))
+	return b.Bytes()
+}
+
+// describeMove names a move in board coordinates, e.g. "black D4".
+func describeMove(gridSize int, move matchMove) string {
+	switch {
+	case move.Resigned:
+		return playerName(move.Player) + " resigned"
+	case move.TimedOut:
+		return playerName(move.Player) + " ran out of time"
+	case move.isPass():
+		return playerName(move.Player) + " passed"
+	}
+	return playerName(move.Player) + " " + columnLabel(move.Position.X) + rowLabel(gridSize, move.Position.Y)
+}
+
+// wantsASCII reports whether a request for a match asked for its plain text rendering.
+func wantsASCII(req *http.Request) bool {
+	return strings.EqualFold(req.URL.Query().Get("format"), asciiFormat) || acceptsMediaType(req, textMediaType)
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+func TestRenderASCIILabelsBoardAndHeader(t *testing.T) {
+	match := gogo.NewMatch(9, "alfred", "bob")
+	match.GameBoard.Positions[2][6] = gogo.PlayerBlack
+	match.GameBoard.Positions[4][2] = gogo.PlayerWhite
+	match.TurnCount = 3
+	moves := []matchMove{
+		{Player: gogo.PlayerBlack, Position: &gogo.Coordinate{X: 2, Y: 6}, Turn: 1, Captures: 1},
+		{Player: gogo.PlayerWhite, Position: &gogo.Coordinate{X: 4, Y: 2}, Turn: 2},
+		{Player: gogo.PlayerBlack, Turn: 3},
+	}
+
+	expected := `alfred (X, black) vs bob (O, white)
+Turn 3, white to play. Captures: black 1, white 0
+Last move: black passed
+
+   A B C D E F G H J
+ 9 . . . . . . . . . 9
+ 8 . . . . . . . . . 8
+ 7 . . + . O . + . . 7
+ 6 . . . . . . . . . 6
+ 5 . . . . + . . . . 5
+ 4 . . . . . . . . . 4
+ 3 . . X . . . + . . 3
+ 2 . . . . . . . . . 2
+ 1 . . . . . . . . . 1
+   A B C D E F G H J
+`
+	if got := string(renderASCII(match, matchSettings{}, moves)); got != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestDescribeMoveUsesBoardCoordinates(t *testing.T) {
+	cases := map[string]matchMove{
+		"black D4":       {Player: gogo.PlayerBlack, Position: &gogo.Coordinate{X: 3, Y: 15}},
+		"white T19":      {Player: gogo.PlayerWhite, Position: &gogo.Coordinate{X: 18, Y: 0}},
+		"white passed":   {Player: gogo.PlayerWhite},
+		"black resigned": {Player: gogo.PlayerBlack, Resigned: true},
+	}
+	for expected, move := range cases {
+		if got := describeMove(19, move); got != expected {
+			t.Errorf("Expected %s, got %s", expected, got)
+		}
+	}
+}
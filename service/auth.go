@@ -0,0 +1,91 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	seatTokenBytes = 32
+
+	// adminTokenEnv names the environment variable holding the administrator's bearer token.
+	// Administrative actions are disabled while it is unset.
+	adminTokenEnv = "GOGO_ADMIN_TOKEN"
+)
+
+var (
+	errMissingSeatToken = errors.New("A bearer seat token is required to move in this match")
+	errWrongSeatToken   = errors.New("Seat token does not belong to the moving player")
+)
+
+// newSeatToken returns a random secret that identifies the holder as one of a match's players.
+func newSeatToken() (token string, err error) {
+	b := make([]byte, seatTokenBytes)
+	_, err = rand.Read(b)
+	if err == nil {
+		token = hex.EncodeToString(b)
+	}
+	return
+}
+
+// newSeats issues a fresh pair of seat tokens for a match.
+func newSeats() (tokens seats, err error) {
+	tokens.Black, err = newSeatToken()
+	if err == nil {
+		tokens.White, err = newSeatToken()
+	}
+	return
+}
+
+// hashSeatToken returns the form in which a seat token is stored. Seat tokens are long random
+// values, so a plain SHA-256 digest is enough to keep them from being replayed out of a database dump.
+func hashSeatToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header.
+func bearerToken(req *http.Request) (token string, ok bool) {
+	header := req.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(header) > len(prefix) && strings.ToLower(header[:len(prefix)]) == prefix {
+		token = strings.TrimSpace(header[len(prefix):])
+	}
+	return token, token != ""
+}
+
+// authorizeSeat checks that the request carries the seat token of the given player. Matches
+// stored without seat tokens predate them and remain open to either player.
+func authorizeSeat(req *http.Request, settings matchSettings, player byte) (status int, err error) {
+	token, _ := bearerToken(req)
+	return authorizeSeatToken(token, settings, player)
+}
+
+// authorizeSeatToken checks a seat token presented outside of HTTP, such as over GTP. An empty
+// token counts as missing.
+func authorizeSeatToken(token string, settings matchSettings, player byte) (status int, err error) {
+	expected := settings.seatHash(player)
+	if expected == "" {
+		return http.StatusOK, nil
+	}
+	if token == "" {
+		return http.StatusUnauthorized, errMissingSeatToken
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSeatToken(token)), []byte(expected)) != 1 {
+		return http.StatusForbidden, errWrongSeatToken
+	}
+	return http.StatusOK, nil
+}
+
+// isAdmin reports whether the request carries the administrator's bearer token.
+func isAdmin(req *http.Request) bool {
+	expected := os.Getenv(adminTokenEnv)
+	token, ok := bearerToken(req)
+	return ok && expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
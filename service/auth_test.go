@@ -0,0 +1,52 @@
+package service
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+func TestSeatTokensAreUniqueAndHashed(t *testing.T) {
+	first, err := newSeatToken()
+	if err != nil {
+		t.Errorf("Error generating seat token: %v", err)
+	}
+	second, _ := newSeatToken()
+	if first == second || len(first) != seatTokenBytes*2 {
+		t.Errorf("Expected distinct %d character seat tokens, got %s and %s", seatTokenBytes*2, first, second)
+	}
+	if hashSeatToken(first) == first || hashSeatToken(first) != hashSeatToken(first) {
+		t.Error("Expected seat token hashes to be stable and differ from the token")
+	}
+}
+
+func TestAuthorizeSeat(t *testing.T) {
+	settings := matchSettings{
+		BlackSeatHash: hashSeatToken("black-secret"),
+		WhiteSeatHash: hashSeatToken("white-secret"),
+	}
+
+	request, _ := http.NewRequest("POST", "/matches/1234/moves", nil)
+	status, err := authorizeSeat(request, settings, gogo.PlayerBlack)
+	if status != http.StatusUnauthorized || err == nil {
+		t.Errorf("Expected a missing token to be unauthorized, got %d", status)
+	}
+
+	request.Header.Set("Authorization", "Bearer white-secret")
+	status, err = authorizeSeat(request, settings, gogo.PlayerBlack)
+	if status != http.StatusForbidden || err == nil {
+		t.Errorf("Expected white's token to be forbidden for black, got %d", status)
+	}
+
+	request.Header.Set("Authorization", "bearer black-secret")
+	status, err = authorizeSeat(request, settings, gogo.PlayerBlack)
+	if status != http.StatusOK || err != nil {
+		t.Errorf("Expected black's token to authorize black, got %d: %v", status, err)
+	}
+
+	status, err = authorizeSeat(request, matchSettings{}, gogo.PlayerWhite)
+	if status != http.StatusOK || err != nil {
+		t.Errorf("Expected a match without seat tokens to stay open, got %d: %v", status, err)
+	}
+}
@@ -0,0 +1,182 @@
+package service
+
+import (
+	"strconv"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+// neighbours returns the points on the board orthogonally adjacent to the given coordinate.
+func neighbours(positions [][]byte, c gogo.Coordinate) (adjacent []gogo.Coordinate) {
+	candidates := []gogo.Coordinate{
+		{X: c.X - 1, Y: c.Y},
+		{X: c.X + 1, Y: c.Y},
+		{X: c.X, Y: c.Y - 1},
+		{X: c.X, Y: c.Y + 1},
+	}
+	for _, n := range candidates {
+		if n.X >= 0 && n.X < len(positions) && n.Y >= 0 && n.Y < len(positions[n.X]) {
+			adjacent = append(adjacent, n)
+		}
+	}
+	return
+}
+
+// liberties returns every empty point adjacent to at least one of the player's stones, in board order.
+func liberties(positions [][]byte, player byte) (points []gogo.Coordinate) {
+	for x := range positions {
+		for y := range positions[x] {
+			if positions[x][y] != 0 {
+				continue
+			}
+			for _, n := range neighbours(positions, gogo.Coordinate{X: x, Y: y}) {
+				if positions[n.X][n.Y] == player {
+					points = append(points, gogo.Coordinate{X: x, Y: y})
+					break
+				}
+			}
+		}
+	}
+	return
+}
+
+// chain is a group of orthogonally connected stones belonging to a single player.
+type chain struct {
+	Player    byte
+	Stones    []gogo.Coordinate
+	Liberties []gogo.Coordinate
+}
+
+// chains flood-fills the board and returns every chain on it, ordered by the first stone found in board order.
+func chains(positions [][]byte) (result []chain) {
+	visited := make([][]bool, len(positions))
+	for x := range positions {
+		visited[x] = make([]bool, len(positions[x]))
+	}
+
+	for x := range positions {
+		for y := range positions[x] {
+			if positions[x][y] == 0 || visited[x][y] {
+				continue
+			}
+			result = append(result, floodFill(positions, visited, gogo.Coordinate{X: x, Y: y}))
+		}
+	}
+	return
+}
+
+func floodFill(positions [][]byte, visited [][]bool, start gogo.Coordinate) (found chain) {
+	found.Player = positions[start.X][start.Y]
+	seenLiberty := make(map[gogo.Coordinate]bool)
+	stack := []gogo.Coordinate{start}
+	visited[start.X][start.Y] = true
+
+	for len(stack) > 0 {
+		stone := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		found.Stones = append(found.Stones, stone)
+
+		for _, n := range neighbours(positions, stone) {
+			switch positions[n.X][n.Y] {
+			case found.Player:
+				if !visited[n.X][n.Y] {
+					visited[n.X][n.Y] = true
+					stack = append(stack, n)
+				}
+			case 0:
+				if !seenLiberty[n] {
+					seenLiberty[n] = true
+					found.Liberties = append(found.Liberties, n)
+				}
+			}
+		}
+	}
+	return
+}
+
+// countStones returns the number of stones the player has on the board.
+func countStones(positions [][]byte, player byte) (count int) {
+	for x := range positions {
+		for y := range positions[x] {
+			if positions[x][y] == player {
+				count++
+			}
+		}
+	}
+	return
+}
+
+// handicapPoints returns the star points on which handicap stones are placed, following the
+// fixed placement order used by GTP (corners first, then the side star points, with the center
+// taking the odd stone).
+func handicapPoints(gridSize int, stones int) (points []gogo.Coordinate) {
+	low := 3
+	if gridSize < 13 {
+		low = 2
+	}
+	mid := gridSize / 2
+	high := gridSize - 1 - low
+
+	corners := []gogo.Coordinate{{X: low, Y: low}, {X: high, Y: high}, {X: low, Y: high}, {X: high, Y: low}}
+	sides := []gogo.Coordinate{{X: low, Y: mid}, {X: high, Y: mid}, {X: mid, Y: low}, {X: mid, Y: high}}
+	center := gogo.Coordinate{X: mid, Y: mid}
+
+	switch {
+	case stones < 2:
+		return
+	case stones <= 4:
+		points = append(points, corners[:stones]...)
+	case stones <= 7:
+		points = append(points, corners...)
+		points = append(points, sides[:(stones-4)/2*2]...)
+	default:
+		points = append(points, corners...)
+		points = append(points, sides...)
+	}
+	if stones >= 5 && stones%2 == 1 {
+		points = append(points, center)
+	}
+	return
+}
+
+// starPoints returns the points marked on an empty board: the nine handicap points on 19x19, and
+// the corners and center on smaller boards.
+func starPoints(gridSize int) []gogo.Coordinate {
+	if gridSize >= 19 {
+		return handicapPoints(gridSize, 9)
+	}
+	return handicapPoints(gridSize, 5)
+}
+
+// columnLabel names a board column the way Go software does: A to T, skipping I.
+func columnLabel(x int) string {
+	letter := 'A' + rune(x)
+	if letter >= 'I' {
+		letter++
+	}
+	return string(letter)
+}
+
+// rowLabel numbers a board row from the bottom edge, which is row 1.
+func rowLabel(gridSize int, y int) string {
+	return strconv.Itoa(gridSize - y)
+}
+
+// positionAt rebuilds a match board as it stood after the given moves, replaying them through the
+// engine from the match's initial handicap position.
+func positionAt(gridSize int, settings matchSettings, moves []matchMove) (board gogo.GameBoard, err error) {
+	board = gogo.NewMatch(gridSize, "", "").GameBoard
+	for _, point := range handicapPoints(gridSize, settings.Handicap) {
+		board.Positions[point.X][point.Y] = gogo.PlayerBlack
+	}
+	for _, move := range moves {
+		if move.Position == nil {
+			continue
+		}
+		board, err = board.PerformMove(gogo.Move{Player: move.Player, Position: *move.Position})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
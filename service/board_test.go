@@ -0,0 +1,145 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+func TestNeighboursStayOnBoard(t *testing.T) {
+	positions := gogo.NewMatch(9, "black", "white").GameBoard.Positions
+
+	corner := neighbours(positions, gogo.Coordinate{X: 0, Y: 0})
+	if len(corner) != 2 {
+		t.Errorf("Expected a corner point to have 2 neighbours, got %d", len(corner))
+	}
+	edge := neighbours(positions, gogo.Coordinate{X: 8, Y: 4})
+	if len(edge) != 3 {
+		t.Errorf("Expected an edge point to have 3 neighbours, got %d", len(edge))
+	}
+	center := neighbours(positions, gogo.Coordinate{X: 4, Y: 4})
+	if len(center) != 4 {
+		t.Errorf("Expected a center point to have 4 neighbours, got %d", len(center))
+	}
+}
+
+func TestLibertiesAreAdjacentEmptyPoints(t *testing.T) {
+	positions := gogo.NewMatch(9, "black", "white").GameBoard.Positions
+	positions[0][0] = gogo.PlayerBlack
+	positions[0][1] = gogo.PlayerWhite
+	positions[4][4] = gogo.PlayerBlack
+	positions[4][5] = gogo.PlayerBlack
+
+	black := liberties(positions, gogo.PlayerBlack)
+	// 0,0 only has 1,0 free; the 4,4-4,5 pair has six distinct empty neighbours.
+	if len(black) != 7 {
+		t.Errorf("Expected black to have 7 liberties, got %d: %v", len(black), black)
+	}
+	for _, p := range black {
+		if positions[p.X][p.Y] != 0 {
+			t.Errorf("Liberty %v is not an empty point", p)
+		}
+	}
+
+	white := liberties(positions, gogo.PlayerWhite)
+	if len(white) != 2 {
+		t.Errorf("Expected white to have 2 liberties, got %d: %v", len(white), white)
+	}
+}
+
+func TestChainsGroupConnectedStones(t *testing.T) {
+	positions := gogo.NewMatch(9, "black", "white").GameBoard.Positions
+	positions[0][0] = gogo.PlayerBlack
+	positions[0][1] = gogo.PlayerBlack
+	positions[1][1] = gogo.PlayerBlack
+	positions[1][0] = gogo.PlayerWhite
+	positions[5][5] = gogo.PlayerWhite
+	positions[6][6] = gogo.PlayerWhite
+
+	found := chains(positions)
+	if len(found) != 4 {
+		t.Fatalf("Expected 4 chains, got %d: %+v", len(found), found)
+	}
+
+	black := found[0]
+	if black.Player != gogo.PlayerBlack || len(black.Stones) != 3 {
+		t.Errorf("Expected first chain to be black's three stones, got %+v", black)
+	}
+	// 0,2 1,2 and 2,1 are free; 1,0 is a white stone.
+	if len(black.Liberties) != 3 {
+		t.Errorf("Expected black chain to have 3 liberties, got %d: %v", len(black.Liberties), black.Liberties)
+	}
+
+	atari := found[1]
+	if atari.Player != gogo.PlayerWhite || len(atari.Stones) != 1 || len(atari.Liberties) != 1 {
+		t.Errorf("Expected white stone at 1,0 to be a single stone in atari, got %+v", atari)
+	}
+
+	for _, c := range found[2:] {
+		if len(c.Stones) != 1 || len(c.Liberties) != 4 {
+			t.Errorf("Diagonal stones should not connect, got %+v", c)
+		}
+	}
+}
+
+func TestHandicapPointsFollowStandardPlacement(t *testing.T) {
+	expected := map[int][]gogo.Coordinate{
+		2: {{X: 3, Y: 3}, {X: 15, Y: 15}},
+		3: {{X: 3, Y: 3}, {X: 15, Y: 15}, {X: 3, Y: 15}},
+		5: {{X: 3, Y: 3}, {X: 15, Y: 15}, {X: 3, Y: 15}, {X: 15, Y: 3}, {X: 9, Y: 9}},
+		6: {{X: 3, Y: 3}, {X: 15, Y: 15}, {X: 3, Y: 15}, {X: 15, Y: 3}, {X: 3, Y: 9}, {X: 15, Y: 9}},
+		8: {{X: 3, Y: 3}, {X: 15, Y: 15}, {X: 3, Y: 15}, {X: 15, Y: 3}, {X: 3, Y: 9}, {X: 15, Y: 9}, {X: 9, Y: 3}, {X: 9, Y: 15}},
+	}
+	for stones, want := range expected {
+		got := handicapPoints(19, stones)
+		if len(got) != len(want) {
+			t.Errorf("Expected %d points for a %d stone handicap, got %v", len(want), stones, got)
+			continue
+		}
+		for idx := range want {
+			if got[idx] != want[idx] {
+				t.Errorf("Handicap %d: expected %v at index %d, got %v", stones, want[idx], idx, got[idx])
+			}
+		}
+	}
+
+	for stones := 2; stones <= 9; stones++ {
+		if len(handicapPoints(9, stones)) != stones || len(handicapPoints(13, stones)) != stones {
+			t.Errorf("Expected %d handicap points on every supported grid size", stones)
+		}
+	}
+	if handicapPoints(9, 9)[0] != (gogo.Coordinate{X: 2, Y: 2}) {
+		t.Errorf("Expected 9x9 handicap stones to sit on the third line, got %v", handicapPoints(9, 9)[0])
+	}
+	if handicapPoints(13, 9)[8] != (gogo.Coordinate{X: 6, Y: 6}) {
+		t.Errorf("Expected the odd stone on 13x13 to sit on tengen, got %v", handicapPoints(13, 9)[8])
+	}
+}
+
+func TestBoardLabelsFollowGoConvention(t *testing.T) {
+	if columnLabel(0) != "A" || columnLabel(7) != "H" || columnLabel(8) != "J" || columnLabel(18) != "T" {
+		t.Errorf("Expected columns A to T skipping I, got %s %s %s %s", columnLabel(0), columnLabel(7), columnLabel(8), columnLabel(18))
+	}
+	if rowLabel(19, 0) != "19" || rowLabel(19, 18) != "1" {
+		t.Errorf("Expected rows to be numbered from the bottom, got %s and %s", rowLabel(19, 0), rowLabel(19, 18))
+	}
+	if len(starPoints(19)) != 9 || len(starPoints(9)) != 5 {
+		t.Errorf("Expected 9 star points on 19x19 and 5 on 9x9, got %d and %d", len(starPoints(19)), len(starPoints(9)))
+	}
+}
+
+func TestPositionAtReplaysMovesOverHandicap(t *testing.T) {
+	moves := []matchMove{
+		{Player: gogo.PlayerWhite, Position: &gogo.Coordinate{X: 4, Y: 4}, Turn: 1},
+		{Player: gogo.PlayerBlack, Turn: 2},
+		{Player: gogo.PlayerWhite, Position: &gogo.Coordinate{X: 5, Y: 5}, Turn: 3},
+	}
+
+	board, err := positionAt(9, matchSettings{Handicap: 2}, moves[:2])
+	if err != nil {
+		t.Fatalf("Expected the moves to replay, got %v", err)
+	}
+	if board.Positions[2][2] != gogo.PlayerBlack || board.Positions[4][4] != gogo.PlayerWhite || board.Positions[5][5] != 0 {
+		t.Errorf("Expected the handicap stones and the first move only, got\n%s", asciiBoard(board.Positions))
+	}
+}
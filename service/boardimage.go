@@ -0,0 +1,260 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+const (
+	svgMediaType = "image/svg+xml"
+	pngMediaType = "image/png"
+
+	defaultImageSize = 512
+	minImageSize     = 128
+	maxImageSize     = 2048
+)
+
+var (
+	boardColor = color.RGBA{R: 0xdc, G: 0xb3, B: 0x5c, A: 0xff}
+	lineColor  = color.RGBA{R: 0x20, G: 0x20, B: 0x20, A: 0xff}
+	blackStone = color.RGBA{R: 0x10, G: 0x10, B: 0x10, A: 0xff}
+	whiteStone = color.RGBA{R: 0xf8, G: 0xf8, B: 0xf8, A: 0xff}
+)
+
+// boardPicture is a board position to be drawn, with the stone played last marked on it.
+type boardPicture struct {
+	Positions [][]byte
+	LastMove  *gogo.Coordinate
+	Size      int
+}
+
+// boardLayout places the intersections of a board inside a square image, leaving a margin of one
+// cell around the grid for the coordinates.
+type boardLayout struct {
+	gridSize int
+	cell     float64
+}
+
+func newBoardLayout(picture boardPicture) boardLayout {
+	gridSize := len(picture.Positions)
+	return boardLayout{gridSize: gridSize, cell: float64(picture.Size) / float64(gridSize+1)}
+}
+
+// point returns the image coordinates of a board intersection.
+func (l boardLayout) point(x int, y int) (float64, float64) {
+	return l.cell * (float64(x) + 1), l.cell * (float64(y) + 1)
+}
+
+func (l boardLayout) stoneRadius() float64 {
+	return l.cell * 0.48
+}
+
+// renderBoardSVG draws a board position as a scalable SVG image.
+func renderBoardSVG(picture boardPicture) []byte {
+	l := newBoardLayout(picture)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n",
+		picture.Size, picture.Size, picture.Size, picture.Size)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="%s"/>`+"\n", svgColor(boardColor))
+
+	first, _ := l.point(0, 0)
+	last, _ := l.point(l.gridSize-1, 0)
+	fmt.Fprintf(&b, `<g stroke="%s" stroke-width="%.2f">`+"\n", svgColor(lineColor), math.Max(1, l.cell/30))
+	for i := 0; i < l.gridSize; i++ {
+		at, _ := l.point(i, 0)
+		fmt.Fprintf(&b, `<line x1="%.2f" y1="%.2f" x2="%.2f" y2="%.2f"/>`+"\n", at, first, at, last)
+		fmt.Fprintf(&b, `<line x1="%.2f" y1="%.2f" x2="%.2f" y2="%.2f"/>`+"\n", first, at, last, at)
+	}
+	b.WriteString("</g>\n")
+	for _, star := range starPoints(l.gridSize) {
+		cx, cy := l.point(star.X, star.Y)
+		fmt.Fprintf(&b, `<circle cx="%.2f" cy="%.2f" r="%.2f" fill="%s"/>`+"\n", cx, cy, l.cell/10, svgColor(lineColor))
+	}
+
+	fmt.Fprintf(&b, `<g font-family="sans-serif" font-size="%.2f" fill="%s" text-anchor="middle" dominant-baseline="central">`+"\n",
+		l.cell*0.4, svgColor(lineColor))
+	edge := l.cell / 2
+	far := float64(picture.Size) - edge
+	for i := 0; i < l.gridSize; i++ {
+		at, _ := l.point(i, 0)
+		for _, y := range []float64{edge, far} {
+			fmt.Fprintf(&b, `<text x="%.2f" y="%.2f">%s</text>`+"\n", at, y, columnLabel(i))
+		}
+		for _, x := range []float64{edge, far} {
+			fmt.Fprintf(&b, `<text x="%.2f" y="%.2f">%s</text>`+"\n", x, at, rowLabel(l.gridSize, i))
+		}
+	}
+	b.WriteString("</g>\n")
+
+	for x := range picture.Positions {
+		for y, player := range picture.Positions[x] {
+			if player == 0 {
+				continue
+			}
+			fill, outline := stoneColors(player)
+			cx, cy := l.point(x, y)
+			fmt.Fprintf(&b, `<circle cx="%.2f" cy="%.2f" r="%.2f" fill="%s" stroke="%s" stroke-width="%.2f"/>`+"\n",
+				cx, cy, l.stoneRadius(), svgColor(fill), svgColor(outline), math.Max(1, l.cell/30))
+		}
+	}
+	if marker := picture.LastMove; marker != nil {
+		_, outline := stoneColors(picture.Positions[marker.X][marker.Y])
+		cx, cy := l.point(marker.X, marker.Y)
+		fmt.Fprintf(&b, `<circle cx="%.2f" cy="%.2f" r="%.2f" fill="none" stroke="%s" stroke-width="%.2f"/>`+"\n",
+			cx, cy, l.cell/4, svgColor(outline), math.Max(1, l.cell/15))
+	}
+	b.WriteString("</svg>\n")
+	return b.Bytes()
+}
+
+// renderBoardPNG draws a board position as a PNG image. The coordinates are drawn with a small
+// built-in bitmap font so that no font files need to ship with the service.
+func renderBoardPNG(picture boardPicture) ([]byte, error) {
+	l := newBoardLayout(picture)
+	img := image.NewRGBA(image.Rect(0, 0, picture.Size, picture.Size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: boardColor}, image.Point{}, draw.Src)
+
+	width := math.Max(1, math.Round(l.cell/30))
+	first, _ := l.point(0, 0)
+	last, _ := l.point(l.gridSize-1, 0)
+	for i := 0; i < l.gridSize; i++ {
+		at, _ := l.point(i, 0)
+		fillRect(img, at-width/2, first-width/2, at+width/2, last+width/2, lineColor)
+		fillRect(img, first-width/2, at-width/2, last+width/2, at+width/2, lineColor)
+	}
+	for _, star := range starPoints(l.gridSize) {
+		cx, cy := l.point(star.X, star.Y)
+		fillCircle(img, cx, cy, 0, l.cell/10, lineColor)
+	}
+
+	scale := math.Max(1, math.Floor(l.cell*0.4/glyphHeight))
+	edge := l.cell / 2
+	far := float64(picture.Size) - edge
+	for i := 0; i < l.gridSize; i++ {
+		at, _ := l.point(i, 0)
+		for _, y := range []float64{edge, far} {
+			drawText(img, columnLabel(i), at, y, scale, lineColor)
+		}
+		for _, x := range []float64{edge, far} {
+			drawText(img, rowLabel(l.gridSize, i), x, at, scale, lineColor)
+		}
+	}
+
+	outlineWidth := math.Max(1, l.cell/30)
+	for x := range picture.Positions {
+		for y, player := range picture.Positions[x] {
+			if player == 0 {
+				continue
+			}
+			fill, outline := stoneColors(player)
+			cx, cy := l.point(x, y)
+			fillCircle(img, cx, cy, 0, l.stoneRadius(), outline)
+			fillCircle(img, cx, cy, 0, l.stoneRadius()-outlineWidth, fill)
+		}
+	}
+	if marker := picture.LastMove; marker != nil {
+		_, outline := stoneColors(picture.Positions[marker.X][marker.Y])
+		cx, cy := l.point(marker.X, marker.Y)
+		markerWidth := math.Max(1, l.cell/15)
+		fillCircle(img, cx, cy, l.cell/4-markerWidth/2, l.cell/4+markerWidth/2, outline)
+	}
+
+	var b bytes.Buffer
+	err := png.Encode(&b, img)
+	return b.Bytes(), err
+}
+
+// stoneColors returns the fill of a player's stones and the contrasting color drawn around and on them.
+func stoneColors(player byte) (fill color.RGBA, outline color.RGBA) {
+	if player == gogo.PlayerWhite {
+		return whiteStone, blackStone
+	}
+	return blackStone, whiteStone
+}
+
+func svgColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// fillRect paints the pixels whose centers fall inside the rectangle.
+func fillRect(img *image.RGBA, x0 float64, y0 float64, x1 float64, y1 float64, c color.RGBA) {
+	for y := int(math.Round(y0)); y < int(math.Round(y1)); y++ {
+		for x := int(math.Round(x0)); x < int(math.Round(x1)); x++ {
+			blend(img, x, y, c, 1)
+		}
+	}
+}
+
+// fillCircle paints the ring between the inner and outer radii, or a disc when inner is zero,
+// shading edge pixels by their approximate coverage to smooth the outline.
+func fillCircle(img *image.RGBA, cx float64, cy float64, inner float64, outer float64, c color.RGBA) {
+	for y := int(cy - outer - 1); y <= int(cy+outer+1); y++ {
+		for x := int(cx - outer - 1); x <= int(cx+outer+1); x++ {
+			d := math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy)
+			coverage := math.Min(outer+0.5-d, 1)
+			if inner > 0 {
+				coverage = math.Min(coverage, d-inner+0.5)
+			}
+			if coverage > 0 {
+				blend(img, x, y, c, coverage)
+			}
+		}
+	}
+}
+
+func blend(img *image.RGBA, x int, y int, c color.RGBA, alpha float64) {
+	if !(image.Point{X: x, Y: y}.In(img.Rect)) {
+		return
+	}
+	current := img.RGBAAt(x, y)
+	mix := func(from uint8, to uint8) uint8 {
+		return uint8(math.Round(float64(from)*(1-alpha) + float64(to)*alpha))
+	}
+	img.SetRGBA(x, y, color.RGBA{R: mix(current.R, c.R), G: mix(current.G, c.G), B: mix(current.B, c.B), A: 0xff})
+}
+
+const (
+	glyphWidth  = 3
+	glyphHeight = 5
+)
+
+// glyphs is a 3x5 pixel font covering the board coordinates. Each row is a 3 bit mask, most
+// significant bit leftmost.
+var glyphs = map[rune][glyphHeight]uint8{
+	'0': {7, 5, 5, 5, 7}, '1': {2, 6, 2, 2, 7}, '2': {7, 1, 7, 4, 7}, '3': {7, 1, 7, 1, 7},
+	'4': {5, 5, 7, 1, 1}, '5': {7, 4, 7, 1, 7}, '6': {7, 4, 7, 5, 7}, '7': {7, 1, 2, 2, 2},
+	'8': {7, 5, 7, 5, 7}, '9': {7, 5, 7, 1, 7},
+	'A': {2, 5, 7, 5, 5}, 'B': {6, 5, 6, 5, 6}, 'C': {3, 4, 4, 4, 3}, 'D': {6, 5, 5, 5, 6},
+	'E': {7, 4, 6, 4, 7}, 'F': {7, 4, 6, 4, 4}, 'G': {3, 4, 5, 5, 3}, 'H': {5, 5, 7, 5, 5},
+	'J': {1, 1, 1, 5, 2}, 'K': {5, 5, 6, 5, 5}, 'L': {4, 4, 4, 4, 7}, 'M': {5, 7, 7, 5, 5},
+	'N': {6, 5, 5, 5, 5}, 'O': {2, 5, 5, 5, 2}, 'P': {6, 5, 6, 4, 4}, 'Q': {2, 5, 5, 6, 3},
+	'R': {6, 5, 6, 5, 5}, 'S': {3, 4, 2, 1, 6}, 'T': {7, 2, 2, 2, 2},
+}
+
+// drawText writes text centered on the given point, each font pixel drawn as a scale sized square.
+func drawText(img *image.RGBA, text string, cx float64, cy float64, scale float64, c color.RGBA) {
+	runes := []rune(text)
+	width := float64(len(runes)*(glyphWidth+1)-1) * scale
+	left := math.Round(cx - width/2)
+	top := math.Round(cy - glyphHeight*scale/2)
+	for i, r := range runes {
+		glyph := glyphs[r]
+		for row, bits := range glyph {
+			for col := 0; col < glyphWidth; col++ {
+				if bits&(1<<uint(glyphWidth-1-col)) == 0 {
+					continue
+				}
+				x := left + float64(i*(glyphWidth+1)+col)*scale
+				y := top + float64(row)*scale
+				fillRect(img, x, y, x+scale, y+scale, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+func TestRenderBoardSVGDrawsStonesAndLastMove(t *testing.T) {
+	positions := gogo.NewMatch(9, "black", "white").GameBoard.Positions
+	positions[2][6] = gogo.PlayerBlack
+	positions[4][4] = gogo.PlayerWhite
+
+	svg := string(renderBoardSVG(boardPicture{Positions: positions, LastMove: &gogo.Coordinate{X: 4, Y: 4}, Size: 200}))
+	if !strings.HasPrefix(svg, "<svg") || !strings.Contains(svg, `width="200"`) {
+		t.Errorf("Expected a 200 pixel SVG document, got %s", svg)
+	}
+	if strings.Count(svg, "<line") != 18 {
+		t.Errorf("Expected 18 grid lines on a 9x9 board, got %d", strings.Count(svg, "<line"))
+	}
+	// Five star points, two stones and the last move marker.
+	if strings.Count(svg, "<circle") != 8 {
+		t.Errorf("Expected 8 circles, got %d", strings.Count(svg, "<circle"))
+	}
+	if !strings.Contains(svg, ">J</text>") || strings.Contains(svg, ">I</text>") {
+		t.Error("Expected the column labels to skip I")
+	}
+}
+
+func TestRenderBoardPNGDrawsStones(t *testing.T) {
+	positions := gogo.NewMatch(9, "black", "white").GameBoard.Positions
+	positions[0][0] = gogo.PlayerBlack
+	positions[8][8] = gogo.PlayerWhite
+
+	b, err := renderBoardPNG(boardPicture{Positions: positions, Size: 200})
+	if err != nil {
+		t.Fatalf("Expected the board to render, got %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("Expected a valid PNG, got %v", err)
+	}
+	if img.Bounds().Dx() != 200 || img.Bounds().Dy() != 200 {
+		t.Errorf("Expected a 200x200 image, got %v", img.Bounds())
+	}
+	l := newBoardLayout(boardPicture{Positions: positions, Size: 200})
+	for point, expected := range map[gogo.Coordinate]uint32{{X: 0, Y: 0}: uint32(blackStone.R), {X: 8, Y: 8}: uint32(whiteStone.R)} {
+		x, y := l.point(point.X, point.Y)
+		if r, _, _, _ := img.At(int(x)+2, int(y)+2).RGBA(); r>>8 != expected {
+			t.Errorf("Expected the stone at %v to be drawn, got red %d", point, r>>8)
+		}
+	}
+}
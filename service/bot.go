@@ -0,0 +1,429 @@
+package service
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+const (
+	// botPrefix marks a player name as one of the built-in computer opponents, e.g. "bot:random".
+	botPrefix = "bot:"
+
+	defaultBotThinkingTime = time.Second
+	maxBotThinkingTime     = 10 * time.Second
+
+	// botClockMargin is how long before its time runs out a bot on the clock stops thinking, to
+	// leave time for its move to be stored.
+	botClockMargin = 500 * time.Millisecond
+)
+
+// botPlayer chooses moves for a computer opponent. A nil position is a pass, unless the bot
+// resigns instead.
+type botPlayer interface {
+	chooseMove(turn botTurn) (position *gogo.Coordinate, resign bool)
+}
+
+// botReleaser is implemented by bots that hold on to resources for a match, which they can let
+// go of once it is over.
+type botReleaser interface {
+	release(matchID string)
+}
+
+// botThinker is implemented by bots that search for as long as the turn allows. Only they can be
+// given a thinking time; the others answer as soon as they have picked a move.
+type botThinker interface {
+	searches()
+}
+
+// botTurn is everything a bot may consider when choosing a move. Bots draw all their randomness
+// from Rand, so a given seed always produces the same game against the same opponent.
+type botTurn struct {
+	MatchID  string
+	Board    gogo.GameBoard
+	Player   byte
+	Komi     float64
+	Handicap int
+	Moves    []matchMove
+	Rand     *rand.Rand
+	Deadline time.Time
+}
+
+var botPlayers = map[string]botPlayer{
+	"random":         randomBot{},
+	"greedy-capture": greedyCaptureBot{},
+	"mcts":           mctsBot{playouts: defaultMCTSPlayouts},
+}
+
+func isBotName(name string) bool {
+	return strings.HasPrefix(name, botPrefix)
+}
+
+// isKnownPlayer rejects names that claim to be a bot but name none of the built-in ones.
+func isKnownPlayer(name string) bool {
+	_, ok := botPlayers[strings.TrimPrefix(name, botPrefix)]
+	return !isBotName(name) || ok
+}
+
+// botFor returns the bot playing the given side of a match, if that side is played by one.
+func botFor(match gogo.Match, player byte) (bot botPlayer, ok bool) {
+	name := match.PlayerBlack
+	if player == gogo.PlayerWhite {
+		name = match.PlayerWhite
+	}
+	if !isBotName(name) {
+		return nil, false
+	}
+	bot, ok = botPlayers[strings.TrimPrefix(name, botPrefix)]
+	return
+}
+
+// isThinkingBot reports whether the named player is a bot that makes use of its thinking time.
+func isThinkingBot(name string) bool {
+	if !isBotName(name) {
+		return false
+	}
+	_, ok := botPlayers[strings.TrimPrefix(name, botPrefix)].(botThinker)
+	return ok
+}
+
+// withoutBots withholds the tokens of seats held by bots. Their hashes are still stored, so
+// nobody else can move for a bot.
+func (tokens seats) withoutBots(match gogo.Match) seats {
+	if _, ok := botFor(match, gogo.PlayerBlack); ok {
+		tokens.Black = ""
+	}
+	if _, ok := botFor(match, gogo.PlayerWhite); ok {
+		tokens.White = ""
+	}
+	return tokens
+}
+
+// botRunner plays the moves of computer opponents. A bot's reply is worked out in the background
+// once it is its turn, and submitted through the same path as any other move. Replies are worked
+// out by a pool of at most one worker per CPU. A match waits in the queue at most once and is only
+// ever worked on by one worker at a time; should it change while its bot is thinking, it is queued
+// again once the bot is done.
+type botRunner struct {
+	repo    matchRepository
+	hub     *matchHub
+	workers int
+
+	mu      sync.Mutex
+	queue   []string
+	jobs    map[string]int
+	running int
+	pending sync.WaitGroup
+}
+
+// States of a match in the bot runner.
+const (
+	botQueued = iota + 1
+	botThinking
+	// botThinkingStale is a match that changed while its bot was thinking.
+	botThinkingStale
+)
+
+func newBotRunner(repo matchRepository, hub *matchHub) *botRunner {
+	return &botRunner{repo: repo, hub: hub, workers: runtime.NumCPU(), jobs: map[string]int{}}
+}
+
+// respond lets the match's bot move, if it has one and it is its turn. It is given the players'
+// names so that matches between people cost nothing.
+func (runner *botRunner) respond(matchID string, playerBlack string, playerWhite string) {
+	if !isBotName(playerBlack) && !isBotName(playerWhite) {
+		return
+	}
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	switch runner.jobs[matchID] {
+	case botQueued, botThinkingStale:
+		// The bot will look at the match as it stands when its turn comes up.
+	case botThinking:
+		runner.jobs[matchID] = botThinkingStale
+	default:
+		runner.enqueue(matchID)
+	}
+}
+
+// enqueue adds the match to the queue, starting another worker if the pool is not yet full. The
+// caller must hold the runner's lock.
+func (runner *botRunner) enqueue(matchID string) {
+	runner.jobs[matchID] = botQueued
+	runner.queue = append(runner.queue, matchID)
+	runner.pending.Add(1)
+	if runner.running < runner.workers {
+		runner.running++
+		go runner.work()
+	}
+}
+
+// work plays the turns of queued matches until the queue is empty.
+func (runner *botRunner) work() {
+	for {
+		runner.mu.Lock()
+		if len(runner.queue) == 0 {
+			runner.running--
+			runner.mu.Unlock()
+			return
+		}
+		matchID := runner.queue[0]
+		runner.queue = runner.queue[1:]
+		runner.jobs[matchID] = botThinking
+		runner.mu.Unlock()
+
+		if err := runner.playTurn(matchID); err != nil {
+			fmt.Printf("Bot failed to move in match %s: %v\n", matchID, err)
+		}
+
+		runner.mu.Lock()
+		if runner.jobs[matchID] == botThinkingStale {
+			runner.enqueue(matchID)
+		} else {
+			delete(runner.jobs, matchID)
+		}
+		runner.pending.Done()
+		runner.mu.Unlock()
+	}
+}
+
+// release forgets the match's queued turn and lets its bots free whatever they kept for it, for a
+// match that is about to be deleted. A bot already thinking about the match is left to fail when
+// it comes to submit its move.
+func (runner *botRunner) release(match gogo.Match) {
+	runner.mu.Lock()
+	if runner.jobs[match.ID] == botQueued {
+		for idx, queued := range runner.queue {
+			if queued == match.ID {
+				runner.queue = append(runner.queue[:idx], runner.queue[idx+1:]...)
+				break
+			}
+		}
+		delete(runner.jobs, match.ID)
+		runner.pending.Done()
+	}
+	runner.mu.Unlock()
+	releaseBots(match)
+}
+
+// wait blocks until every reply in progress or queued has been submitted.
+func (runner *botRunner) wait() {
+	runner.pending.Wait()
+}
+
+func (runner *botRunner) playTurn(matchID string) error {
+	state, err := runner.repo.loadMatch(matchID)
+	if err != nil {
+		return err
+	}
+	match, settings, moves := state.Match, state.Settings, state.Moves
+	if matchStatus(moves) == matchStatusFinished {
+		releaseBots(match)
+		return nil
+	}
+	player := nextPlayer(settings, moves)
+	bot, ok := botFor(match, player)
+	if !ok {
+		return nil
+	}
+
+	turn := botTurnFor(state, player)
+	var moveRequest newMoveRequest
+	moveRequest.Player = player
+	position, resign := bot.chooseMove(turn)
+	if position != nil {
+		moveRequest.Position = &boardPosition{X: position.X, Y: position.Y}
+	}
+	// The bot holds its own seat, so there is no token to check.
+	check := func(matchSettings, int) (int, error) { return http.StatusOK, nil }
+	mdr, _, status, err := submitMove(runner.repo, matchID, moveRequest, resign, check)
+	if status == http.StatusBadRequest {
+		fmt.Printf("Bot chose an illegal move in match %s, resigning: %v\n", matchID, err)
+		mdr, _, status, err = submitMove(runner.repo, matchID, newMoveRequest{Player: player}, true, check)
+	}
+	if err == errOutOfTime {
+		// The bot ran out of time, which ended the match.
+		runner.hub.publish(matchID, mdr)
+		releaseBots(match)
+		return nil
+	}
+	if status == http.StatusConflict && err != errVersionConflict {
+		// The match moved on while the bot was thinking, e.g. its opponent resigned.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	runner.hub.publish(matchID, mdr)
+	if mdr.Status == matchStatusFinished {
+		releaseBots(match)
+	}
+	return nil
+}
+
+// botTurnFor sets up a bot's turn as the given player in a match: it may think for the match's
+// thinking time, but stops short of running out of time on the clock.
+func botTurnFor(state matchState, player byte) botTurn {
+	match, settings, moves := state.Match, state.Settings, state.Moves
+	thinkingTime := settings.BotThinkingTime
+	if thinkingTime <= 0 {
+		thinkingTime = defaultBotThinkingTime
+	}
+	turn := botTurn{
+		MatchID:  match.ID,
+		Board:    match.GameBoard,
+		Player:   player,
+		Komi:     settings.Komi,
+		Handicap: settings.Handicap,
+		Moves:    moves,
+		Rand:     rand.New(rand.NewSource(settings.BotSeed + int64(len(moves)))),
+		Deadline: time.Now().Add(thinkingTime),
+	}
+	if settings.TimeControl.System != "" {
+		clocks := runClocks(settings, match.StartTime, moves, state.Undos)
+		if deadline := clocks.Deadline.Add(-botClockMargin); deadline.Before(turn.Deadline) {
+			turn.Deadline = deadline
+		}
+	}
+	return turn
+}
+
+// releaseBots lets the bots of a finished match free whatever they kept for it.
+func releaseBots(match gogo.Match) {
+	for _, player := range []byte{gogo.PlayerBlack, gogo.PlayerWhite} {
+		if bot, ok := botFor(match, player); ok {
+			if releaser, ok := bot.(botReleaser); ok {
+				releaser.release(match.ID)
+			}
+		}
+	}
+}
+
+// randomBot plays a random legal move, never filling its own eyes, and passes when none is left.
+type randomBot struct{}
+
+func (randomBot) chooseMove(turn botTurn) (*gogo.Coordinate, bool) {
+	for _, candidate := range botCandidates(turn) {
+		if isLegal(turn.Board, turn.Player, candidate) {
+			return &candidate, false
+		}
+	}
+	return nil, false
+}
+
+// greedyCaptureBot plays whichever move captures the most stones, preferring moves that put
+// opposing chains in atari when nothing can be captured. Ties are broken at random.
+type greedyCaptureBot struct{}
+
+func (greedyCaptureBot) chooseMove(turn botTurn) (*gogo.Coordinate, bool) {
+	positions := turn.Board.Positions
+	onBoard := chains(positions)
+	ranked := rankedMoves{}
+	for _, candidate := range botCandidates(turn) {
+		captured, ataris := captureScore(onBoard, turn.Player, candidate)
+		ranked.points = append(ranked.points, candidate)
+		ranked.scores = append(ranked.scores, captured*len(positions)*len(positions)+ataris)
+	}
+	sort.Stable(ranked)
+	for _, candidate := range ranked.points {
+		if isLegal(turn.Board, turn.Player, candidate) {
+			return &candidate, false
+		}
+	}
+	return nil, false
+}
+
+// rankedMoves sorts candidate points by descending score.
+type rankedMoves struct {
+	points []gogo.Coordinate
+	scores []int
+}
+
+func (r rankedMoves) Len() int           { return len(r.points) }
+func (r rankedMoves) Less(i, j int) bool { return r.scores[i] > r.scores[j] }
+func (r rankedMoves) Swap(i, j int) {
+	r.points[i], r.points[j] = r.points[j], r.points[i]
+	r.scores[i], r.scores[j] = r.scores[j], r.scores[i]
+}
+
+// botCandidates lists the empty points a bot may consider, other than its own eyes, in random order.
+func botCandidates(turn botTurn) (candidates []gogo.Coordinate) {
+	positions := turn.Board.Positions
+	for x := range positions {
+		for y := range positions[x] {
+			point := gogo.Coordinate{X: x, Y: y}
+			if positions[x][y] == 0 && !isEye(positions, turn.Player, point) {
+				candidates = append(candidates, point)
+			}
+		}
+	}
+	for i := len(candidates) - 1; i > 0; i-- {
+		j := turn.Rand.Intn(i + 1)
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	}
+	return
+}
+
+// isLegal asks the engine whether a stone may be played, so that bots respect every rule the
+// engine enforces.
+func isLegal(board gogo.GameBoard, player byte, point gogo.Coordinate) bool {
+	_, err := board.PerformMove(gogo.Move{Player: player, Position: point})
+	return err == nil
+}
+
+// isEye reports whether an empty point is a simple eye of the player's: every neighbour is the
+// player's stone, and the opponent holds at most one diagonal, or none on the edge of the board.
+func isEye(positions [][]byte, player byte, point gogo.Coordinate) bool {
+	for _, n := range neighbours(positions, point) {
+		if positions[n.X][n.Y] != player {
+			return false
+		}
+	}
+	size := len(positions)
+	enemies, offBoard := 0, 0
+	for _, d := range []gogo.Coordinate{{X: -1, Y: -1}, {X: -1, Y: 1}, {X: 1, Y: -1}, {X: 1, Y: 1}} {
+		x, y := point.X+d.X, point.Y+d.Y
+		if x < 0 || y < 0 || x >= size || y >= size {
+			offBoard++
+		} else if positions[x][y] == opponent(player) {
+			enemies++
+		}
+	}
+	if offBoard > 0 {
+		return enemies == 0
+	}
+	return enemies < 2
+}
+
+// captureScore counts the opposing stones a move would capture and the opposing chains it would
+// leave with a single liberty, given the chains on the board.
+func captureScore(onBoard []chain, player byte, point gogo.Coordinate) (captured int, ataris int) {
+	for _, c := range onBoard {
+		if c.Player != opponent(player) || !containsPoint(c.Liberties, point) {
+			continue
+		}
+		switch len(c.Liberties) {
+		case 1:
+			captured += len(c.Stones)
+		case 2:
+			ataris++
+		}
+	}
+	return
+}
+
+func containsPoint(points []gogo.Coordinate, point gogo.Coordinate) bool {
+	for _, p := range points {
+		if p == point {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+package service
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+func newBotTurn(positions [][]byte, player byte, seed int64) botTurn {
+	return botTurn{
+		Board:    gogo.GameBoard{Positions: positions},
+		Player:   player,
+		Komi:     defaultKomi,
+		Rand:     rand.New(rand.NewSource(seed)),
+		Deadline: time.Now().Add(time.Minute),
+	}
+}
+
+func TestRandomBotIsDeterministicForASeed(t *testing.T) {
+	positions := gogo.NewMatch(9, "black", "bot:random").GameBoard.Positions
+	positions[4][4] = gogo.PlayerBlack
+
+	first, _ := randomBot{}.chooseMove(newBotTurn(positions, gogo.PlayerWhite, 7))
+	second, _ := randomBot{}.chooseMove(newBotTurn(positions, gogo.PlayerWhite, 7))
+	if first == nil || second == nil || *first != *second {
+		t.Fatalf("Expected the same seed to produce the same move, got %v and %v", first, second)
+	}
+	if positions[first.X][first.Y] != 0 {
+		t.Errorf("Expected the bot to play on an empty point, got %v", *first)
+	}
+}
+
+func TestRandomBotPassesRatherThanFillingItsEyes(t *testing.T) {
+	positions := gogo.NewMatch(9, "black", "bot:random").GameBoard.Positions
+	for x := range positions {
+		for y := range positions[x] {
+			positions[x][y] = gogo.PlayerWhite
+		}
+	}
+	positions[0][0] = 0
+	positions[4][4] = 0
+
+	if move, _ := (randomBot{}).chooseMove(newBotTurn(positions, gogo.PlayerWhite, 1)); move != nil {
+		t.Errorf("Expected the bot to pass instead of filling an eye, got %v", *move)
+	}
+}
+
+func TestIsEyeRejectsFalseEyes(t *testing.T) {
+	positions := gogo.NewMatch(9, "black", "white").GameBoard.Positions
+	for _, p := range []gogo.Coordinate{{X: 3, Y: 4}, {X: 5, Y: 4}, {X: 4, Y: 3}, {X: 4, Y: 5}} {
+		positions[p.X][p.Y] = gogo.PlayerBlack
+	}
+	center := gogo.Coordinate{X: 4, Y: 4}
+	if !isEye(positions, gogo.PlayerBlack, center) {
+		t.Error("Expected a point surrounded by black stones to be black's eye")
+	}
+	if isEye(positions, gogo.PlayerWhite, center) {
+		t.Error("Expected a point surrounded by black stones not to be white's eye")
+	}
+	positions[3][3] = gogo.PlayerWhite
+	positions[5][5] = gogo.PlayerWhite
+	if isEye(positions, gogo.PlayerBlack, center) {
+		t.Error("Expected two opposing diagonals to make a false eye")
+	}
+}
+
+func TestGreedyCaptureBotTakesTheLargestCapture(t *testing.T) {
+	positions := gogo.NewMatch(9, "bot:greedy-capture", "white").GameBoard.Positions
+	// A lone white stone in atari in the corner...
+	positions[0][0] = gogo.PlayerWhite
+	positions[1][0] = gogo.PlayerBlack
+	// ...and a pair of white stones in atari, which can be taken at 6,4.
+	positions[4][4] = gogo.PlayerWhite
+	positions[5][4] = gogo.PlayerWhite
+	for _, p := range []gogo.Coordinate{{X: 3, Y: 4}, {X: 4, Y: 3}, {X: 4, Y: 5}, {X: 5, Y: 3}, {X: 5, Y: 5}} {
+		positions[p.X][p.Y] = gogo.PlayerBlack
+	}
+
+	for seed := int64(0); seed < 5; seed++ {
+		move, _ := greedyCaptureBot{}.chooseMove(newBotTurn(positions, gogo.PlayerBlack, seed))
+		if move == nil || *move != (gogo.Coordinate{X: 6, Y: 4}) {
+			t.Errorf("Expected the bot to capture two stones at 6,4 with seed %d, got %v", seed, move)
+		}
+	}
+}
+
+func TestPlayoutBoardCapturesAndEnforcesKo(t *testing.T) {
+	positions := gogo.NewMatch(9, "black", "white").GameBoard.Positions
+	// Black and white stones facing each other around 1,1 and 2,1, with white's stone at 1,1.
+	for _, p := range []gogo.Coordinate{{X: 0, Y: 1}, {X: 1, Y: 0}, {X: 1, Y: 2}} {
+		positions[p.X][p.Y] = gogo.PlayerBlack
+	}
+	for _, p := range []gogo.Coordinate{{X: 3, Y: 1}, {X: 2, Y: 0}, {X: 2, Y: 2}, {X: 1, Y: 1}} {
+		positions[p.X][p.Y] = gogo.PlayerWhite
+	}
+	board := newPlayoutBoard(positions)
+	point := func(x int, y int) int { return x*board.size + y }
+
+	if !board.play(gogo.PlayerBlack, point(2, 1)) {
+		t.Fatal("Expected black to capture at 2,1")
+	}
+	if board.points[point(1, 1)] != 0 {
+		t.Error("Expected white's stone at 1,1 to be captured")
+	}
+	if board.play(gogo.PlayerWhite, point(1, 1)) {
+		t.Error("Expected white's immediate recapture at 1,1 to be forbidden by ko")
+	}
+	board.play(gogo.PlayerWhite, passPoint)
+	board.play(gogo.PlayerBlack, passPoint)
+	if !board.play(gogo.PlayerWhite, point(1, 1)) {
+		t.Error("Expected white to retake the ko after a pass")
+	}
+
+	if !board.play(gogo.PlayerBlack, point(8, 8)) || !board.play(gogo.PlayerWhite, point(8, 7)) {
+		t.Fatal("Expected open points to be playable")
+	}
+	board.play(gogo.PlayerWhite, point(7, 8))
+	if board.points[point(8, 8)] != 0 {
+		t.Error("Expected black's corner stone to be captured")
+	}
+	board.points[point(7, 7)] = gogo.PlayerWhite
+	board.ko = passPoint
+	if board.play(gogo.PlayerBlack, point(8, 8)) {
+		t.Error("Expected black's suicide at 8,8 to be rejected")
+	}
+}
+
+func TestMCTSBotCapturesStonesInAtari(t *testing.T) {
+	positions := gogo.NewMatch(9, "bot:mcts", "white").GameBoard.Positions
+	// A white chain of three stones across the middle, with its last liberty at 4,5.
+	for _, p := range []gogo.Coordinate{{X: 3, Y: 4}, {X: 4, Y: 4}, {X: 5, Y: 4}} {
+		positions[p.X][p.Y] = gogo.PlayerWhite
+	}
+	for _, p := range []gogo.Coordinate{{X: 2, Y: 4}, {X: 6, Y: 4}, {X: 3, Y: 3}, {X: 4, Y: 3}, {X: 5, Y: 3}, {X: 3, Y: 5}, {X: 5, Y: 5}} {
+		positions[p.X][p.Y] = gogo.PlayerBlack
+	}
+
+	move, _ := mctsBot{playouts: 2000}.chooseMove(newBotTurn(positions, gogo.PlayerBlack, 3))
+	if move == nil || *move != (gogo.Coordinate{X: 4, Y: 5}) {
+		t.Errorf("Expected the bot to capture at 4,5, got %v", move)
+	}
+
+	first, _ := mctsBot{playouts: 200}.chooseMove(newBotTurn(positions, gogo.PlayerWhite, 5))
+	second, _ := mctsBot{playouts: 200}.chooseMove(newBotTurn(positions, gogo.PlayerWhite, 5))
+	if first == nil || second == nil || *first != *second {
+		t.Errorf("Expected the same seed to produce the same move, got %v and %v", first, second)
+	}
+}
+
+func TestMCTSBotMovesWithoutFinishedPlayouts(t *testing.T) {
+	positions := gogo.NewMatch(9, "bot:mcts", "white").GameBoard.Positions
+	turn := newBotTurn(positions, gogo.PlayerBlack, 7)
+	turn.Deadline = time.Now().Add(-time.Second)
+	move, resign := mctsBot{playouts: 2000}.chooseMove(turn)
+	if resign || move == nil || !isLegal(turn.Board, turn.Player, *move) {
+		t.Errorf("Expected a legal move rather than a pass when no playout finished, got %v", move)
+	}
+}
+
+// blockingBot passes once it is let go, keeping track of how many turns it was thinking about at once.
+type blockingBot struct {
+	mu       sync.Mutex
+	calls    int
+	thinking int
+	most     int
+	release  chan struct{}
+}
+
+func (bot *blockingBot) chooseMove(turn botTurn) (*gogo.Coordinate, bool) {
+	bot.mu.Lock()
+	bot.calls++
+	bot.thinking++
+	if bot.thinking > bot.most {
+		bot.most = bot.thinking
+	}
+	bot.mu.Unlock()
+	<-bot.release
+	bot.mu.Lock()
+	bot.thinking--
+	bot.mu.Unlock()
+	return nil, false
+}
+
+func (bot *blockingBot) busy() int {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	return bot.thinking
+}
+
+func TestBotRunnerBoundsItsWorkers(t *testing.T) {
+	bot := &blockingBot{release: make(chan struct{})}
+	botPlayers["blocking"] = bot
+	defer delete(botPlayers, "blocking")
+
+	repo := newInMemoryRepository()
+	runner := newBotRunner(repo, newMatchHub())
+	runner.workers = 2
+	var matches []gogo.Match
+	for i := 0; i < 4; i++ {
+		match := gogo.NewMatch(9, "bot:blocking", "bob")
+		repo.addMatch(match, matchSettings{})
+		matches = append(matches, match)
+		runner.respond(match.ID, match.PlayerBlack, match.PlayerWhite)
+	}
+	for deadline := time.Now().Add(time.Second); bot.busy() < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	// The first match changes while its bot is thinking, and is looked at once more afterwards.
+	runner.respond(matches[0].ID, matches[0].PlayerBlack, matches[0].PlayerWhite)
+	runner.respond(matches[0].ID, matches[0].PlayerBlack, matches[0].PlayerWhite)
+	close(bot.release)
+	runner.wait()
+
+	if bot.most != 2 || bot.calls != 4 {
+		t.Errorf("Expected four turns played two at a time, got %d turns and up to %d at once", bot.calls, bot.most)
+	}
+	for _, match := range matches {
+		if moves, _ := repo.getMoves(match.ID); len(moves) != 1 {
+			t.Errorf("Expected the bot to move once in match %s, got %+v", match.ID, moves)
+		}
+	}
+}
+
+func TestBotMoveIsRetriedAfterVersionConflict(t *testing.T) {
+	repo := &racingRepository{inMemoryMatchRepository: newInMemoryRepository(), races: 1}
+	runner := newBotRunner(repo, newMatchHub())
+	match := gogo.NewMatch(9, "bot:random", "bob")
+	repo.addMatch(match, matchSettings{})
+	if err := runner.playTurn(match.ID); err != nil {
+		t.Errorf("Expected the bot's move to be retried after losing a race, got %v", err)
+	}
+	if moves, _ := repo.getMoves(match.ID); len(moves) != 1 || moves[0].Player != gogo.PlayerBlack {
+		t.Errorf("Expected the bot's move to land, got %+v", moves)
+	}
+}
@@ -0,0 +1,351 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+// Time control systems a match can be played under.
+const (
+	// timeAbsolute gives each player a fixed amount of time for the whole match.
+	timeAbsolute = "absolute"
+	// timeFischer adds an increment to a player's time after each of their moves.
+	timeFischer = "fischer"
+	// timeByoyomi follows the main time with a number of periods. A move made within a period
+	// keeps it; running over a period uses it up.
+	timeByoyomi = "byoyomi"
+	// timeCanadian follows the main time with blocks of overtime, in each of which a number of
+	// stones has to be played.
+	timeCanadian = "canadian"
+
+	// clockSweepPeriod is how often the sweeper looks for players who have run out of time.
+	clockSweepPeriod = time.Second
+)
+
+// errOutOfTime is returned for a move made after the player to move ran out of time, which ends
+// the match instead.
+var errOutOfTime = errors.New("The player to move has run out of time")
+
+// timeControl is the time limit a match is played under. The zero value is no limit at all.
+type timeControl struct {
+	System       string
+	MainTime     time.Duration
+	Increment    time.Duration
+	Periods      int
+	PeriodTime   time.Duration
+	PeriodStones int
+}
+
+// timeControlRequest is a time control as requested for a new match, with times in seconds.
+type timeControlRequest struct {
+	System       string `json:"system"`
+	MainTime     int    `json:"mainTime"`
+	Increment    int    `json:"increment"`
+	Periods      int    `json:"periods"`
+	PeriodTime   int    `json:"periodTime"`
+	PeriodStones int    `json:"periodStones"`
+}
+
+func (request timeControlRequest) isValid() bool {
+	if request.MainTime < 0 || request.Increment < 0 || request.Periods < 0 || request.PeriodTime < 0 || request.PeriodStones < 0 {
+		return false
+	}
+	switch request.System {
+	case timeAbsolute:
+		return request.MainTime > 0
+	case timeFischer:
+		return request.MainTime > 0 && request.Increment > 0
+	case timeByoyomi:
+		return request.Periods > 0 && request.PeriodTime > 0
+	case timeCanadian:
+		return request.PeriodStones > 0 && request.PeriodTime > 0
+	}
+	return false
+}
+
+func (request timeControlRequest) timeControl() timeControl {
+	return timeControl{
+		System:       request.System,
+		MainTime:     time.Duration(request.MainTime) * time.Second,
+		Increment:    time.Duration(request.Increment) * time.Second,
+		Periods:      request.Periods,
+		PeriodTime:   time.Duration(request.PeriodTime) * time.Second,
+		PeriodStones: request.PeriodStones,
+	}
+}
+
+type timeControlResponse struct {
+	System       string  `json:"system"`
+	MainTime     float64 `json:"mainTime"`
+	Increment    float64 `json:"increment,omitempty"`
+	Periods      int     `json:"periods,omitempty"`
+	PeriodTime   float64 `json:"periodTime,omitempty"`
+	PeriodStones int     `json:"periodStones,omitempty"`
+}
+
+func (m *timeControlResponse) copyTimeControl(tc timeControl) {
+	m.System = tc.System
+	m.MainTime = tc.MainTime.Seconds()
+	m.Increment = tc.Increment.Seconds()
+	m.Periods = tc.Periods
+	m.PeriodTime = tc.PeriodTime.Seconds()
+	m.PeriodStones = tc.PeriodStones
+}
+
+// playerClock is the time a player has left.
+type playerClock struct {
+	MainTime time.Duration
+	// Periods is the number of byo-yomi periods left.
+	Periods int
+	// PeriodTime is what is left of the current byo-yomi period or Canadian overtime block.
+	PeriodTime time.Duration
+	// Stones is the number of stones still to be played in the current Canadian overtime block.
+	Stones int
+}
+
+func (tc timeControl) newClock() playerClock {
+	return playerClock{MainTime: tc.MainTime, Periods: tc.Periods, PeriodTime: tc.PeriodTime, Stones: tc.PeriodStones}
+}
+
+// spend charges a player for a move that took elapsed, returning their clock after it and whether
+// they ran out of time making it.
+func (tc timeControl) spend(clock playerClock, elapsed time.Duration) (playerClock, bool) {
+	if elapsed <= clock.MainTime {
+		clock.MainTime -= elapsed
+		if tc.System == timeFischer {
+			clock.MainTime += tc.Increment
+		}
+		return clock, false
+	}
+	overtime := elapsed - clock.MainTime
+	clock.MainTime = 0
+	switch tc.System {
+	case timeByoyomi:
+		// Every period run over is lost; the one the move was made in starts afresh.
+		lost := int((overtime - 1) / tc.PeriodTime)
+		if lost >= clock.Periods {
+			return playerClock{}, true
+		}
+		clock.Periods -= lost
+		return clock, false
+	case timeCanadian:
+		if overtime > clock.PeriodTime {
+			return playerClock{}, true
+		}
+		clock.PeriodTime -= overtime
+		clock.Stones--
+		if clock.Stones == 0 {
+			clock.PeriodTime, clock.Stones = tc.PeriodTime, tc.PeriodStones
+		}
+		return clock, false
+	}
+	return playerClock{}, true
+}
+
+// allowance is the longest a player can take over their next move without running out of time.
+func (tc timeControl) allowance(clock playerClock) time.Duration {
+	switch tc.System {
+	case timeByoyomi:
+		return clock.MainTime + time.Duration(clock.Periods)*tc.PeriodTime
+	case timeCanadian:
+		return clock.MainTime + clock.PeriodTime
+	}
+	return clock.MainTime
+}
+
+// matchClocks is where the clocks of a match stand after its last move.
+type matchClocks struct {
+	Black playerClock
+	White playerClock
+	// Running is the player whose clock is running, if the match is still going, and Deadline
+	// the moment they run out of time.
+	Running  byte
+	Deadline time.Time
+}
+
+// runClocks works out the players' clocks from the time each move was made. The first move is
+// timed from the start of the match. An undo restarts the clock of the player to move, so a move
+// made after moves were taken back is timed from the latest undo back to its turn.
+func runClocks(settings matchSettings, started time.Time, moves []matchMove, undos []matchUndo) (clocks matchClocks) {
+	tc := settings.TimeControl
+	left := map[byte]playerClock{gogo.PlayerBlack: tc.newClock(), gogo.PlayerWhite: tc.newClock()}
+	restarted := map[int]time.Time{}
+	for _, undo := range undos {
+		restarted[undo.Keep] = undo.At
+	}
+	since := started
+	for idx, move := range moves {
+		if at := restarted[idx]; at.After(since) {
+			since = at
+		}
+		if move.TimedOut {
+			left[move.Player] = playerClock{}
+			continue
+		}
+		left[move.Player], _ = tc.spend(left[move.Player], move.Timestamp.Sub(since))
+		since = move.Timestamp
+	}
+	clocks.Black, clocks.White = left[gogo.PlayerBlack], left[gogo.PlayerWhite]
+	if at := restarted[len(moves)]; at.After(since) {
+		since = at
+	}
+	if matchStatus(moves) == matchStatusActive {
+		clocks.Running = nextPlayer(settings, moves)
+		clocks.Deadline = since.Add(tc.allowance(left[clocks.Running]))
+	}
+	return
+}
+
+// clockDeadline is the moment the player to move runs out of time. It is zero for an untimed or
+// finished match, where no clock is running. It is stored with the match so the sweeper can find
+// expired matches without working out the clocks of every other one.
+func clockDeadline(settings matchSettings, started time.Time, moves []matchMove, undos []matchUndo) time.Time {
+	if settings.TimeControl.System == "" || matchStatus(moves) == matchStatusFinished {
+		return time.Time{}
+	}
+	return runClocks(settings, started, moves, undos).Deadline
+}
+
+// outOfTime reports whether the player to move has run out of time by now, and if so who that is.
+func outOfTime(settings matchSettings, started time.Time, moves []matchMove, undos []matchUndo, now time.Time) (player byte, expired bool) {
+	if settings.TimeControl.System == "" || matchStatus(moves) == matchStatusFinished {
+		return 0, false
+	}
+	clocks := runClocks(settings, started, moves, undos)
+	return clocks.Running, now.After(clocks.Deadline)
+}
+
+type clockResponse struct {
+	MainTime   float64 `json:"mainTime"`
+	Periods    int     `json:"periods,omitempty"`
+	PeriodTime float64 `json:"periodTime,omitempty"`
+	Stones     int     `json:"stones,omitempty"`
+}
+
+// clocksResponse reports the clocks as they stood after the last move, so it only changes when a
+// move is made. Clients count down the running clock themselves, up to the deadline.
+type clocksResponse struct {
+	Black    clockResponse `json:"black"`
+	White    clockResponse `json:"white"`
+	Running  string        `json:"running,omitempty"`
+	Deadline int64         `json:"deadline,omitempty"`
+}
+
+func (m *clockResponse) copyClock(clock playerClock) {
+	m.MainTime = roundSeconds(clock.MainTime)
+	m.Periods = clock.Periods
+	m.PeriodTime = roundSeconds(clock.PeriodTime)
+	m.Stones = clock.Stones
+}
+
+func (m *clocksResponse) copyClocks(clocks matchClocks) {
+	m.Black.copyClock(clocks.Black)
+	m.White.copyClock(clocks.White)
+	if clocks.Running != 0 {
+		m.Running = playerName(clocks.Running)
+		m.Deadline = clocks.Deadline.Unix()
+	}
+}
+
+// roundSeconds converts a duration to seconds, to the millisecond.
+func roundSeconds(d time.Duration) float64 {
+	return math.Round(d.Seconds()*1000) / 1000
+}
+
+// claimTimeout ends the match on time if the player to move has run out of it, reporting whether
+// it did so. Like a move, it retries when it loses a race with another update.
+func claimTimeout(repo matchRepository, matchID string, now time.Time) (mdr matchDetailsResponse, ended bool, err error) {
+	for attempt := 1; ; attempt++ {
+		var state matchState
+		state, err = repo.loadMatch(matchID)
+		if err != nil {
+			return
+		}
+		player, expired := outOfTime(state.Settings, state.Match.StartTime, state.Moves, state.Undos, now)
+		if !expired {
+			return mdr, false, nil
+		}
+		mdr, err = recordTimeout(repo, state.Version, state.Match, state.Settings, state.Moves, state.Undos, player, now)
+		if err == errVersionConflict && attempt < maxMoveAttempts {
+			continue
+		}
+		return mdr, err == nil, err
+	}
+}
+
+// recordTimeout ends a match on time, with a final move by the player who ran out of it. The
+// caller passes the state it read at version; if the match has moved on since, errVersionConflict
+// is returned.
+func recordTimeout(repo matchRepository, version int, match gogo.Match, settings matchSettings, moves []matchMove, undos []matchUndo, player byte, now time.Time) (mdr matchDetailsResponse, err error) {
+	move := matchMove{Player: player, Turn: match.TurnCount + 1, TimedOut: true, Timestamp: now}
+	match.TurnCount = move.Turn
+	moves = append(moves, move)
+	err = repo.updateMatch(match.ID, version, matchUpdate{Match: match, Status: matchStatus(moves), Moves: []matchMove{move}})
+	if err == nil {
+		mdr.copyMatch(match, settings, moves, undos)
+		mdr.version = version + 1
+	}
+	return
+}
+
+// clockSweeper ends matches whose player to move has run out of time, so that a match is lost on
+// time even when nobody tries to move in it again.
+type clockSweeper struct {
+	repo matchRepository
+	hub  *matchHub
+	bots *botRunner
+}
+
+func newClockSweeper(repo matchRepository, hub *matchHub, bots *botRunner) *clockSweeper {
+	return &clockSweeper{repo: repo, hub: hub, bots: bots}
+}
+
+// run sweeps every period, forever.
+func (sweeper *clockSweeper) run(period time.Duration) {
+	for range time.Tick(period) {
+		if _, err := sweeper.sweep(time.Now()); err != nil {
+			fmt.Printf("Clock sweep failed: %v\n", err)
+		}
+	}
+}
+
+// sweep ends every active match whose player to move has run out of time by now, returning how
+// many it ended. Only the matches whose stored deadline has passed are read.
+func (sweeper *clockSweeper) sweep(now time.Time) (ended int, err error) {
+	matches, err := sweeper.repo.findExpiredMatches(now)
+	if err != nil {
+		return ended, err
+	}
+	for _, state := range matches {
+		match := state.Match
+		mdr, timedOut, err := sweepMatch(sweeper.repo, state, now)
+		if err != nil {
+			fmt.Printf("Failed to check the clocks of match %s: %v\n", match.ID, err)
+			continue
+		}
+		if timedOut {
+			ended++
+			sweeper.hub.publish(match.ID, mdr)
+			sweeper.bots.respond(match.ID, match.PlayerBlack, match.PlayerWhite)
+		}
+	}
+	return ended, nil
+}
+
+// sweepMatch ends a match found past its deadline on time, using the state the sweep read. Should
+// a move have landed since, the match is read afresh, as the move may have beaten the clock.
+func sweepMatch(repo matchRepository, state matchState, now time.Time) (mdr matchDetailsResponse, ended bool, err error) {
+	player, expired := outOfTime(state.Settings, state.Match.StartTime, state.Moves, state.Undos, now)
+	if !expired {
+		return mdr, false, nil
+	}
+	mdr, err = recordTimeout(repo, state.Version, state.Match, state.Settings, state.Moves, state.Undos, player, now)
+	if err == errVersionConflict {
+		return claimTimeout(repo, state.Match.ID, now)
+	}
+	return mdr, err == nil, err
+}
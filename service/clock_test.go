@@ -0,0 +1,232 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudnativego/gogo-engine"
+	"github.com/gorilla/mux"
+)
+
+func TestClocksRunDownUnderEachTimeControl(t *testing.T) {
+	byoyomi := timeControl{System: timeByoyomi, MainTime: time.Minute, Periods: 3, PeriodTime: 10 * time.Second}
+	canadian := timeControl{System: timeCanadian, MainTime: time.Minute, PeriodTime: 30 * time.Second, PeriodStones: 2}
+	tests := []struct {
+		name     string
+		tc       timeControl
+		clock    playerClock
+		elapsed  time.Duration
+		expected playerClock
+		expired  bool
+	}{
+		{"absolute", timeControl{System: timeAbsolute, MainTime: time.Minute}, playerClock{MainTime: time.Minute},
+			20 * time.Second, playerClock{MainTime: 40 * time.Second}, false},
+		{"absolute over", timeControl{System: timeAbsolute, MainTime: time.Minute}, playerClock{MainTime: time.Minute},
+			61 * time.Second, playerClock{}, true},
+		{"fischer", timeControl{System: timeFischer, MainTime: time.Minute, Increment: 5 * time.Second}, playerClock{MainTime: time.Minute},
+			20 * time.Second, playerClock{MainTime: 45 * time.Second}, false},
+		{"byo-yomi main time", byoyomi, byoyomi.newClock(),
+			20 * time.Second, playerClock{MainTime: 40 * time.Second, Periods: 3, PeriodTime: 10 * time.Second}, false},
+		{"byo-yomi within a period", byoyomi, byoyomi.newClock(),
+			70 * time.Second, playerClock{Periods: 3, PeriodTime: 10 * time.Second}, false},
+		{"byo-yomi losing a period", byoyomi, byoyomi.newClock(),
+			75 * time.Second, playerClock{Periods: 2, PeriodTime: 10 * time.Second}, false},
+		{"byo-yomi losing the last period", byoyomi, playerClock{Periods: 1, PeriodTime: 10 * time.Second},
+			11 * time.Second, playerClock{}, true},
+		{"canadian into overtime", canadian, canadian.newClock(),
+			70 * time.Second, playerClock{PeriodTime: 20 * time.Second, Stones: 1}, false},
+		{"canadian completing a block", canadian, playerClock{PeriodTime: 20 * time.Second, Stones: 1},
+			15 * time.Second, playerClock{PeriodTime: 30 * time.Second, Stones: 2}, false},
+		{"canadian over the block", canadian, playerClock{PeriodTime: 20 * time.Second, Stones: 1},
+			21 * time.Second, playerClock{}, true},
+	}
+	for _, test := range tests {
+		clock, expired := test.tc.spend(test.clock, test.elapsed)
+		if clock != test.expected || expired != test.expired {
+			t.Errorf("%s: expected %+v (expired %v), got %+v (expired %v)", test.name, test.expected, test.expired, clock, expired)
+		}
+	}
+}
+
+func TestClocksAreReplayedFromTheMoves(t *testing.T) {
+	start := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	settings := matchSettings{TimeControl: timeControl{System: timeFischer, MainTime: time.Minute, Increment: 10 * time.Second}}
+	moves := []matchMove{
+		{Player: gogo.PlayerBlack, Position: &gogo.Coordinate{X: 4, Y: 4}, Timestamp: start.Add(30 * time.Second)},
+		{Player: gogo.PlayerWhite, Position: &gogo.Coordinate{X: 5, Y: 5}, Timestamp: start.Add(35 * time.Second)},
+	}
+	clocks := runClocks(settings, start, moves, nil)
+	if clocks.Black.MainTime != 40*time.Second || clocks.White.MainTime != 65*time.Second {
+		t.Errorf("Expected black and white to have 40s and 65s left, got %v and %v", clocks.Black.MainTime, clocks.White.MainTime)
+	}
+	if clocks.Running != gogo.PlayerBlack || !clocks.Deadline.Equal(start.Add(75*time.Second)) {
+		t.Errorf("Expected black's clock to run out 75s in, got %v at %v", clocks.Running, clocks.Deadline.Sub(start))
+	}
+	if _, expired := outOfTime(settings, start, moves, nil, start.Add(75*time.Second)); expired {
+		t.Error("Expected black to still be in time on the deadline")
+	}
+	if player, expired := outOfTime(settings, start, moves, nil, start.Add(76*time.Second)); !expired || player != gogo.PlayerBlack {
+		t.Error("Expected black to be out of time after the deadline")
+	}
+}
+
+func TestUndoRestartsTheClock(t *testing.T) {
+	start := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	settings := matchSettings{TimeControl: timeControl{System: timeFischer, MainTime: time.Minute, Increment: 10 * time.Second}}
+	moves := []matchMove{
+		{Player: gogo.PlayerBlack, Position: &gogo.Coordinate{X: 4, Y: 4}, Timestamp: start.Add(30 * time.Second)},
+		{Player: gogo.PlayerWhite, Position: &gogo.Coordinate{X: 3, Y: 3}, Timestamp: start.Add(110 * time.Second)},
+	}
+	// White's move at 35s was taken back at 100s, and white tried again.
+	undos := []matchUndo{{Keep: 1, At: start.Add(100 * time.Second)}}
+
+	clocks := runClocks(settings, start, moves[:1], undos)
+	if clocks.Running != gogo.PlayerWhite || !clocks.Deadline.Equal(start.Add(160*time.Second)) {
+		t.Errorf("Expected white's clock to run from the undo, out 160s in, got %v at %v", clocks.Running, clocks.Deadline.Sub(start))
+	}
+	clocks = runClocks(settings, start, moves, undos)
+	if clocks.White.MainTime != 60*time.Second || clocks.Black.MainTime != 40*time.Second {
+		t.Errorf("Expected white to be charged 10s from the undo, leaving 60s to black's 40s, got %v and %v", clocks.White.MainTime, clocks.Black.MainTime)
+	}
+}
+
+func TestUndoneMatchIsNotSweptOnItsOldDeadline(t *testing.T) {
+	repo := newInMemoryRepository()
+	settings := matchSettings{TimeControl: timeControl{System: timeAbsolute, MainTime: time.Minute}}
+	match := gogo.NewMatch(9, "black", "white")
+	match.StartTime = time.Now().Add(-2 * time.Minute)
+	repo.addMatch(match, settings)
+	moves := []matchMove{
+		{Player: gogo.PlayerBlack, Turn: 1, Timestamp: match.StartTime.Add(10 * time.Second)},
+		{Player: gogo.PlayerWhite, Turn: 2, Timestamp: match.StartTime.Add(20 * time.Second)},
+	}
+	repo.updateMatch(match.ID, 1, matchUpdate{Match: match, Status: matchStatusActive, Moves: moves,
+		Deadline: clockDeadline(settings, match.StartTime, moves, nil)})
+	state, _ := repo.loadMatch(match.ID)
+
+	// Black had 50s left when white moved, long gone by now, but the undo gives white their time back.
+	mdr, err := rewindMoves(repo, state.Version, state.Match, state.Settings, state.Moves, state.Undos, 1)
+	if err != nil {
+		t.Fatalf("Expected white's move to be taken back, got %v", err)
+	}
+	if mdr.Clocks == nil || mdr.Clocks.Running != "white" || mdr.Clocks.Deadline < time.Now().Add(45*time.Second).Unix() {
+		t.Errorf("Expected white's clock to restart from the undo, got %+v", mdr.Clocks)
+	}
+	if expired, _ := repo.findExpiredMatches(time.Now()); len(expired) != 0 {
+		t.Errorf("Expected the undone match to be in time, got %d expired", len(expired))
+	}
+	if _, ended, _ := claimTimeout(repo, match.ID, time.Now()); ended {
+		t.Error("Expected no timeout to be claimed against the restarted clock")
+	}
+}
+
+func TestInvalidTimeControlsAreRejected(t *testing.T) {
+	for _, tc := range []string{
+		`{"system": "hourglass", "mainTime": 60}`,
+		`{"system": "absolute"}`,
+		`{"system": "fischer", "mainTime": 60}`,
+		`{"system": "byoyomi", "mainTime": 60, "periodTime": 30}`,
+		`{"system": "canadian", "mainTime": 60, "periodTime": -30, "periodStones": 10}`,
+	} {
+		var request newMatchRequest
+		json.Unmarshal([]byte(`{"gridsize": 9, "playerBlack": "b", "playerWhite": "w", "timeControl": `+tc+`}`), &request)
+		if request.isValid() {
+			t.Errorf("Expected time control %s to be rejected", tc)
+		}
+	}
+}
+
+func TestMatchDetailsIncludeClocks(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches", strings.NewReader(`{"gridsize": 9, "playerBlack": "b", "playerWhite": "w",
+		"timeControl": {"system": "canadian", "mainTime": 600, "periodTime": 300, "periodStones": 25}}`))
+	server.ServeHTTP(recorder, request)
+	var created newMatchResponse
+	json.Unmarshal(recorder.Body.Bytes(), &created)
+	if created.TimeControl == nil || created.TimeControl.System != timeCanadian || created.TimeControl.PeriodStones != 25 {
+		t.Fatalf("Expected the new match to report its time control, got %+v", created.TimeControl)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/matches/"+created.ID, nil)
+	server.ServeHTTP(recorder, request)
+	var details matchDetailsResponse
+	json.Unmarshal(recorder.Body.Bytes(), &details)
+	if details.Clocks == nil || details.Clocks.Black.MainTime != 600 || details.Clocks.White.Stones != 25 {
+		t.Fatalf("Expected both players to start with full clocks, got %+v", details.Clocks)
+	}
+	if details.Clocks.Running != "black" || details.Clocks.Deadline < created.StartedAt+600 {
+		t.Errorf("Expected black's clock to be running, got %+v", details.Clocks)
+	}
+}
+
+func TestMoveAfterRunningOutOfTimeEndsTheMatch(t *testing.T) {
+	repo := newInMemoryRepository()
+	hub := newMatchHub()
+	server := mux.NewRouter()
+	initRoutes(server, formatter, repo, hub, newBotRunner(repo, hub))
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	targetMatch.StartTime = time.Now().Add(-2 * time.Minute)
+	repo.addMatch(targetMatch, matchSettings{TimeControl: timeControl{System: timeAbsolute, MainTime: time.Minute}})
+	updates := hub.subscribe(targetMatch.ID)
+	defer hub.unsubscribe(targetMatch.ID, updates)
+
+	recorder := postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}")
+	if recorder.Code != http.StatusConflict || !strings.Contains(recorder.Body.String(), "run out of time") {
+		t.Fatalf("Expected a move after the flag fell to return 409, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	select {
+	case update := <-updates:
+		if update.Status != matchStatusFinished || update.Winner != "white" {
+			t.Errorf("Expected white to win on time, got %s and %q", update.Status, update.Winner)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the timeout to be published")
+	}
+	moves, _ := repo.getMoves(targetMatch.ID)
+	if len(moves) != 1 || !moves[0].TimedOut || moves[0].Player != gogo.PlayerBlack || moves[0].Position != nil {
+		t.Errorf("Expected black's timeout to be recorded in the history, got %+v", moves)
+	}
+}
+
+func TestSweeperEndsMatchesOnTime(t *testing.T) {
+	repo := newInMemoryRepository()
+	hub := newMatchHub()
+	settings := matchSettings{TimeControl: timeControl{System: timeByoyomi, MainTime: time.Minute, Periods: 1, PeriodTime: 30 * time.Second}}
+	expired := gogo.NewMatch(9, "black", "white")
+	expired.StartTime = time.Now().Add(-time.Minute)
+	repo.addMatch(expired, settings)
+	moves := []matchMove{{Player: gogo.PlayerBlack, Turn: 1, Timestamp: expired.StartTime.Add(10 * time.Second)}}
+	repo.updateMatch(expired.ID, 1, matchUpdate{Match: expired, Status: matchStatusActive, Moves: moves,
+		Deadline: clockDeadline(settings, expired.StartTime, moves, nil)})
+	inTime := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(inTime, settings)
+	untimed := gogo.NewMatch(9, "black", "white")
+	untimed.StartTime = time.Now().Add(-24 * time.Hour)
+	repo.addMatch(untimed, matchSettings{})
+
+	sweeper := newClockSweeper(repo, hub, newBotRunner(repo, hub))
+	// White has had 50s on a 60s main time so far, and runs out once the byo-yomi period is up too.
+	if ended, err := sweeper.sweep(time.Now()); err != nil || ended != 0 {
+		t.Fatalf("Expected no match to have run out of time yet, ended %d (%v)", ended, err)
+	}
+	if ended, err := sweeper.sweep(time.Now().Add(41 * time.Second)); err != nil || ended != 1 {
+		t.Fatalf("Expected one match to run out of time, ended %d (%v)", ended, err)
+	}
+
+	moves, _ = repo.getMoves(expired.ID)
+	if matchStatus(moves) != matchStatusFinished || !moves[1].TimedOut || moves[1].Player != gogo.PlayerWhite {
+		t.Errorf("Expected white to have lost on time, got %+v", moves)
+	}
+	for _, id := range []string{inTime.ID, untimed.ID} {
+		if moves, _ := repo.getMoves(id); len(moves) != 0 {
+			t.Errorf("Expected match %s to be left alone, got %+v", id, moves)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Variants of a match representation its entity tags tell apart, besides the image and ASCII formats.
+const (
+	jsonVariant = "json"
+	sgfVariant  = "sgf"
+)
+
+var (
+	errStaleBoard      = errors.New("Match has changed since the board named in If-Match was fetched")
+	errIfMatchRequired = errors.New("If-Match is required; fetch the match first and send back its ETag")
+)
+
+// matchETag tags a representation of a match version. Variant names the representation, such as
+// its SGF record, so that it never validates against another representation of the same version.
+func matchETag(matchID string, version int, variant string) string {
+	return entityTag(variant, matchID+"@"+strconv.Itoa(version))
+}
+
+// listETag tags a page of the match list by the versions of the matches on it, so that it changes
+// whenever one of them does.
+func listETag(matches []matchState) string {
+	parts := make([]string, len(matches))
+	for idx, state := range matches {
+		parts[idx] = state.Match.ID + "@" + strconv.Itoa(state.Version)
+	}
+	return entityTag("list", parts...)
+}
+
+// entityTag is the one scheme every entity tag follows: a strong, opaque tag hashed from the name
+// of the representation and the match versions it shows.
+func entityTag(variant string, parts ...string) string {
+	hash := sha256.New()
+	hash.Write([]byte(variant))
+	for _, part := range parts {
+		hash.Write([]byte("\n" + part))
+	}
+	return strconv.Quote(hex.EncodeToString(hash.Sum(nil)[:16]))
+}
+
+// lastModified is the Last-Modified date of a match last written at updated. HTTP dates only carry
+// whole seconds, and a second write within the same second would leave the date as it was, so the
+// date is only given once that second is over. Until then it is zero, and the entity tag is the only
+// validator.
+func lastModified(updated time.Time, now time.Time) time.Time {
+	modified := updated.UTC().Truncate(time.Second)
+	if updated.IsZero() || !modified.Before(now.UTC().Truncate(time.Second)) {
+		return time.Time{}
+	}
+	return modified
+}
+
+// setValidators writes the ETag and Last-Modified headers for a representation.
+func setValidators(w http.ResponseWriter, etag string, modified time.Time) {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	}
+}
+
+// notModified evaluates If-None-Match and, in its absence, If-Modified-Since against the current
+// validators of a representation, returning true when the client's copy is still fresh.
+func notModified(req *http.Request, etag string, modified time.Time) bool {
+	if header := req.Header.Get("If-None-Match"); header != "" {
+		return etagListContains(header, etag, false)
+	}
+	if header := req.Header.Get("If-Modified-Since"); header != "" && !modified.IsZero() {
+		since, err := http.ParseTime(header)
+		return err == nil && !modified.After(since)
+	}
+	return false
+}
+
+// checkPrecondition evaluates the If-Match header every change to a match has to carry against
+// the current entity tag, so that clients only ever change the board they have seen.
+func checkPrecondition(req *http.Request, etag string) (status int, err error) {
+	header := req.Header.Get("If-Match")
+	if header == "" {
+		return http.StatusPreconditionRequired, errIfMatchRequired
+	}
+	if !etagListContains(header, etag, true) {
+		return http.StatusPreconditionFailed, errStaleBoard
+	}
+	return http.StatusOK, nil
+}
+
+// etagListContains reports whether a comma separated If-Match or If-None-Match header names etag.
+// Strong comparison, as required by If-Match, never matches a weak tag.
+func etagListContains(header string, etag string, strong bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if strong {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
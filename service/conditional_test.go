@@ -0,0 +1,61 @@
+package service
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestETagListMatching(t *testing.T) {
+	cases := []struct {
+		header string
+		strong bool
+		match  bool
+	}{
+		{"\"3\"", true, true},
+		{"\"2\", \"3\"", true, true},
+		{"\"2\"", false, false},
+		{"*", true, true},
+		{"W/\"3\"", false, true},
+		{"W/\"3\"", true, false},
+	}
+	for _, c := range cases {
+		if etagListContains(c.header, "\"3\"", c.strong) != c.match {
+			t.Errorf("Expected %s (strong: %v) matching \"3\" to be %v", c.header, c.strong, c.match)
+		}
+	}
+}
+
+func TestNotModifiedPrefersIfNoneMatch(t *testing.T) {
+	modified := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	request, _ := http.NewRequest("GET", "/matches", nil)
+	if notModified(request, "\"1\"", modified) {
+		t.Error("A request without validators should never be answered with 304")
+	}
+
+	request.Header.Set("If-Modified-Since", modified.Format(http.TimeFormat))
+	if !notModified(request, "\"1\"", modified) {
+		t.Error("Expected an unchanged Last-Modified to be answered with 304")
+	}
+	if notModified(request, "\"1\"", modified.Add(time.Second)) {
+		t.Error("Expected a later Last-Modified to be answered in full")
+	}
+
+	request.Header.Set("If-None-Match", "\"0\"")
+	if notModified(request, "\"1\"", modified) {
+		t.Error("If-None-Match should take precedence over If-Modified-Since")
+	}
+}
+
+func TestLastModifiedWaitsForTheSecondToEnd(t *testing.T) {
+	updated := time.Date(2016, 5, 1, 12, 0, 0, 400*int(time.Millisecond), time.UTC)
+	if !lastModified(updated, updated.Add(700*time.Millisecond)).Equal(updated.Truncate(time.Second)) {
+		t.Error("Expected a write from a past second to be dated to that second")
+	}
+	if !lastModified(updated, updated.Add(500*time.Millisecond)).IsZero() {
+		t.Error("Expected no date for a write within the current second")
+	}
+	if !lastModified(time.Time{}, updated).IsZero() {
+		t.Error("Expected no date for a match with no recorded write")
+	}
+}
@@ -4,4 +4,19 @@ const (
 	//MatchesCollectionName holds the name of the matches collection in mongodb.
 	MatchesCollectionName = "matches"
 	dbServiceName         = "mongodb"
+
+	matchStatusActive   = "active"
+	matchStatusFinished = "finished"
+
+	defaultKomi         = 6.5
+	defaultHandicapKomi = 0.5
+	minHandicap         = 2
+	maxHandicap         = 9
+
+	// maxMoveAttempts bounds how often submitMove replays a move by a GTP session or a bot that lost
+	// a race with another one.
+	maxMoveAttempts = 3
+
+	// maxImportSize bounds the SGF records accepted by importMatchHandler.
+	maxImportSize = 1 << 20
 )
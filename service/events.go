@@ -0,0 +1,171 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudnativego/gogo-engine"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+)
+
+const (
+	eventMatchCreated  = "match-created"
+	eventMovePlayed    = "move-played"
+	eventPass          = "pass"
+	eventResign        = "resign"
+	eventTimeout       = "timeout"
+	eventUndo          = "undo"
+	eventMatchFinished = "match-finished"
+
+	// eventsRefreshPeriod bounds how long a client waits to hear about a move made through
+	// another instance of the service, and doubles as the keepalive interval.
+	eventsRefreshPeriod = 15 * time.Second
+)
+
+// matchEvent is a single entry in a match's event feed.
+type matchEvent struct {
+	ID   int
+	Type string
+	Data interface{}
+}
+
+// undoEventResponse announces moves being taken back. The match carries on from Turn, so every
+// move of a later turn is gone.
+type undoEventResponse struct {
+	Turn int   `json:"turn"`
+	At   int64 `json:"at"`
+}
+
+// matchEvents derives the event feed of a match from its stored move history and the undos
+// granted in it. Because the feed is rebuilt from the repository every time, event IDs stay
+// stable across reconnects and restarts. They come from the version each move or undo brought
+// the match to, which only ever goes up, so an ID is never handed out twice even after moves
+// are taken back: the match is created as event 1, a move or undo at version v is event 2v,
+// and a finished match ends with a final event carrying its details, numbered right after its
+// last move.
+func matchEvents(match gogo.Match, settings matchSettings, moves []matchMove, undos []matchUndo) (events []matchEvent) {
+	var created newMatchResponse
+	created.copyMatch(match, settings, nil)
+	events = append(events, matchEvent{ID: 1, Type: eventMatchCreated, Data: created})
+
+	next := 0
+	for _, move := range moves {
+		// Moves and undos are both stored in the order they happened; interleave them by version.
+		for ; next < len(undos) && undos[next].Version < move.Version; next++ {
+			events = append(events, undoEvent(undos[next]))
+		}
+		var mr moveResponse
+		mr.copyMove(move)
+		eventType := eventMovePlayed
+		if move.Resigned {
+			eventType = eventResign
+		} else if move.TimedOut {
+			eventType = eventTimeout
+		} else if move.isPass() {
+			eventType = eventPass
+		}
+		events = append(events, matchEvent{ID: 2 * move.Version, Type: eventType, Data: mr})
+	}
+	for ; next < len(undos); next++ {
+		events = append(events, undoEvent(undos[next]))
+	}
+
+	if matchStatus(moves) == matchStatusFinished {
+		var finished matchDetailsResponse
+		finished.copyMatch(match, settings, moves, undos)
+		events = append(events, matchEvent{ID: 2*moves[len(moves)-1].Version + 1, Type: eventMatchFinished, Data: finished})
+	}
+	return
+}
+
+func undoEvent(undo matchUndo) matchEvent {
+	return matchEvent{ID: 2 * undo.Version, Type: eventUndo, Data: undoEventResponse{Turn: undo.Keep, At: undo.At.Unix()}}
+}
+
+// matchEventsHandler serves a match's event feed as Server-Sent Events. Clients that reconnect
+// with a Last-Event-ID header (or lastEventId query parameter) resume after that event.
+func matchEventsHandler(formatter *render.Render, repo matchRepository, hub *matchHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		matchID := vars["id"]
+		if _, err := repo.getMatch(matchID); err != nil {
+			formatter.JSON(w, http.StatusNotFound, err.Error())
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			formatter.JSON(w, http.StatusInternalServerError, "Streaming is not supported")
+			return
+		}
+
+		lastEventID := req.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = req.URL.Query().Get("lastEventId")
+		}
+		lastSent, _ := strconv.Atoi(lastEventID)
+
+		updates := hub.subscribe(matchID)
+		defer hub.unsubscribe(matchID, updates)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		sendPending := func() (err error) {
+			state, err := repo.loadMatch(matchID)
+			if err != nil {
+				return
+			}
+			for _, event := range matchEvents(state.Match, state.Settings, state.Moves, state.Undos) {
+				if event.ID <= lastSent {
+					continue
+				}
+				err = writeEvent(w, event)
+				if err != nil {
+					return
+				}
+				lastSent = event.ID
+			}
+			flusher.Flush()
+			return
+		}
+
+		if sendPending() != nil {
+			return
+		}
+		ticker := time.NewTicker(eventsRefreshPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-updates:
+				if sendPending() != nil {
+					return
+				}
+			case <-ticker.C:
+				if sendPending() != nil {
+					return
+				}
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-req.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event matchEvent) (err error) {
+	data, err := json.Marshal(event.Data)
+	if err == nil {
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	}
+	return
+}
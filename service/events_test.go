@@ -0,0 +1,140 @@
+package service
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+func TestMatchEventsFollowMoveHistory(t *testing.T) {
+	match := gogo.NewMatch(9, "black", "white")
+	moves := []matchMove{
+		{Player: gogo.PlayerBlack, Position: &gogo.Coordinate{X: 2, Y: 2}, Turn: 1, Version: 2},
+		{Player: gogo.PlayerWhite, Turn: 2, Version: 3},
+		{Player: gogo.PlayerBlack, Turn: 3, Version: 4},
+	}
+
+	events := matchEvents(match, matchSettings{}, moves, nil)
+	expectedIDs := []int{1, 4, 6, 8, 9}
+	expected := []string{eventMatchCreated, eventMovePlayed, eventPass, eventPass, eventMatchFinished}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(events))
+	}
+	for idx, event := range events {
+		if event.ID != expectedIDs[idx] || event.Type != expected[idx] {
+			t.Errorf("Expected event %d to be %s, got %d %s", expectedIDs[idx], expected[idx], event.ID, event.Type)
+		}
+	}
+
+	active := matchEvents(match, matchSettings{}, moves[:2], nil)
+	if active[len(active)-1].Type == eventMatchFinished {
+		t.Error("An active match should not have a match-finished event")
+	}
+}
+
+func TestResignationEndsTheEventFeed(t *testing.T) {
+	match := gogo.NewMatch(9, "black", "white")
+	moves := []matchMove{
+		{Player: gogo.PlayerBlack, Turn: 1, Version: 2},
+		{Player: gogo.PlayerBlack, Turn: 2, Resigned: true, Version: 3},
+	}
+
+	events := matchEvents(match, matchSettings{}, moves, nil)
+	if len(events) != 4 || events[2].Type != eventResign || events[3].Type != eventMatchFinished {
+		t.Errorf("Expected a pass, a resignation and the end of the match, got %+v", events)
+	}
+}
+
+func TestEventIDsAreNotReusedAfterUndo(t *testing.T) {
+	repo := newInMemoryRepository()
+	handler := MakeTestServer(repo)
+	match := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(match, matchSettings{})
+	postMove(handler, match.ID, "{\"player\": 1, \"position\": {\"x\": 2, \"y\": 2}}")
+	postMove(handler, match.ID, "{\"player\": 2, \"position\": {\"x\": 6, \"y\": 6}}")
+	before, _ := repo.loadMatch(match.ID)
+	seen := matchEvents(before.Match, before.Settings, before.Moves, before.Undos)
+	lastSeen := seen[len(seen)-1].ID
+
+	if _, err := rewindMoves(repo, before.Version, before.Match, before.Settings, before.Moves, before.Undos, 1); err != nil {
+		t.Fatalf("Expected white's move to be taken back, got %v", err)
+	}
+	postMove(handler, match.ID, "{\"player\": 2, \"position\": {\"x\": 5, \"y\": 5}}")
+	after, _ := repo.loadMatch(match.ID)
+	var resumed []matchEvent
+	for _, event := range matchEvents(after.Match, after.Settings, after.Moves, after.Undos) {
+		if event.ID > lastSeen {
+			resumed = append(resumed, event)
+		}
+	}
+	if len(resumed) != 2 || resumed[0].Type != eventUndo || resumed[1].Type != eventMovePlayed || resumed[0].ID >= resumed[1].ID {
+		t.Fatalf("Expected a client that saw white's first move to hear of the undo and then white's new move, got %+v", resumed)
+	}
+	if undo := resumed[0].Data.(undoEventResponse); undo.Turn != 1 {
+		t.Errorf("Expected the undo to take the match back to turn 1, got %d", undo.Turn)
+	}
+}
+
+func TestEventsResumeFromLastEventID(t *testing.T) {
+	repo := newInMemoryRepository()
+	handler := MakeTestServer(repo)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+	postMove(handler, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 2, \"y\": 2}}")
+	postMove(handler, targetMatch.ID, "{\"player\": 2, \"position\": {\"x\": 6, \"y\": 6}}")
+
+	request, _ := http.NewRequest("GET", server.URL+"/matches/"+targetMatch.ID+"/events", nil)
+	request.Header.Set("Last-Event-ID", "4")
+	client := &http.Client{Timeout: 5 * time.Second}
+	res, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("Error opening event stream: %v", err)
+	}
+	defer res.Body.Close()
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		t.Errorf("Expected an event stream, got %s", res.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(res.Body)
+
+	id, eventType := readEvent(t, reader)
+	if id != "6" || eventType != eventMovePlayed {
+		t.Errorf("Expected to resume with white's move as event 6, got %s %s", id, eventType)
+	}
+
+	res2, err := postLiveMove(server.URL, targetMatch.ID, "{\"player\": 1}")
+	if err != nil {
+		t.Fatalf("Error posting pass: %v", err)
+	}
+	res2.Body.Close()
+
+	id, eventType = readEvent(t, reader)
+	if id != "8" || eventType != eventPass {
+		t.Errorf("Expected black's pass as event 8, got %s %s", id, eventType)
+	}
+}
+
+func readEvent(t *testing.T, reader *bufio.Reader) (id string, eventType string) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && id != "":
+			return
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		}
+	}
+}
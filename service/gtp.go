@@ -0,0 +1,635 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+const (
+	// gtpPortEnv names the environment variable holding the TCP port for Go Text Protocol
+	// connections. The GTP listener is only started when it is set.
+	gtpPortEnv = "GTP_PORT"
+
+	gtpProtocolVersion = "2"
+	gtpName            = "gogo-service"
+	gtpVersion         = "1.0"
+
+	// gtpDefaultBot is the bot that generates moves for the seats a session plays itself.
+	gtpDefaultBot = "mcts"
+
+	// gtpMoveWait is how long genmove waits for a move to be made elsewhere, by a player over
+	// HTTP or by the match's bot, before giving up.
+	gtpMoveWait = 30 * time.Second
+)
+
+var (
+	errGTPSyntax  = errors.New("syntax error")
+	errGTPNoMatch = errors.New("no match; send clear_board or gogo-match first")
+	errGTPNoMove  = errors.New("cannot generate move")
+	errGTPNoUndo  = errors.New("cannot undo")
+	errGTPSetup   = errors.New("handicap stones are not all placed")
+)
+
+// gtpCommand carries out one GTP command, returning the response text.
+type gtpCommand func(session *gtpSession, args []string) (string, error)
+
+var gtpCommands map[string]gtpCommand
+
+// The command table is filled in at init, as known_command and list_commands consult it.
+func init() {
+	gtpCommands = map[string]gtpCommand{
+		"protocol_version": func(*gtpSession, []string) (string, error) { return gtpProtocolVersion, nil },
+		"name":             func(*gtpSession, []string) (string, error) { return gtpName, nil },
+		"version":          func(*gtpSession, []string) (string, error) { return gtpVersion, nil },
+		"quit":             func(*gtpSession, []string) (string, error) { return "", nil },
+		"known_command":    gtpKnownCommand,
+		"list_commands":    gtpListCommands,
+		"boardsize":        (*gtpSession).boardSize,
+		"clear_board":      (*gtpSession).clearBoard,
+		"komi":             (*gtpSession).setKomi,
+		"play":             (*gtpSession).play,
+		"genmove":          (*gtpSession).genMove,
+		"undo":             (*gtpSession).undo,
+		"showboard":        (*gtpSession).showBoard,
+		"final_score":      (*gtpSession).finalScore,
+		"gogo-match":       (*gtpSession).attach,
+		"gogo-seats":       (*gtpSession).seats,
+		"gogo-bot":         (*gtpSession).chooseBot,
+	}
+}
+
+// listenGTP accepts Go Text Protocol connections on addr and serves each from its own session.
+func listenGTP(addr string, repo matchRepository, hub *matchHub, bots *botRunner) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Accepting GTP connections on %s...\n", addr)
+	return serveGTP(listener, repo, hub, bots)
+}
+
+func serveGTP(listener net.Listener, repo matchRepository, hub *matchHub, bots *botRunner) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			newGTPSession(repo, hub, bots).serve(conn, conn)
+		}()
+	}
+}
+
+// gtpSession is one GTP connection. It plays a single match at a time, stored in the repository
+// like any other, so its moves show up over HTTP and moves made over HTTP show up in it. The
+// session holds the seat tokens of the sides it may play, and generates their moves with bot.
+// Handicap stones played before white's first move are gathered in setup until they make up a
+// handicap.
+type gtpSession struct {
+	repo     matchRepository
+	hub      *matchHub
+	bots     *botRunner
+	gridSize int
+	komi     float64
+	handicap int
+	setup    []gogo.Coordinate
+	matchID  string
+	tokens   map[byte]string
+	bot      string
+	moveWait time.Duration
+}
+
+func newGTPSession(repo matchRepository, hub *matchHub, bots *botRunner) *gtpSession {
+	return &gtpSession{
+		repo:     repo,
+		hub:      hub,
+		bots:     bots,
+		gridSize: 19,
+		komi:     defaultKomi,
+		tokens:   map[byte]string{},
+		bot:      gtpDefaultBot,
+		moveWait: gtpMoveWait,
+	}
+}
+
+// serve answers commands read from r until quit or the end of the input.
+func (session *gtpSession) serve(r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		id, name, args, ok := parseGTPCommand(scanner.Text())
+		if !ok {
+			continue
+		}
+		var result string
+		err := errors.New("unknown command")
+		if command, known := gtpCommands[name]; known {
+			result, err = command(session, args)
+		}
+		if err != nil {
+			_, err = fmt.Fprintf(w, "?%s %s\n\n", id, err)
+		} else {
+			_, err = fmt.Fprintf(w, "=%s %s\n\n", id, result)
+		}
+		if err != nil || name == "quit" {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// parseGTPCommand splits a line of input into its optional numeric ID, command name and
+// arguments, after removing comments and control characters. Blank lines are not commands.
+func parseGTPCommand(line string) (id string, name string, args []string, ok bool) {
+	if hash := strings.IndexByte(line, '#'); hash >= 0 {
+		line = line[:hash]
+	}
+	line = strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return ' '
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, line)
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		if _, err := strconv.Atoi(fields[0]); err == nil {
+			id, fields = fields[0], fields[1:]
+		}
+	}
+	if len(fields) == 0 {
+		return id, "", nil, false
+	}
+	return id, fields[0], fields[1:], true
+}
+
+func gtpKnownCommand(session *gtpSession, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errGTPSyntax
+	}
+	_, known := gtpCommands[args[0]]
+	return strconv.FormatBool(known), nil
+}
+
+func gtpListCommands(session *gtpSession, args []string) (string, error) {
+	names := make([]string, 0, len(gtpCommands))
+	for name := range gtpCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "\n"), nil
+}
+
+// boardSize sets the size of the board for the next clear_board, leaving the current match.
+func (session *gtpSession) boardSize(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errGTPSyntax
+	}
+	size, err := strconv.Atoi(args[0])
+	if err != nil {
+		return "", errGTPSyntax
+	}
+	if !(newMatchRequest{GridSize: size, PlayerBlack: "black", PlayerWhite: "white"}).isValid() {
+		return "", errors.New("unacceptable size")
+	}
+	session.gridSize = size
+	session.matchID, session.tokens, session.setup = "", map[byte]string{}, nil
+	return "", nil
+}
+
+// clearBoard starts a new match, holding both of its seats. The match keeps the handicap of the
+// last one, so that a controller starting over does not lose black's stones.
+func (session *gtpSession) clearBoard(args []string) (string, error) {
+	match := gogo.NewMatch(session.gridSize, "black", "white")
+	settings := matchSettings{Komi: session.komi, Handicap: session.handicap}
+	for _, point := range handicapPoints(match.GridSize, settings.Handicap) {
+		match.GameBoard.Positions[point.X][point.Y] = gogo.PlayerBlack
+	}
+	tokens, err := newSeats()
+	if err != nil {
+		return "", err
+	}
+	settings.BlackSeatHash = hashSeatToken(tokens.Black)
+	settings.WhiteSeatHash = hashSeatToken(tokens.White)
+	if err = session.repo.addMatch(match, settings); err != nil {
+		return "", err
+	}
+	session.matchID, session.setup = match.ID, nil
+	session.tokens = map[byte]string{gogo.PlayerBlack: tokens.Black, gogo.PlayerWhite: tokens.White}
+	return "", nil
+}
+
+// setKomi sets the komi of matches started from now on. The current match takes it too, as long
+// as nobody has moved in it yet and the session holds both its seats; otherwise it keeps its own.
+func (session *gtpSession) setKomi(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errGTPSyntax
+	}
+	komi, err := strconv.ParseFloat(args[0], 64)
+	if err != nil {
+		return "", errGTPSyntax
+	}
+	session.komi = komi
+	if session.matchID == "" {
+		return "", nil
+	}
+	state, err := session.repo.loadMatch(session.matchID)
+	if err != nil {
+		return "", err
+	}
+	if len(state.Moves) > 0 || !session.holdsSeat(state.Settings, gogo.PlayerBlack) || !session.holdsSeat(state.Settings, gogo.PlayerWhite) {
+		return "", nil
+	}
+	if err = session.repo.setKomi(session.matchID, state.Version, komi); err != nil {
+		return "", err
+	}
+	state.Settings.Komi = komi
+	var mdr matchDetailsResponse
+	mdr.copyMatch(state.Match, state.Settings, state.Moves, state.Undos)
+	mdr.version = state.Version + 1
+	session.hub.publish(session.matchID, mdr)
+	return "", nil
+}
+
+// holdsSeat reports whether the session may play for the player.
+func (session *gtpSession) holdsSeat(settings matchSettings, player byte) bool {
+	status, _ := authorizeSeatToken(session.tokens[player], settings, player)
+	return status == http.StatusOK
+}
+
+// seatCheck vets the session's moves for the player against the seat token it holds.
+func (session *gtpSession) seatCheck(player byte) moveCheck {
+	return func(settings matchSettings, version int) (int, error) {
+		return authorizeSeatToken(session.tokens[player], settings, player)
+	}
+}
+
+// chooseBot picks the bot, one of the built-in ones or a GTP engine, that generates the moves of
+// the session's seats. With no arguments it reports the current one.
+func (session *gtpSession) chooseBot(args []string) (string, error) {
+	if len(args) == 0 {
+		return session.bot, nil
+	}
+	if len(args) != 1 {
+		return "", errGTPSyntax
+	}
+	if _, ok := botPlayers[args[0]]; !ok {
+		return "", errors.New("unknown bot")
+	}
+	session.bot = args[0]
+	return "", nil
+}
+
+// attach switches the session to a stored match, taking the seats whose tokens follow its ID.
+// With no arguments it reports the ID of the current match.
+func (session *gtpSession) attach(args []string) (string, error) {
+	if len(args) == 0 {
+		return session.matchID, nil
+	}
+	state, err := session.repo.loadMatch(args[0])
+	if err != nil {
+		return "", errors.New("unknown match")
+	}
+	match, settings := state.Match, state.Settings
+	tokens := map[byte]string{}
+	for _, token := range args[1:] {
+		seat := byte(0)
+		for _, player := range []byte{gogo.PlayerBlack, gogo.PlayerWhite} {
+			if hash := settings.seatHash(player); hash != "" && hash == hashSeatToken(token) {
+				seat = player
+			}
+		}
+		if seat == 0 {
+			return "", errors.New("seat token does not belong to this match")
+		}
+		tokens[seat] = token
+	}
+	session.matchID, session.tokens, session.setup = match.ID, tokens, nil
+	session.gridSize, session.komi, session.handicap = match.GridSize, settings.Komi, settings.Handicap
+	return "", nil
+}
+
+// seats lists the seat tokens the session holds, so that a seat can be handed to a player
+// joining over HTTP.
+func (session *gtpSession) seats(args []string) (string, error) {
+	var lines []string
+	for _, player := range []byte{gogo.PlayerBlack, gogo.PlayerWhite} {
+		if token, ok := session.tokens[player]; ok {
+			lines = append(lines, playerName(player)+" "+token)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// play submits a move through the same path as the HTTP API, checked against the session's seats.
+func (session *gtpSession) play(args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errGTPSyntax
+	}
+	if session.matchID == "" {
+		return "", errGTPNoMatch
+	}
+	player, ok := parseGTPColor(args[0])
+	if !ok {
+		return "", errGTPSyntax
+	}
+	position, ok := parseGTPVertex(args[1], session.gridSize)
+	if !ok {
+		return "", errGTPSyntax
+	}
+	if player == gogo.PlayerBlack && position != nil {
+		if placed, err := session.setupStone(gogo.Coordinate{X: position.X, Y: position.Y}); placed || err != nil {
+			return "", err
+		}
+	}
+	if len(session.setup) > 0 {
+		return "", errGTPSetup
+	}
+	mdr, _, status, err := submitMove(session.repo, session.matchID, newMoveRequest{Player: player, Position: position}, false, session.seatCheck(player))
+	if err == errOutOfTime {
+		publishMove(session.hub, session.bots, session.matchID, mdr)
+	}
+	if err != nil {
+		return "", gtpMoveError(status, err)
+	}
+	publishMove(session.hub, session.bots, session.matchID, mdr)
+	return "", nil
+}
+
+// setupStone takes a black stone played while white is due to make the first move as a handicap
+// stone, which is how controllers set up handicap games. Stones are gathered until they cover the
+// handicap points for their number, and the match is then started over with that handicap. A
+// stone resent on a point the handicap already covers changes nothing. It reports false for a
+// stone that cannot be part of a handicap, to be played as an ordinary move.
+func (session *gtpSession) setupStone(position gogo.Coordinate) (bool, error) {
+	state, err := session.repo.loadMatch(session.matchID)
+	if err != nil {
+		return false, err
+	}
+	settings := state.Settings
+	if nextPlayer(settings, state.Moves) != gogo.PlayerWhite ||
+		!session.holdsSeat(settings, gogo.PlayerBlack) || !session.holdsSeat(settings, gogo.PlayerWhite) {
+		return false, nil
+	}
+	stones := append(handicapPoints(session.gridSize, settings.Handicap), session.setup...)
+	for _, move := range state.Moves {
+		if move.Player != gogo.PlayerBlack || move.Position == nil {
+			return false, nil
+		}
+		stones = append(stones, *move.Position)
+	}
+	for _, stone := range stones {
+		if stone == position {
+			return len(state.Moves) == 0 && len(session.setup) == 0, nil
+		}
+	}
+	stones = append(stones, position)
+	for count := len(stones); count <= maxHandicap; count++ {
+		if !containsPoints(handicapPoints(session.gridSize, count), stones) {
+			continue
+		}
+		if count > len(stones) {
+			session.setup = append(session.setup, position)
+			return true, nil
+		}
+		session.handicap = count
+		_, err = session.clearBoard(nil)
+		return true, err
+	}
+	return false, nil
+}
+
+// containsPoints reports whether every one of the points is among those given first.
+func containsPoints(points []gogo.Coordinate, subset []gogo.Coordinate) bool {
+	for _, point := range subset {
+		found := false
+		for _, candidate := range points {
+			found = found || candidate == point
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// gtpMoveError words a move rejected by submitMove the way GTP controllers expect.
+func gtpMoveError(status int, err error) error {
+	switch {
+	case err == errOutOfTime:
+		return errors.New("out of time")
+	case err == errVersionConflict:
+		return errors.New("match changed while moving; try again")
+	case status == http.StatusBadRequest:
+		return errors.New("illegal move")
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return errors.New("seat not held by this session")
+	case status == http.StatusNotFound:
+		return errors.New("unknown match")
+	case status == http.StatusConflict:
+		// The match is over, or it is the other player's turn.
+		return errors.New(strings.ToLower(err.Error()[:1]) + err.Error()[1:])
+	}
+	return err
+}
+
+// genMove answers with the next move for the given color. The session generates the move with its
+// bot when it holds the seat, unless the match's own bot plays it. Otherwise it waits a while for
+// the move to be made elsewhere, by a player over HTTP or by the match's bot.
+func (session *gtpSession) genMove(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errGTPSyntax
+	}
+	if session.matchID == "" {
+		return "", errGTPNoMatch
+	}
+	player, ok := parseGTPColor(args[0])
+	if !ok {
+		return "", errGTPSyntax
+	}
+	if len(session.setup) > 0 {
+		return "", errGTPSetup
+	}
+	updates := session.hub.subscribe(session.matchID)
+	defer session.hub.unsubscribe(session.matchID, updates)
+	state, err := session.repo.loadMatch(session.matchID)
+	if err != nil {
+		return "", err
+	}
+	moves := state.Moves
+	if matchStatus(moves) == matchStatusFinished {
+		return "", errors.New("match is already finished")
+	}
+	if nextPlayer(state.Settings, moves) != player {
+		return "", errors.New("it is not " + playerName(player) + "'s turn")
+	}
+	if _, ok := botFor(state.Match, player); !ok && session.holdsSeat(state.Settings, player) {
+		return session.generateMove(state, player)
+	}
+
+	awaited := len(moves)
+	timeout := time.NewTimer(session.moveWait)
+	defer timeout.Stop()
+	ticker := time.NewTicker(eventsRefreshPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-updates:
+		case <-ticker.C:
+		case <-timeout.C:
+			return "", errGTPNoMove
+		}
+		moves, err = session.repo.getMoves(session.matchID)
+		if err != nil {
+			return "", err
+		}
+		if len(moves) > awaited {
+			move := moves[awaited]
+			// GTP has no way to say the opponent ran out of time, so it resigns for them.
+			if move.isForfeit() {
+				return "resign", nil
+			}
+			return gtpVertex(session.gridSize, move.Position), nil
+		}
+	}
+}
+
+// generateMove has the session's bot choose the player's move and plays it. A bot whose move turns
+// out to be illegal resigns, as it would in a match of its own.
+func (session *gtpSession) generateMove(state matchState, player byte) (string, error) {
+	bot, ok := botPlayers[session.bot]
+	if !ok {
+		return "", errGTPNoMove
+	}
+	position, resign := bot.chooseMove(botTurnFor(state, player))
+	moveRequest := newMoveRequest{Player: player}
+	if position != nil {
+		moveRequest.Position = &boardPosition{X: position.X, Y: position.Y}
+	}
+	mdr, _, status, err := submitMove(session.repo, session.matchID, moveRequest, resign, session.seatCheck(player))
+	if status == http.StatusBadRequest {
+		resign = true
+		mdr, _, status, err = submitMove(session.repo, session.matchID, newMoveRequest{Player: player}, true, session.seatCheck(player))
+	}
+	if err == errOutOfTime {
+		publishMove(session.hub, session.bots, session.matchID, mdr)
+		return "resign", nil
+	}
+	if err != nil {
+		return "", gtpMoveError(status, err)
+	}
+	publishMove(session.hub, session.bots, session.matchID, mdr)
+	if releaser, ok := bot.(botReleaser); ok && mdr.Status == matchStatusFinished {
+		releaser.release(session.matchID)
+	}
+	if resign {
+		return "resign", nil
+	}
+	return gtpVertex(session.gridSize, position), nil
+}
+
+// undo takes back the last move, provided it was played from one of the session's seats. It goes
+// through the same request as an undo over HTTP, which GTP has no way to leave pending, so the
+// opponent must agree up front: a bot always does, and so does the session when it holds both seats.
+func (session *gtpSession) undo(args []string) (string, error) {
+	if session.matchID == "" {
+		return "", errGTPNoMatch
+	}
+	stored, err := session.repo.loadMatch(session.matchID)
+	if err != nil {
+		return "", err
+	}
+	if len(stored.Moves) == 0 {
+		return "", errGTPNoUndo
+	}
+	player := stored.Moves[len(stored.Moves)-1].Player
+	_, agreed := botFor(stored.Match, opponent(player))
+	agreed = agreed || session.holdsSeat(stored.Settings, opponent(player))
+	if !session.holdsSeat(stored.Settings, player) || !agreed {
+		return "", errGTPNoUndo
+	}
+	if _, _, err = requestUndo(session.repo, session.hub, newUndoState(stored, player), true); err != nil {
+		return "", errGTPNoUndo
+	}
+	return "", nil
+}
+
+func (session *gtpSession) showBoard(args []string) (string, error) {
+	if session.matchID == "" {
+		return "", errGTPNoMatch
+	}
+	state, err := session.repo.loadMatch(session.matchID)
+	if err != nil {
+		return "", err
+	}
+	match, settings, moves := state.Match, state.Settings, state.Moves
+	// A blank line would end the response early.
+	board := strings.Replace(string(renderASCII(match, settings, moves)), "\n\n", "\n", -1)
+	return "\n" + strings.TrimRight(board, "\n"), nil
+}
+
+// finalScore reports the result of a finished match, or the territory score of the board as it stands.
+func (session *gtpSession) finalScore(args []string) (string, error) {
+	if session.matchID == "" {
+		return "", errGTPNoMatch
+	}
+	state, err := session.repo.loadMatch(session.matchID)
+	if err != nil {
+		return "", err
+	}
+	match, settings, moves := state.Match, state.Settings, state.Moves
+	if result := sgfResult(match, settings, moves); result != "" {
+		return result, nil
+	}
+	return territoryResult(match, settings, moves), nil
+}
+
+func parseGTPColor(s string) (player byte, ok bool) {
+	switch strings.ToLower(s) {
+	case "b", "black":
+		return gogo.PlayerBlack, true
+	case "w", "white":
+		return gogo.PlayerWhite, true
+	}
+	return 0, false
+}
+
+// parseGTPVertex reads a vertex such as "D4" or "pass", the latter giving a nil position.
+func parseGTPVertex(s string, gridSize int) (position *boardPosition, ok bool) {
+	s = strings.ToUpper(s)
+	if s == "PASS" {
+		return nil, true
+	}
+	if len(s) < 2 || s[0] < 'A' || s[0] > 'Z' || s[0] == 'I' {
+		return nil, false
+	}
+	x := int(s[0] - 'A')
+	if s[0] > 'I' {
+		x--
+	}
+	row, err := strconv.Atoi(s[1:])
+	if err != nil || x >= gridSize || row < 1 || row > gridSize {
+		return nil, false
+	}
+	return &boardPosition{X: x, Y: gridSize - row}, true
+}
+
+func gtpVertex(gridSize int, position *gogo.Coordinate) string {
+	if position == nil {
+		return "pass"
+	}
+	return columnLabel(position.X) + rowLabel(gridSize, position.Y)
+}
@@ -0,0 +1,342 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudnativego/gogo-engine"
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/mux"
+)
+
+func TestGTPSessionPlaysStoredMatch(t *testing.T) {
+	repo := newInMemoryRepository()
+	session := newGTPSession(repo, newMatchHub(), newBotRunner(repo, newMatchHub()))
+	script := "1 protocol_version\nboardsize 9\nclear_board\n\n# a comment\nplay b D5\n2 play\tw e5\n3 play b d5\nundo\nplay w C3\nfoo\nquit\nname\n"
+
+	var out bytes.Buffer
+	if err := session.serve(strings.NewReader(script), &out); err != nil {
+		t.Fatalf("Expected the session to end cleanly, got %v", err)
+	}
+	expected := "=1 2\n\n= \n\n= \n\n= \n\n=2 \n\n?3 illegal move\n\n= \n\n= \n\n? unknown command\n\n= \n\n"
+	if out.String() != expected {
+		t.Errorf("Expected responses %q, got %q", expected, out.String())
+	}
+
+	match, _ := repo.getMatch(session.matchID)
+	moves, _ := repo.getMoves(session.matchID)
+	if len(moves) != 2 || match.GridSize != 9 || match.GameBoard.Positions[3][4] != gogo.PlayerBlack || match.GameBoard.Positions[4][4] != 0 {
+		t.Errorf("Expected white's first move to be undone and replayed at C3, got moves %+v on\n%s", moves, asciiBoard(match.GameBoard.Positions))
+	}
+	if match.GameBoard.Positions[2][6] != gogo.PlayerWhite {
+		t.Errorf("Expected white's stone on C3, got\n%s", asciiBoard(match.GameBoard.Positions))
+	}
+}
+
+func TestGTPSessionRespectsSeats(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches", strings.NewReader("{\"gridsize\": 9, \"playerWhite\": \"bob\", \"playerBlack\": \"alfred\"}"))
+	server.ServeHTTP(recorder, request)
+	var mr newMatchResponse
+	json.Unmarshal(recorder.Body.Bytes(), &mr)
+
+	session := newGTPSession(repo, newMatchHub(), newBotRunner(repo, newMatchHub()))
+	responses := runGTP(session, "gogo-match "+mr.ID+" not-a-token",
+		"gogo-match "+mr.ID+" "+mr.SeatTokens.Black,
+		"gogo-match",
+		"play black C3",
+		"play white D4",
+		"gogo-seats",
+		"showboard",
+		"final_score")
+	if !strings.HasPrefix(responses[0], "? seat token does not belong") {
+		t.Errorf("Expected a foreign token to be refused, got %q", responses[0])
+	}
+	if responses[2] != "= "+mr.ID {
+		t.Errorf("Expected gogo-match to report the current match, got %q", responses[2])
+	}
+	if responses[3] != "= " || !strings.HasPrefix(responses[4], "? ") {
+		t.Errorf("Expected only black's seat to be playable, got %q and %q", responses[3], responses[4])
+	}
+	if responses[5] != "= black "+mr.SeatTokens.Black {
+		t.Errorf("Expected the session to hold only black's seat, got %q", responses[5])
+	}
+	if !strings.Contains(responses[6], "alfred (X, black) vs bob (O, white)") || !strings.Contains(responses[6], " 3 . . X") {
+		t.Errorf("Expected showboard to draw the match, got %q", responses[6])
+	}
+	if !strings.HasPrefix(responses[7], "= B+") && !strings.HasPrefix(responses[7], "= W+") {
+		t.Errorf("Expected a score, got %q", responses[7])
+	}
+}
+
+// watchedRepository signals every time the moves of a match have been read.
+type watchedRepository struct {
+	*inMemoryMatchRepository
+	reads chan bool
+}
+
+func (repo *watchedRepository) getMoves(id string) ([]matchMove, error) {
+	moves, err := repo.inMemoryMatchRepository.getMoves(id)
+	select {
+	case repo.reads <- true:
+	default:
+	}
+	return moves, err
+}
+
+func (repo *watchedRepository) loadMatch(id string) (matchState, error) {
+	state, err := repo.inMemoryMatchRepository.loadMatch(id)
+	select {
+	case repo.reads <- true:
+	default:
+	}
+	return state, err
+}
+
+func TestGTPGenmoveWaitsForMoveOverHTTP(t *testing.T) {
+	repo := &watchedRepository{inMemoryMatchRepository: newInMemoryRepository(), reads: make(chan bool, 1)}
+	hub := newMatchHub()
+	mx := mux.NewRouter()
+	initRoutes(mx, formatter, repo, hub, newBotRunner(repo, hub))
+	server := negroni.New()
+	server.UseHandler(mx)
+
+	session := newGTPSession(repo, hub, newBotRunner(repo, hub))
+	runGTP(session, "boardsize 9", "clear_board", "play b E5")
+	whiteToken := session.tokens[gogo.PlayerWhite]
+	delete(session.tokens, gogo.PlayerWhite)
+
+	in, commands := io.Pipe()
+	var out bytes.Buffer
+	done := make(chan bool)
+	go func() {
+		session.serve(in, &out)
+		close(done)
+	}()
+	<-repo.reads
+	io.WriteString(commands, "genmove white\n")
+	// Only move once genmove has looked at the match, so it has to wait for this move.
+	<-repo.reads
+
+	recorder := postMoveAs(server, session.matchID, "{\"player\": 2, \"position\": {\"x\": 2, \"y\": 6}}", whiteToken)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected white's move over HTTP to succeed, got %d", recorder.Code)
+	}
+	commands.Close()
+	<-done
+	if out.String() != "= C3\n\n" {
+		t.Errorf("Expected genmove to answer with white's move, got %q", out.String())
+	}
+
+	if responses := runGTP(session, "genmove white"); !strings.HasPrefix(responses[0], "? it is not white's turn") {
+		t.Errorf("Expected genmove out of turn to fail, got %q", responses[0])
+	}
+}
+
+func TestGTPGenmoveGeneratesMovesForHeldSeats(t *testing.T) {
+	repo := newInMemoryRepository()
+	session := newGTPSession(repo, newMatchHub(), newBotRunner(repo, newMatchHub()))
+	responses := runGTP(session, "boardsize 9", "clear_board", "gogo-bot random", "gogo-bot", "genmove black", "genmove white", "gogo-bot deep-thought")
+	if responses[3] != "= random" {
+		t.Errorf("Expected gogo-bot to report the chosen bot, got %q", responses[3])
+	}
+	for _, response := range responses[4:6] {
+		if _, ok := parseGTPVertex(strings.TrimPrefix(response, "= "), 9); !ok && response != "= resign" {
+			t.Errorf("Expected genmove to answer with a generated move, got %q", response)
+		}
+	}
+	if moves, _ := repo.getMoves(session.matchID); len(moves) != 2 {
+		t.Errorf("Expected both generated moves to be stored, got %+v", moves)
+	}
+	if responses[6] != "? unknown bot" {
+		t.Errorf("Expected an unknown bot to be refused, got %q", responses[6])
+	}
+
+	delete(session.tokens, gogo.PlayerBlack)
+	session.moveWait = 10 * time.Millisecond
+	if responses := runGTP(session, "genmove black"); responses[0] != "? cannot generate move" {
+		t.Errorf("Expected genmove for a seat played elsewhere to give up, got %q", responses[0])
+	}
+}
+
+func TestGTPKomiAppliesUntilTheFirstMove(t *testing.T) {
+	repo := newInMemoryRepository()
+	session := newGTPSession(repo, newMatchHub(), newBotRunner(repo, newMatchHub()))
+	runGTP(session, "boardsize 9", "clear_board", "komi 0.5")
+	state, _ := repo.loadMatch(session.matchID)
+	if state.Settings.Komi != 0.5 {
+		t.Errorf("Expected komi to apply to a match nobody has moved in, got %v", state.Settings.Komi)
+	}
+	runGTP(session, "play b E5", "komi 9.5")
+	state, _ = repo.loadMatch(session.matchID)
+	if state.Settings.Komi != 0.5 || session.komi != 9.5 {
+		t.Errorf("Expected komi to only apply to later matches once moves are made, got %v and %v", state.Settings.Komi, session.komi)
+	}
+}
+
+func TestGTPPlayExplainsRejectedMoves(t *testing.T) {
+	repo := newInMemoryRepository()
+	session := newGTPSession(repo, newMatchHub(), newBotRunner(repo, newMatchHub()))
+	runGTP(session, "boardsize 9", "clear_board", "play b E5")
+	responses := runGTP(session, "play b D4", "play w E5")
+	if responses[0] != "? it is white's turn to move" {
+		t.Errorf("Expected a move out of turn to say whose turn it is, got %q", responses[0])
+	}
+	if responses[1] != "? illegal move" {
+		t.Errorf("Expected a move on an occupied point to be illegal, got %q", responses[1])
+	}
+	delete(session.tokens, gogo.PlayerWhite)
+	if responses := runGTP(session, "play w D4"); responses[0] != "? seat not held by this session" {
+		t.Errorf("Expected a move for a seat not held to be refused, got %q", responses[0])
+	}
+}
+
+func TestGTPPlaySetsUpHandicapStones(t *testing.T) {
+	repo := newInMemoryRepository()
+	session := newGTPSession(repo, newMatchHub(), newBotRunner(repo, newMatchHub()))
+	commands := []string{"boardsize 19", "clear_board", "komi 0.5"}
+	for _, stone := range handicapPoints(19, 6) {
+		commands = append(commands, "play black "+gtpVertex(19, &stone))
+	}
+	for idx, response := range runGTP(session, commands...) {
+		if response != "= " {
+			t.Errorf("Expected %q to be accepted, got %q", commands[idx], response)
+		}
+	}
+	state, _ := repo.loadMatch(session.matchID)
+	if state.Settings.Handicap != 6 || len(state.Moves) != 0 || state.Settings.Komi != 0.5 {
+		t.Fatalf("Expected the stones to start a match with a handicap of 6, got %+v and moves %+v", state.Settings, state.Moves)
+	}
+	for _, stone := range handicapPoints(19, 6) {
+		if state.Match.GameBoard.Positions[stone.X][stone.Y] != gogo.PlayerBlack {
+			t.Errorf("Expected a handicap stone on %s, got\n%s", gtpVertex(19, &stone), asciiBoard(state.Match.GameBoard.Positions))
+		}
+	}
+
+	// Starting over keeps the handicap, and resending its stones is harmless.
+	commands = []string{"clear_board", "play black D4", "play white K10", "play black C3"}
+	responses := runGTP(session, commands...)
+	if responses[1] != "= " || responses[2] != "= " || responses[3] != "= " {
+		t.Errorf("Expected the handicap stones to be taken as placed and play to go on, got %q", responses)
+	}
+	state, _ = repo.loadMatch(session.matchID)
+	if state.Settings.Handicap != 6 || len(state.Moves) != 2 || state.Moves[0].Player != gogo.PlayerWhite {
+		t.Errorf("Expected clear_board to keep the handicap, got %+v and moves %+v", state.Settings, state.Moves)
+	}
+
+	if responses := runGTP(session, "clear_board", "play black E5"); responses[1] != "? it is white's turn to move" {
+		t.Errorf("Expected a black stone off the handicap points to be played as a move, got %q", responses[1])
+	}
+}
+
+func TestGTPPlayIsRetriedAfterVersionConflict(t *testing.T) {
+	repo := &racingRepository{inMemoryMatchRepository: newInMemoryRepository()}
+	session := newGTPSession(repo, newMatchHub(), newBotRunner(repo, newMatchHub()))
+	runGTP(session, "boardsize 9", "clear_board")
+	repo.races = 1
+	if responses := runGTP(session, "play b E5"); responses[0] != "= " {
+		t.Errorf("Expected a move that lost one race to be retried and land, got %q", responses[0])
+	}
+	repo.races = maxMoveAttempts
+	if responses := runGTP(session, "play w D4"); responses[0] != "? match changed while moving; try again" {
+		t.Errorf("Expected a move that keeps losing races to be refused, got %q", responses[0])
+	}
+	if moves, _ := repo.getMoves(session.matchID); len(moves) != 1 {
+		t.Errorf("Expected only the retried move to be recorded, got %+v", moves)
+	}
+}
+
+func TestGTPUndoNeedsTheOpponentsConsent(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches", strings.NewReader("{\"gridsize\": 9, \"playerWhite\": \"bob\", \"playerBlack\": \"alfred\"}"))
+	server.ServeHTTP(recorder, request)
+	var mr newMatchResponse
+	json.Unmarshal(recorder.Body.Bytes(), &mr)
+
+	session := newGTPSession(repo, newMatchHub(), newBotRunner(repo, newMatchHub()))
+	responses := runGTP(session, "gogo-match "+mr.ID+" "+mr.SeatTokens.Black, "play b C3", "undo")
+	if responses[2] != "? cannot undo" {
+		t.Errorf("Expected an undo to need the consent of white, who plays elsewhere, got %q", responses[2])
+	}
+	if moves, _ := repo.getMoves(mr.ID); len(moves) != 1 {
+		t.Errorf("Expected black's move to stand, got %+v", moves)
+	}
+
+	runGTP(session, "boardsize 9", "clear_board", "play b E5")
+	anyVersion := func(matchSettings, int) (int, error) { return http.StatusOK, nil }
+	submitMove(repo, session.matchID, newMoveRequest{Player: gogo.PlayerWhite}, true, anyVersion)
+	if responses := runGTP(session, "undo"); responses[0] != "? cannot undo" {
+		t.Errorf("Expected no undo in a finished match, got %q", responses[0])
+	}
+	if state, _ := repo.loadMatch(session.matchID); len(state.Moves) != 2 || len(state.Undos) != 0 {
+		t.Errorf("Expected the finished match to be left alone, got %+v", state.Moves)
+	}
+}
+
+func TestGTPListenerServesConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Cannot listen on loopback: %v", err)
+	}
+	defer listener.Close()
+	repo := newInMemoryRepository()
+	go serveGTP(listener, repo, newMatchHub(), newBotRunner(repo, newMatchHub()))
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected to connect to the GTP listener, got %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "known_command genmove\nknown_command fly\nquit\n")
+	reader := bufio.NewReader(conn)
+	var lines []string
+	for line, err := reader.ReadString('\n'); err == nil; line, err = reader.ReadString('\n') {
+		lines = append(lines, line)
+	}
+	if strings.Join(lines, "") != "= true\n\n= false\n\n= \n\n" {
+		t.Errorf("Unexpected responses %q", lines)
+	}
+}
+
+func TestParseGTPVertex(t *testing.T) {
+	cases := map[string]*boardPosition{
+		"A1":   {X: 0, Y: 18},
+		"t19":  {X: 18, Y: 0},
+		"J10":  {X: 8, Y: 9},
+		"pass": nil,
+	}
+	for vertex, expected := range cases {
+		position, ok := parseGTPVertex(vertex, 19)
+		if !ok || (expected == nil) != (position == nil) || (expected != nil && *position != *expected) {
+			t.Errorf("Expected %s to be %v, got %v", vertex, expected, position)
+		}
+	}
+	for _, vertex := range []string{"I5", "A0", "A20", "U1", "5A", "Z"} {
+		if _, ok := parseGTPVertex(vertex, 19); ok {
+			t.Errorf("Expected %s to be rejected", vertex)
+		}
+	}
+	if gtpVertex(19, &gogo.Coordinate{X: 8, Y: 9}) != "J10" || gtpVertex(19, nil) != "pass" {
+		t.Error("Expected vertices to be written as they are read")
+	}
+}
+
+// runGTP sends each command to the session and returns the response to each, without its
+// trailing blank line.
+func runGTP(session *gtpSession, commands ...string) []string {
+	var out bytes.Buffer
+	session.serve(strings.NewReader(strings.Join(commands, "\n")+"\n"), &out)
+	return strings.Split(strings.TrimSuffix(out.String(), "\n\n"), "\n\n")
+}
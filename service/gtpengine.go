@@ -0,0 +1,436 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+const (
+	// gtpEnginesEnv names the environment variable listing the GTP engines installed on the host,
+	// as name=command pairs separated by semicolons, e.g. "gnugo=/usr/games/gnugo --mode gtp".
+	// Each engine can then be played as bot:<name>.
+	gtpEnginesEnv = "GTP_ENGINES"
+
+	// engineGracePeriod is how long an engine may take to answer on top of its thinking time
+	// before it is given up on.
+	engineGracePeriod = 5 * time.Second
+
+	// maxEngineProcesses is how many engine processes may run at once, across every engine.
+	maxEngineProcesses = 8
+
+	// engineIdleTimeout is how long an engine process is kept waiting for the next move of its
+	// match, e.g. while a person thinks, before it is stopped to free its slot.
+	engineIdleTimeout = 5 * time.Minute
+)
+
+var (
+	errEngineExited  = errors.New("engine exited")
+	errEngineTimeout = errors.New("engine did not answer in time")
+	errEnginesBusy   = errors.New("every engine process is busy")
+)
+
+// runningEngines holds every engine process, so that their number can be capped across engines.
+var runningEngines = newEnginePool(maxEngineProcesses)
+
+// registerGTPEngines adds the engines listed in spec to the bots matches can be played against.
+func registerGTPEngines(spec string) error {
+	for _, entry := range strings.Split(spec, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" || len(strings.Fields(parts[1])) == 0 {
+			return fmt.Errorf("malformed GTP engine %q, expected name=command", entry)
+		}
+		if _, taken := botPlayers[name]; taken {
+			return fmt.Errorf("GTP engine %q clashes with an existing bot", name)
+		}
+		botPlayers[name] = newGTPEngine(name, strings.Fields(parts[1]))
+	}
+	return nil
+}
+
+// gtpEngine plays moves chosen by an external program speaking the Go Text Protocol. Each match
+// gets a process of its own, started when the engine first has to move and stopped when the
+// match is over, when it is deleted, or when it has sat idle for a while. A process is only sent
+// the moves made since it last moved; should the match have gone another way, such as a move
+// taken back, it is sent the whole match again. An engine that crashes, stalls or answers
+// nonsense resigns.
+type gtpEngine struct {
+	name        string
+	command     []string
+	grace       time.Duration
+	idleTimeout time.Duration
+	pool        *enginePool
+
+	// processes is guarded by the pool's lock.
+	processes map[string]*engineProcess
+}
+
+func newGTPEngine(name string, command []string) *gtpEngine {
+	return &gtpEngine{
+		name:        name,
+		command:     command,
+		grace:       engineGracePeriod,
+		idleTimeout: engineIdleTimeout,
+		pool:        runningEngines,
+		processes:   map[string]*engineProcess{},
+	}
+}
+
+func (engine *gtpEngine) searches() {}
+
+func (engine *gtpEngine) chooseMove(turn botTurn) (*gogo.Coordinate, bool) {
+	position, resign, err := engine.genMove(turn)
+	if err != nil {
+		fmt.Printf("GTP engine %s failed in match %s, resigning: %v\n", engine.name, turn.MatchID, err)
+		engine.release(turn.MatchID)
+		return nil, true
+	}
+	return position, resign
+}
+
+// release stops the process playing the match, if there is one. It is safe to call for any match,
+// such as one being deleted.
+func (engine *gtpEngine) release(matchID string) {
+	engine.pool.mu.Lock()
+	process := engine.processes[matchID]
+	if process != nil {
+		engine.pool.remove(process)
+	}
+	engine.pool.mu.Unlock()
+	if process != nil {
+		process.stop()
+	}
+}
+
+// acquire hands out the match's process for the engine's exclusive use, starting it if need be.
+// When the pool is full, the process idle for longest is stopped to make room; if every process
+// is busy, acquire waits for one to finish until the deadline.
+func (engine *gtpEngine) acquire(matchID string, deadline time.Time) (*engineProcess, error) {
+	pool := engine.pool
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for {
+		process, ok := engine.processes[matchID]
+		if ok && !process.busy {
+			process.busy = true
+			if process.idle != nil {
+				process.idle.Stop()
+			}
+			pool.touch(process)
+			return process, nil
+		}
+		if !ok && len(pool.processes) < pool.limit {
+			break
+		}
+		if !ok {
+			if victim := pool.longestIdle(); victim != nil {
+				pool.remove(victim)
+				go victim.stop()
+				continue
+			}
+		}
+		if !time.Now().Before(deadline) {
+			return nil, errEnginesBusy
+		}
+		wake := time.AfterFunc(deadline.Sub(time.Now()), pool.freed.Broadcast)
+		pool.freed.Wait()
+		wake.Stop()
+	}
+
+	process, err := startEngineProcess(engine.command)
+	if err != nil {
+		return nil, err
+	}
+	process.engine, process.matchID, process.busy = engine, matchID, true
+	engine.processes[matchID] = process
+	pool.processes = append(pool.processes, process)
+	return process, nil
+}
+
+// putBack returns a process once its move has been chosen, stopping it should it sit idle for
+// longer than the engine's idle timeout.
+func (engine *gtpEngine) putBack(process *engineProcess) {
+	engine.pool.mu.Lock()
+	defer engine.pool.mu.Unlock()
+	process.busy = false
+	if engine.processes[process.matchID] == process {
+		process.idle = time.AfterFunc(engine.idleTimeout, func() { engine.expire(process) })
+	}
+	engine.pool.freed.Broadcast()
+}
+
+// expire stops a process that has sat idle for too long, unless it has been put to work since.
+func (engine *gtpEngine) expire(process *engineProcess) {
+	engine.pool.mu.Lock()
+	expired := !process.busy && engine.processes[process.matchID] == process
+	if expired {
+		engine.pool.remove(process)
+	}
+	engine.pool.mu.Unlock()
+	if expired {
+		process.stop()
+	}
+}
+
+func (engine *gtpEngine) genMove(turn botTurn) (position *gogo.Coordinate, resign bool, err error) {
+	process, err := engine.acquire(turn.MatchID, turn.Deadline)
+	if err != nil {
+		return nil, false, err
+	}
+	defer engine.putBack(process)
+
+	gridSize := len(turn.Board.Positions)
+	thinkingTime := turn.Deadline.Sub(time.Now())
+	for _, command := range process.syncCommands(turn) {
+		if _, err = process.send(command, engine.grace); err != nil {
+			process.board = nil
+			return nil, false, fmt.Errorf("%s: %v", command, err)
+		}
+	}
+	process.board = &engineBoard{gridSize: gridSize, komi: turn.Komi, handicap: turn.Handicap, moves: turn.Moves}
+	// Not every engine keeps time, so a refusal is not an error.
+	seconds := int(math.Max(1, math.Ceil(thinkingTime.Seconds())))
+	if _, err = process.send(fmt.Sprintf("time_settings 0 %d 1", seconds), engine.grace); err == errEngineExited || err == errEngineTimeout {
+		return nil, false, err
+	}
+
+	reply, err := process.send("genmove "+playerName(turn.Player), thinkingTime+engine.grace)
+	if err != nil {
+		process.board = nil
+		return nil, false, err
+	}
+	if strings.EqualFold(reply, "resign") {
+		return nil, true, nil
+	}
+	vertex, ok := parseGTPVertex(reply, gridSize)
+	if !ok {
+		process.board = nil
+		return nil, false, fmt.Errorf("genmove answered %q", reply)
+	}
+	if vertex != nil {
+		position = &gogo.Coordinate{X: vertex.X, Y: vertex.Y}
+	}
+	// The engine has played its move on its own board.
+	played := matchMove{Player: turn.Player, Position: position}
+	process.board.moves = append(append([]matchMove(nil), turn.Moves...), played)
+	return position, false, nil
+}
+
+// engineBoard is what an engine process has been told about its match: the setup and the moves
+// played on its board.
+type engineBoard struct {
+	gridSize int
+	komi     float64
+	handicap int
+	moves    []matchMove
+}
+
+// syncCommands lists what the process has to be sent to bring its board up to the turn: only the
+// moves made since it last heard of the match, or the whole match should it have gone otherwise.
+func (process *engineProcess) syncCommands(turn botTurn) (commands []string) {
+	gridSize := len(turn.Board.Positions)
+	known := 0
+	if board := process.board; board != nil && board.gridSize == gridSize && board.komi == turn.Komi &&
+		board.handicap == turn.Handicap && isMovePrefix(board.moves, turn.Moves) {
+		known = len(board.moves)
+	} else {
+		commands = []string{
+			fmt.Sprintf("boardsize %d", gridSize),
+			"clear_board",
+			fmt.Sprintf("komi %v", turn.Komi),
+		}
+		for _, stone := range handicapPoints(gridSize, turn.Handicap) {
+			commands = append(commands, "play black "+gtpVertex(gridSize, &stone))
+		}
+	}
+	for _, move := range turn.Moves[known:] {
+		commands = append(commands, fmt.Sprintf("play %s %s", playerName(move.Player), gtpVertex(gridSize, move.Position)))
+	}
+	return
+}
+
+// isMovePrefix reports whether the moves in prefix open the moves in history, stone for stone.
+func isMovePrefix(prefix []matchMove, history []matchMove) bool {
+	if len(prefix) > len(history) {
+		return false
+	}
+	for idx, move := range prefix {
+		other := history[idx]
+		if move.Player != other.Player || (move.Position == nil) != (other.Position == nil) ||
+			(move.Position != nil && *move.Position != *other.Position) {
+			return false
+		}
+	}
+	return true
+}
+
+// enginePool caps the number of engine processes running at once. Its lock also guards each
+// engine's processes and the processes' bookkeeping.
+type enginePool struct {
+	mu    sync.Mutex
+	freed *sync.Cond
+	limit int
+	// processes are ordered from the least to the most recently used.
+	processes []*engineProcess
+}
+
+func newEnginePool(limit int) *enginePool {
+	pool := &enginePool{limit: limit}
+	pool.freed = sync.NewCond(&pool.mu)
+	return pool
+}
+
+// touch moves a process to the back of the queue for eviction. The caller must hold the lock.
+func (pool *enginePool) touch(process *engineProcess) {
+	for idx, candidate := range pool.processes {
+		if candidate == process {
+			pool.processes = append(pool.processes[:idx], pool.processes[idx+1:]...)
+			break
+		}
+	}
+	pool.processes = append(pool.processes, process)
+}
+
+// longestIdle is the process that has waited longest for its next move, or nil if every process
+// is busy. The caller must hold the lock.
+func (pool *enginePool) longestIdle() *engineProcess {
+	for _, process := range pool.processes {
+		if !process.busy {
+			return process
+		}
+	}
+	return nil
+}
+
+// remove forgets a process, leaving it to the caller to stop it. The caller must hold the lock.
+func (pool *enginePool) remove(process *engineProcess) {
+	for idx, candidate := range pool.processes {
+		if candidate == process {
+			pool.processes = append(pool.processes[:idx], pool.processes[idx+1:]...)
+			break
+		}
+	}
+	if process.idle != nil {
+		process.idle.Stop()
+	}
+	if process.engine.processes[process.matchID] == process {
+		delete(process.engine.processes, process.matchID)
+	}
+	pool.freed.Broadcast()
+}
+
+// engineProcess is a running GTP engine. Its replies are read in the background so that waiting
+// for one can be abandoned when the engine takes too long.
+type engineProcess struct {
+	engine  *gtpEngine
+	matchID string
+	// busy and idle are guarded by the pool's lock. board belongs to whoever holds the process.
+	busy  bool
+	idle  *time.Timer
+	board *engineBoard
+
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	replies chan gtpReply
+	done    chan struct{}
+	stopped sync.Once
+}
+
+// gtpReply is an engine's response to a command: its text, and whether it reported a failure.
+type gtpReply struct {
+	text   string
+	failed bool
+}
+
+func startEngineProcess(command []string) (*engineProcess, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	process := &engineProcess{cmd: cmd, stdin: stdin, replies: make(chan gtpReply), done: make(chan struct{})}
+	go process.readReplies(stdout)
+	return process, nil
+}
+
+// send issues a command and waits up to timeout for its reply.
+func (process *engineProcess) send(command string, timeout time.Duration) (string, error) {
+	if _, err := fmt.Fprintln(process.stdin, command); err != nil {
+		return "", errEngineExited
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply, ok := <-process.replies:
+		if !ok {
+			return "", errEngineExited
+		}
+		if reply.failed {
+			return "", errors.New(reply.text)
+		}
+		return reply.text, nil
+	case <-timer.C:
+		return "", errEngineTimeout
+	}
+}
+
+// readReplies collects the lines of each reply up to the blank line that ends it.
+func (process *engineProcess) readReplies(stdout io.Reader) {
+	defer close(process.replies)
+	scanner := bufio.NewScanner(stdout)
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line != "" {
+			lines = append(lines, line)
+			continue
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		reply := parseGTPReply(lines)
+		lines = nil
+		select {
+		case process.replies <- reply:
+		case <-process.done:
+			return
+		}
+	}
+}
+
+// parseGTPReply reads a response such as "=3 D4" or "? illegal move", dropping the status and ID.
+func parseGTPReply(lines []string) (reply gtpReply) {
+	text := strings.Join(lines, "\n")
+	reply.failed = !strings.HasPrefix(text, "=")
+	text = strings.TrimLeft(text[1:], "0123456789")
+	reply.text = strings.TrimSpace(text)
+	return
+}
+
+func (process *engineProcess) stop() {
+	process.stopped.Do(func() {
+		close(process.done)
+		process.stdin.Close()
+		process.cmd.Process.Kill()
+		process.cmd.Wait()
+	})
+}
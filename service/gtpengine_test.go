@@ -0,0 +1,264 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudnativego/gogo-engine"
+	"github.com/gorilla/mux"
+)
+
+// fakeGTPScript is a stand-in GTP engine. It logs every command to the file named by its second
+// argument and answers genmove with its first, unless that is "crash" or "hang".
+const fakeGTPScript = `while read -r line; do
+  echo "$line" >> "$2"
+  case "$line" in
+    genmove*)
+      case "$1" in
+        crash) exit 1 ;;
+        hang) exec sleep 10 ;;
+      esac
+      printf '= %s\n\n' "$1" ;;
+    time_settings*) printf '? unknown command\n\n' ;;
+    *) printf '=\n\n' ;;
+  esac
+done
+`
+
+// newFakeGTPEngine returns an engine running fakeGTPScript with the given genmove reply, and the
+// path of the log of commands it receives.
+func newFakeGTPEngine(t *testing.T, reply string) (engine *gtpEngine, log string, cleanup func()) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("No shell to run the fake GTP engine")
+	}
+	dir, err := ioutil.TempDir("", "gtpengine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "engine.sh")
+	log = filepath.Join(dir, "commands.log")
+	if err = ioutil.WriteFile(script, []byte(fakeGTPScript), 0644); err != nil {
+		t.Fatal(err)
+	}
+	engine = newGTPEngine("fake", []string{"/bin/sh", script, reply, log})
+	engine.grace = 200 * time.Millisecond
+	return engine, log, func() {
+		engine.release("match")
+		os.RemoveAll(dir)
+	}
+}
+
+func readCommandLog(t *testing.T, log string) []string {
+	contents, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatalf("Failed to read the engine's commands: %v", err)
+	}
+	return strings.Split(strings.TrimSpace(string(contents)), "\n")
+}
+
+func TestGTPEngineIsFedTheHistoryBeforeMoving(t *testing.T) {
+	engine, log, cleanup := newFakeGTPEngine(t, "C3")
+	defer cleanup()
+
+	turn := newBotTurn(gogo.NewMatch(9, "alfred", "bot:fake").GameBoard.Positions, gogo.PlayerWhite, 1)
+	turn.MatchID = "match"
+	turn.Handicap = 2
+	turn.Moves = []matchMove{
+		{Player: gogo.PlayerWhite, Position: &gogo.Coordinate{X: 4, Y: 4}},
+		{Player: gogo.PlayerBlack},
+	}
+	position, resign := engine.chooseMove(turn)
+	if resign || position == nil || *position != (gogo.Coordinate{X: 2, Y: 6}) {
+		t.Fatalf("Expected the engine's move at C3, got %v (resign %v)", position, resign)
+	}
+
+	expected := []string{"boardsize 9", "clear_board", "komi 6.5", "play black C7", "play black G3",
+		"play white E5", "play black pass", "time_settings 0 60 1", "genmove white"}
+	if commands := readCommandLog(t, log); strings.Join(commands, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected the engine to be sent %q, got %q", expected, commands)
+	}
+
+	// The same process answers the next move, and is stopped once the match is over.
+	engine.chooseMove(turn)
+	if len(engine.processes) != 1 {
+		t.Errorf("Expected one engine process for the match, got %d", len(engine.processes))
+	}
+	engine.release("match")
+	if len(engine.processes) != 0 {
+		t.Error("Expected the engine process to be stopped on release")
+	}
+}
+
+func TestGTPEngineIsOnlySentNewMoves(t *testing.T) {
+	engine, log, cleanup := newFakeGTPEngine(t, "C3")
+	defer cleanup()
+
+	turn := newBotTurn(gogo.NewMatch(9, "alfred", "bot:fake").GameBoard.Positions, gogo.PlayerWhite, 1)
+	turn.MatchID = "match"
+	turn.Moves = []matchMove{{Player: gogo.PlayerBlack, Position: &gogo.Coordinate{X: 4, Y: 4}}}
+	engine.chooseMove(turn)
+
+	// Black answers the engine's C3, and the engine only needs to hear of that.
+	turn.Moves = append(turn.Moves,
+		matchMove{Player: gogo.PlayerWhite, Position: &gogo.Coordinate{X: 2, Y: 6}},
+		matchMove{Player: gogo.PlayerBlack, Position: &gogo.Coordinate{X: 5, Y: 5}})
+	engine.chooseMove(turn)
+	commands := readCommandLog(t, log)
+	expected := []string{"play black F4", "time_settings 0 60 1", "genmove white"}
+	if got := commands[len(commands)-3:]; strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected the engine to be sent only black's new move, got %q", commands)
+	}
+
+	// Once a move is taken back, the engine is sent the match afresh.
+	turn.Moves = turn.Moves[:1]
+	engine.chooseMove(turn)
+	commands = readCommandLog(t, log)
+	expected = []string{"boardsize 9", "clear_board", "komi 6.5", "play black E5", "time_settings 0 60 1", "genmove white"}
+	if got := commands[len(commands)-6:]; strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected the engine to be sent the match again after an undo, got %q", commands)
+	}
+}
+
+func TestGTPEngineProcessesAreCappedAndStoppedWhenIdle(t *testing.T) {
+	engine, _, cleanup := newFakeGTPEngine(t, "C3")
+	defer cleanup()
+	engine.pool = newEnginePool(1)
+	defer engine.release("other")
+
+	turn := newBotTurn(gogo.NewMatch(9, "bot:fake", "bob").GameBoard.Positions, gogo.PlayerBlack, 1)
+	turn.MatchID = "match"
+	engine.chooseMove(turn)
+	turn.MatchID = "other"
+	if _, resign := engine.chooseMove(turn); resign {
+		t.Fatal("Expected the engine to move in a second match once the idle process made room")
+	}
+	if _, ok := engine.processes["other"]; !ok || len(engine.processes) != 1 {
+		t.Errorf("Expected only the second match's process to be left running, got %v", engine.processes)
+	}
+
+	engine.pool.mu.Lock()
+	engine.idleTimeout = 10 * time.Millisecond
+	engine.pool.mu.Unlock()
+	engine.chooseMove(turn)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		engine.pool.mu.Lock()
+		running := len(engine.processes)
+		engine.pool.mu.Unlock()
+		if running == 0 {
+			return
+		}
+	}
+	t.Error("Expected the idle engine process to be stopped")
+}
+
+func TestGTPEngineResignsWhenItFails(t *testing.T) {
+	for _, reply := range []string{"resign", "crash", "hang", "Z99"} {
+		engine, _, cleanup := newFakeGTPEngine(t, reply)
+		turn := newBotTurn(gogo.NewMatch(9, "bot:fake", "bob").GameBoard.Positions, gogo.PlayerBlack, 1)
+		turn.MatchID = "match"
+		turn.Deadline = time.Now().Add(100 * time.Millisecond)
+
+		start := time.Now()
+		position, resign := engine.chooseMove(turn)
+		if !resign || position != nil {
+			t.Errorf("Expected the engine to resign when it answers %s, got %v", reply, position)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Expected the engine to be given up on promptly when it answers %s, took %v", reply, elapsed)
+		}
+		if reply != "resign" && len(engine.processes) != 0 {
+			t.Errorf("Expected the failed engine process to be stopped when it answers %s", reply)
+		}
+		cleanup()
+	}
+}
+
+func TestGTPEnginesAreRegisteredAsBots(t *testing.T) {
+	defer delete(botPlayers, "gnugo")
+	if err := registerGTPEngines(" gnugo = /usr/games/gnugo --mode gtp ;"); err != nil {
+		t.Fatalf("Expected the engine to be registered, got %v", err)
+	}
+	engine, ok := botPlayers["gnugo"].(*gtpEngine)
+	if !ok || strings.Join(engine.command, " ") != "/usr/games/gnugo --mode gtp" {
+		t.Errorf("Expected bot:gnugo to run the configured command, got %+v", botPlayers["gnugo"])
+	}
+	for _, spec := range []string{"gnugo", "=gnugo", "gnugo=", "random=/usr/bin/random"} {
+		if err := registerGTPEngines(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestGTPEngineRepliesOverHTTP(t *testing.T) {
+	engine, log, cleanup := newFakeGTPEngine(t, "C3")
+	defer cleanup()
+	botPlayers["fake"] = engine
+	defer delete(botPlayers, "fake")
+
+	repo := newInMemoryRepository()
+	bots := newBotRunner(repo, newMatchHub())
+	mx := mux.NewRouter()
+	initRoutes(mx, formatter, repo, newMatchHub(), bots)
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches", strings.NewReader("{\"gridsize\": 9, \"playerBlack\": \"alfred\", \"playerWhite\": \"bot:fake\"}"))
+	mx.ServeHTTP(recorder, request)
+	var matchResponse newMatchResponse
+	json.Unmarshal(recorder.Body.Bytes(), &matchResponse)
+
+	postMoveAs(mx, matchResponse.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}", matchResponse.SeatTokens.Black)
+	bots.wait()
+	moves, _ := repo.getMoves(matchResponse.ID)
+	if len(moves) != 2 || moves[1].Position == nil || *moves[1].Position != (gogo.Coordinate{X: 2, Y: 6}) {
+		t.Fatalf("Expected the engine's reply at C3, got %+v", moves)
+	}
+	if commands := readCommandLog(t, log); commands[3] != "play black E5" {
+		t.Errorf("Expected the engine to be told of black's move, got %q", commands)
+	}
+
+	// C3 is taken now, so the engine's next answer is illegal and it resigns.
+	postMoveAs(mx, matchResponse.ID, "{\"player\": 1, \"position\": {\"x\": 5, \"y\": 5}}", matchResponse.SeatTokens.Black)
+	bots.wait()
+	moves, _ = repo.getMoves(matchResponse.ID)
+	if len(moves) != 4 || !moves[3].Resigned {
+		t.Fatalf("Expected the engine to resign after an illegal move, got %+v", moves)
+	}
+	if len(engine.processes) != 0 {
+		t.Error("Expected the engine process to be stopped once the match was over")
+	}
+}
+
+func TestDeletingAMatchStopsItsEngine(t *testing.T) {
+	os.Setenv(adminTokenEnv, "letmein")
+	defer os.Unsetenv(adminTokenEnv)
+	engine, _, cleanup := newFakeGTPEngine(t, "C3")
+	defer cleanup()
+	botPlayers["fake"] = engine
+	defer delete(botPlayers, "fake")
+
+	repo := newInMemoryRepository()
+	bots := newBotRunner(repo, newMatchHub())
+	mx := mux.NewRouter()
+	initRoutes(mx, formatter, repo, newMatchHub(), bots)
+	match := gogo.NewMatch(9, "alfred", "bot:fake")
+	repo.addMatch(match, matchSettings{})
+	postMove(mx, match.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}")
+	bots.wait()
+	if len(engine.processes) != 1 {
+		t.Fatalf("Expected the engine to be running for the match, got %d processes", len(engine.processes))
+	}
+
+	if recorder := deleteMatchAs(mx, match.ID, "letmein"); recorder.Code != http.StatusNoContent {
+		t.Fatalf("Expected the match to be deleted, got %d", recorder.Code)
+	}
+	if len(engine.processes) != 0 {
+		t.Error("Expected the engine process to be stopped when its match was deleted")
+	}
+}
@@ -2,15 +2,19 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/cloudnativego/gogo-engine"
 	"github.com/gorilla/mux"
 	"github.com/unrolled/render"
 )
 
-func createMatchHandler(formatter *render.Render, repo matchRepository) http.HandlerFunc {
+func createMatchHandler(formatter *render.Render, repo matchRepository, bots *botRunner) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 
 		payload, _ := ioutil.ReadAll(req.Body)
@@ -26,21 +30,155 @@ func createMatchHandler(formatter *render.Render, repo matchRepository) http.Han
 		}
 
 		newMatch := gogo.NewMatch(newMatchRequest.GridSize, newMatchRequest.PlayerBlack, newMatchRequest.PlayerWhite)
-		repo.addMatch(newMatch)
+		settings := newMatchRequest.settings()
+		for _, point := range handicapPoints(newMatch.GridSize, settings.Handicap) {
+			newMatch.GameBoard.Positions[point.X][point.Y] = gogo.PlayerBlack
+		}
+		tokens, err := newSeats()
+		if err != nil {
+			formatter.Text(w, http.StatusInternalServerError, "Failed to issue seat tokens")
+			return
+		}
+		settings.BlackSeatHash = hashSeatToken(tokens.Black)
+		settings.WhiteSeatHash = hashSeatToken(tokens.White)
+		if err = repo.addMatch(newMatch, settings); err != nil {
+			formatter.JSON(w, http.StatusInternalServerError, errorResponse{Message: err.Error()})
+			return
+		}
+		bots.respond(newMatch.ID, newMatch.PlayerBlack, newMatch.PlayerWhite)
 		var mr newMatchResponse
-		mr.copyMatch(newMatch)
+		mr.copyMatch(newMatch, settings, nil)
+		tokens = tokens.withoutBots(newMatch)
+		mr.SeatTokens = &tokens
 		w.Header().Add("Location", "/matches/"+newMatch.ID)
 		formatter.JSON(w, http.StatusCreated, &mr)
 	}
 }
 
+// importMatchHandler creates a match from an SGF game record. Every move of the main line is
+// replayed through the engine; the match is positioned at the end of the record, or after the
+// number of moves given by the move query parameter, keeping the history up to that point.
+func importMatchHandler(formatter *render.Render, repo matchRepository, bots *botRunner) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		payload, err := ioutil.ReadAll(io.LimitReader(req.Body, maxImportSize+1))
+		if err != nil || len(payload) > maxImportSize {
+			formatter.JSON(w, http.StatusBadRequest, errorResponse{Message: "SGF record could not be read"})
+			return
+		}
+		game, err := readSGFGame(payload)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, errorResponse{Message: err.Error()})
+			return
+		}
+		if !game.request.isValid() {
+			formatter.JSON(w, http.StatusBadRequest, errorResponse{Message: "SGF record describes a match this service cannot host"})
+			return
+		}
+		upTo := len(game.moves)
+		if v := req.URL.Query().Get("move"); v != "" {
+			upTo, err = strconv.Atoi(v)
+			if err != nil || upTo < 0 || upTo > len(game.moves) {
+				formatter.JSON(w, http.StatusBadRequest, errorResponse{Message: "Move must be between 0 and " + strconv.Itoa(len(game.moves))})
+				return
+			}
+		}
+		match, moves, err := game.replay(upTo)
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, errorResponse{Message: err.Error()})
+			return
+		}
+
+		settings := game.request.settings()
+		tokens, err := newSeats()
+		if err != nil {
+			formatter.Text(w, http.StatusInternalServerError, "Failed to issue seat tokens")
+			return
+		}
+		settings.BlackSeatHash = hashSeatToken(tokens.Black)
+		settings.WhiteSeatHash = hashSeatToken(tokens.White)
+		if err = repo.importMatch(match, settings, moves); err != nil {
+			formatter.JSON(w, http.StatusInternalServerError, errorResponse{Message: err.Error()})
+			return
+		}
+		bots.respond(match.ID, match.PlayerBlack, match.PlayerWhite)
+		var mr newMatchResponse
+		mr.copyMatch(match, settings, moves)
+		tokens = tokens.withoutBots(match)
+		mr.SeatTokens = &tokens
+		w.Header().Add("Location", "/matches/"+match.ID)
+		formatter.JSON(w, http.StatusCreated, &mr)
+	}
+}
+
+// deleteMatchHandler removes a match outright. Either player may abandon a match nobody has moved
+// in yet; once play has started only an administrator can delete it, and players resign instead.
+// Any engine process or queued bot turn the match has is let go of first.
+func deleteMatchHandler(formatter *render.Render, repo matchRepository, bots *botRunner) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		matchID := vars["id"]
+		state, err := repo.loadMatch(matchID)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, errorResponse{Message: err.Error()})
+			return
+		}
+		if !isAdmin(req) {
+			status, err := authorizeSeat(req, state.Settings, gogo.PlayerBlack)
+			if err != nil {
+				status, err = authorizeSeat(req, state.Settings, gogo.PlayerWhite)
+			}
+			if err != nil {
+				if status == http.StatusUnauthorized {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+				}
+				formatter.JSON(w, status, errorResponse{Message: err.Error()})
+				return
+			}
+			if len(state.Moves) > 0 {
+				formatter.JSON(w, http.StatusConflict, errorResponse{Message: "Match has already started; resign instead"})
+				return
+			}
+		}
+		if status, err := checkPrecondition(req, matchETag(matchID, state.Version, jsonVariant)); err != nil {
+			formatter.JSON(w, status, errorResponse{Message: err.Error()})
+			return
+		}
+		bots.release(state.Match)
+		if err := repo.deleteMatch(matchID); err != nil {
+			formatter.JSON(w, http.StatusInternalServerError, errorResponse{Message: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
 func getMatchListHandler(formatter *render.Render, repo matchRepository) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		repoMatches, err := repo.getMatches()
+		query, err := parseMatchQuery(req.URL.Query())
+		if err != nil {
+			formatter.JSON(w, http.StatusBadRequest, errorResponse{Message: err.Error()})
+			return
+		}
+		repoMatches, next, err := repo.findMatches(query)
+		if err == errInvalidCursor {
+			formatter.JSON(w, http.StatusBadRequest, errorResponse{Message: err.Error()})
+			return
+		}
 		if err == nil {
 			matches := make([]newMatchResponse, len(repoMatches))
-			for idx, match := range repoMatches {
-				matches[idx].copyMatch(match)
+			for idx, state := range repoMatches {
+				matches[idx].copyMatch(state.Match, state.Settings, state.Moves)
+			}
+			// A match deleted from the page leaves no later write behind, so only the entity tag
+			// can tell that the page changed.
+			etag := listETag(repoMatches)
+			setValidators(w, etag, time.Time{})
+			if next != "" {
+				w.Header().Set("Link", nextPageLink(req, next))
+			}
+			if notModified(req, etag, time.Time{}) {
+				w.WriteHeader(http.StatusNotModified)
+				return
 			}
 			formatter.JSON(w, http.StatusOK, matches)
 		} else {
@@ -53,42 +191,436 @@ func getMatchDetailsHandler(formatter *render.Render, repo matchRepository) http
 	return func(w http.ResponseWriter, req *http.Request) {
 		vars := mux.Vars(req)
 		matchID := vars["id"]
-		match, err := repo.getMatch(matchID)
+		w.Header().Set("Vary", "Accept")
+		if acceptsMediaType(req, sgfMediaType) {
+			serveMatchSGF(formatter, w, req, repo, matchID)
+			return
+		}
+		if wantsASCII(req) {
+			serveMatchASCII(formatter, w, req, repo, matchID)
+			return
+		}
+		state, err := repo.loadMatch(matchID)
 		if err != nil {
 			formatter.JSON(w, http.StatusNotFound, err.Error())
-		} else {
-			var mdr matchDetailsResponse
-			mdr.copyMatch(match)
-			formatter.JSON(w, http.StatusOK, &mdr)
+			return
+		}
+		etag, modified := matchETag(matchID, state.Version, jsonVariant), lastModified(state.UpdatedAt, time.Now())
+		setValidators(w, etag, modified)
+		if notModified(req, etag, modified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		var mdr matchDetailsResponse
+		mdr.copyMatch(state.Match, state.Settings, state.Moves, state.Undos)
+		if state.Undo != nil {
+			mdr.UndoRequest = &undoResponse{}
+			mdr.UndoRequest.copyUndo(*state.Undo, state.Moves, undoPending)
 		}
+		formatter.JSON(w, http.StatusOK, &mdr)
 	}
 }
 
-func addMoveHandler(formatter *render.Render, repo matchRepository) http.HandlerFunc {
+func getMatchSGFHandler(formatter *render.Render, repo matchRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		serveMatchSGF(formatter, w, req, repo, vars["id"])
+	}
+}
+
+// serveMatchSGF answers with the match's SGF game record, offered as a download named after the match.
+func serveMatchSGF(formatter *render.Render, w http.ResponseWriter, req *http.Request, repo matchRepository, matchID string) {
+	state, err := repo.loadMatch(matchID)
+	if err != nil {
+		formatter.JSON(w, http.StatusNotFound, err.Error())
+		return
+	}
+	version, match, settings, moves := state.Version, state.Match, state.Settings, state.Moves
+	etag, modified := matchETag(matchID, version, sgfVariant), lastModified(state.UpdatedAt, time.Now())
+	setValidators(w, etag, modified)
+	if notModified(req, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", sgfMediaType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+matchID+sgfExtension+"\"")
+	w.WriteHeader(http.StatusOK)
+	w.Write(renderSGF(match, settings, moves))
+}
+
+// getBoardImageHandler draws a match board as an SVG or PNG image. The size query parameter sets
+// the image width in pixels, and move shows the position after that many moves instead of the
+// current one.
+func getBoardImageHandler(formatter *render.Render, repo matchRepository, format string) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		vars := mux.Vars(req)
 		matchID := vars["id"]
-		match, err := repo.getMatch(matchID)
+		state, err := repo.loadMatch(matchID)
 		if err != nil {
 			formatter.JSON(w, http.StatusNotFound, err.Error())
-		} else {
-			payload, _ := ioutil.ReadAll(req.Body)
-			var moveRequest newMoveRequest
-			err := json.Unmarshal(payload, &moveRequest)
-			newBoard, err := match.GameBoard.PerformMove(gogo.Move{Player: moveRequest.Player, Position: gogo.Coordinate{X: moveRequest.Position.X, Y: moveRequest.Position.Y}})
-			if err != nil {
-				formatter.JSON(w, http.StatusBadRequest, err.Error())
-			} else {
-				match.GameBoard = newBoard
-				err = repo.updateMatch(matchID, match)
+			return
+		}
+		version, match, settings, moves := state.Version, state.Match, state.Settings, state.Moves
+
+		picture := boardPicture{Positions: match.GameBoard.Positions, Size: defaultImageSize}
+		if v := req.URL.Query().Get("size"); v != "" {
+			picture.Size, err = strconv.Atoi(v)
+			if err != nil || picture.Size < minImageSize || picture.Size > maxImageSize {
+				formatter.JSON(w, http.StatusBadRequest, errorResponse{Message: "Size must be between " + strconv.Itoa(minImageSize) + " and " + strconv.Itoa(maxImageSize)})
+				return
+			}
+		}
+		if v := req.URL.Query().Get("move"); v != "" {
+			upTo, err := strconv.Atoi(v)
+			if err != nil || upTo < 0 || upTo > len(moves) {
+				formatter.JSON(w, http.StatusBadRequest, errorResponse{Message: "Move must be between 0 and " + strconv.Itoa(len(moves))})
+				return
+			}
+			if upTo < len(moves) {
+				moves = moves[:upTo]
+				board, err := positionAt(match.GridSize, settings, moves)
 				if err != nil {
 					formatter.JSON(w, http.StatusInternalServerError, err.Error())
-				} else {
-					var mdr matchDetailsResponse
-					mdr.copyMatch(match)
-					formatter.JSON(w, http.StatusCreated, &mdr)
+					return
 				}
+				picture.Positions = board.Positions
+			}
+		}
+		if len(moves) > 0 {
+			picture.LastMove = moves[len(moves)-1].Position
+		}
+
+		etag, modified := matchETag(matchID, version, format), lastModified(state.UpdatedAt, time.Now())
+		setValidators(w, etag, modified)
+		if notModified(req, etag, modified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		var body []byte
+		if format == "png" {
+			w.Header().Set("Content-Type", pngMediaType)
+			body, err = renderBoardPNG(picture)
+		} else {
+			w.Header().Set("Content-Type", svgMediaType)
+			body = renderBoardSVG(picture)
+		}
+		if err != nil {
+			formatter.JSON(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	}
+}
+
+// serveMatchASCII answers with the match drawn as plain text, for terminals and logs.
+func serveMatchASCII(formatter *render.Render, w http.ResponseWriter, req *http.Request, repo matchRepository, matchID string) {
+	state, err := repo.loadMatch(matchID)
+	if err != nil {
+		formatter.JSON(w, http.StatusNotFound, err.Error())
+		return
+	}
+	version, match, settings, moves := state.Version, state.Match, state.Settings, state.Moves
+	etag, modified := matchETag(matchID, version, asciiFormat), lastModified(state.UpdatedAt, time.Now())
+	setValidators(w, etag, modified)
+	if notModified(req, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", textMediaType+"; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(renderASCII(match, settings, moves))
+}
+
+func getLibertiesHandler(formatter *render.Render, repo matchRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		matchID := vars["id"]
+		players := []byte{gogo.PlayerBlack, gogo.PlayerWhite}
+		if name := req.URL.Query().Get("player"); name != "" {
+			player, ok := parsePlayer(name)
+			if !ok {
+				formatter.JSON(w, http.StatusBadRequest, "Player must be black or white")
+				return
 			}
+			players = []byte{player}
 		}
+
+		match, err := repo.getMatch(matchID)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, err.Error())
+			return
+		}
+		libertyList := []libertyResponse{}
+		for _, player := range players {
+			for _, point := range liberties(match.GameBoard.Positions, player) {
+				libertyList = append(libertyList, libertyResponse{
+					Player:   playerName(player),
+					Position: boardPosition{X: point.X, Y: point.Y},
+				})
+			}
+		}
+		formatter.JSON(w, http.StatusOK, libertyList)
+	}
+}
+
+func getChainsHandler(formatter *render.Render, repo matchRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		matchID := vars["id"]
+		var filter byte
+		if name := req.URL.Query().Get("player"); name != "" {
+			player, ok := parsePlayer(name)
+			if !ok {
+				formatter.JSON(w, http.StatusBadRequest, "Player must be black or white")
+				return
+			}
+			filter = player
+		}
+
+		match, err := repo.getMatch(matchID)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, err.Error())
+			return
+		}
+		chainList := []chainResponse{}
+		for _, c := range chains(match.GameBoard.Positions) {
+			if filter != 0 && c.Player != filter {
+				continue
+			}
+			var cr chainResponse
+			cr.copyChain(c)
+			chainList = append(chainList, cr)
+		}
+		formatter.JSON(w, http.StatusOK, chainList)
+	}
+}
+
+func getMoveListHandler(formatter *render.Render, repo matchRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		matchID := vars["id"]
+		repoMoves, err := repo.getMoves(matchID)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, err.Error())
+		} else {
+			moves := make([]moveResponse, len(repoMoves))
+			for idx, move := range repoMoves {
+				moves[idx].copyMove(move)
+			}
+			formatter.JSON(w, http.StatusOK, moves)
+		}
+	}
+}
+
+func getScoreHandler(formatter *render.Render, repo matchRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		matchID := vars["id"]
+		state, err := repo.loadMatch(matchID)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if matchStatus(state.Moves) != matchStatusFinished {
+			formatter.JSON(w, http.StatusConflict, "Match has not finished yet")
+			return
+		}
+		var sr scoreResponse
+		sr.copyScore(scoreMatch(state.Match.GameBoard.Positions, state.Moves, state.Settings))
+		formatter.JSON(w, http.StatusOK, &sr)
+	}
+}
+
+func addMoveHandler(formatter *render.Render, repo matchRepository, hub *matchHub, bots *botRunner) http.HandlerFunc {
+	return moveHandler(formatter, repo, hub, bots, false)
+}
+
+func resignHandler(formatter *render.Render, repo matchRepository, hub *matchHub, bots *botRunner) http.HandlerFunc {
+	return moveHandler(formatter, repo, hub, bots, true)
+}
+
+func moveHandler(formatter *render.Render, repo matchRepository, hub *matchHub, bots *botRunner, resign bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		matchID := vars["id"]
+		payload, _ := ioutil.ReadAll(req.Body)
+		var moveRequest newMoveRequest
+		if json.Unmarshal(payload, &moveRequest) != nil {
+			formatter.JSON(w, http.StatusBadRequest, errorResponse{Message: "Failed to parse move request"})
+			return
+		}
+		check := func(settings matchSettings, version int) (int, error) {
+			if status, err := authorizeSeat(req, settings, moveRequest.Player); err != nil {
+				return status, err
+			}
+			return checkPrecondition(req, matchETag(matchID, version, jsonVariant))
+		}
+
+		// The move is played once: should it lose a race, the board the player saw is gone and they
+		// have to look at the new one before moving again.
+		mdr, version, status, err := playMove(repo, matchID, moveRequest, resign, check)
+		if err == errVersionConflict {
+			status, err = http.StatusPreconditionFailed, errStaleBoard
+		}
+		if err == errOutOfTime {
+			// The move came too late, but it ended the match, which watchers need to hear about.
+			publishMove(hub, bots, matchID, mdr)
+		}
+		if err != nil {
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			formatter.JSON(w, status, errorResponse{Message: err.Error()})
+			return
+		}
+		publishMove(hub, bots, matchID, mdr)
+		w.Header().Set("ETag", matchETag(matchID, version, jsonVariant))
+		formatter.JSON(w, http.StatusCreated, &mdr)
+	}
+}
+
+// publishMove tells the match's watchers and its bot about the match after a move, or after a move
+// that came too late and ended the match on time instead.
+func publishMove(hub *matchHub, bots *botRunner, matchID string, mdr matchDetailsResponse) {
+	hub.publish(matchID, mdr)
+	bots.respond(matchID, mdr.PlayerBlack, mdr.PlayerWhite)
+}
+
+// moveCheck vets a move on behalf of whoever submitted it, such as checking their seat, before the
+// match rules are applied. It sees the match settings and the version the move would be applied to.
+type moveCheck func(settings matchSettings, version int) (status int, err error)
+
+// submitMove plays a move, replaying it against the fresh board each time it loses a race with
+// another move, up to maxMoveAttempts times in all. It is how GTP sessions and bots move, as they
+// play whatever board they find; moves over HTTP name the board they were made on instead.
+func submitMove(repo matchRepository, matchID string, moveRequest newMoveRequest, resign bool, check moveCheck) (mdr matchDetailsResponse, version int, status int, err error) {
+	for attempt := 1; ; attempt++ {
+		mdr, version, status, err = playMove(repo, matchID, moveRequest, resign, check)
+		if err != errVersionConflict || attempt >= maxMoveAttempts {
+			return
+		}
+	}
+}
+
+// playMove validates and applies a single move against the match as it currently stands. A
+// concurrent move landing between the read and the write surfaces as errVersionConflict, in
+// which case nothing has been stored and the caller may try again against the fresh board.
+// A resignation is recorded as a move too, but may be made out of turn and ends the match.
+// If the player to move has already run out of time, the match is ended on time instead and
+// errOutOfTime returned along with its details.
+func playMove(repo matchRepository, matchID string, moveRequest newMoveRequest, resign bool, check moveCheck) (mdr matchDetailsResponse, version int, status int, err error) {
+	now := time.Now()
+	state, err := repo.loadMatch(matchID)
+	if err != nil {
+		return mdr, version, http.StatusNotFound, err
 	}
+	version, match, settings, moves, undos := state.Version, state.Match, state.Settings, state.Moves, state.Undos
+
+	err = moveRequest.validate(match.GridSize)
+	if err != nil {
+		return mdr, version, http.StatusBadRequest, err
+	}
+	if resign && !moveRequest.isPass() {
+		return mdr, version, http.StatusBadRequest, errors.New("A resignation cannot include a position")
+	}
+	if status, err = check(settings, version); err != nil {
+		return mdr, version, status, err
+	}
+	if matchStatus(moves) == matchStatusFinished {
+		return mdr, version, http.StatusConflict, errors.New("Match is already finished")
+	}
+	if player, expired := outOfTime(settings, match.StartTime, moves, undos, now); expired {
+		mdr, err = recordTimeout(repo, version, match, settings, moves, undos, player, now)
+		if err == errVersionConflict {
+			return mdr, version, http.StatusConflict, err
+		}
+		if err != nil {
+			return mdr, version, http.StatusInternalServerError, err
+		}
+		return mdr, version + 1, http.StatusConflict, errOutOfTime
+	}
+	if expected := nextPlayer(settings, moves); !resign && moveRequest.Player != expected {
+		return mdr, version, http.StatusConflict, errors.New("It is " + playerName(expected) + "'s turn to move")
+	}
+
+	move := matchMove{
+		Player:    moveRequest.Player,
+		Turn:      match.TurnCount + 1,
+		Resigned:  resign,
+		Timestamp: now,
+	}
+	if !moveRequest.isPass() {
+		position := gogo.Coordinate{X: moveRequest.Position.X, Y: moveRequest.Position.Y}
+		if err = placeStone(&match, &move, position); err != nil {
+			return mdr, version, http.StatusBadRequest, err
+		}
+	}
+
+	match.TurnCount = move.Turn
+	moves = append(moves, move)
+	err = repo.updateMatch(matchID, version, matchUpdate{
+		Match:    match,
+		Status:   matchStatus(moves),
+		Moves:    []matchMove{move},
+		Deadline: clockDeadline(settings, match.StartTime, moves, undos),
+	})
+	if err == errVersionConflict {
+		return mdr, version, http.StatusConflict, err
+	}
+	if err != nil {
+		return mdr, version, http.StatusInternalServerError, err
+	}
+	mdr.copyMatch(match, settings, moves, undos)
+	mdr.version = version + 1
+	return mdr, version + 1, http.StatusCreated, nil
+}
+
+// rewindMoves takes a match back to the position after its first keep moves, rebuilding the board
+// by replaying them so the engine's history matches the shortened record, and restarts the clock
+// of the player to move. The caller passes the state it read at version; if the match has moved
+// on since, errVersionConflict is returned.
+func rewindMoves(repo matchRepository, version int, match gogo.Match, settings matchSettings, moves []matchMove, undos []matchUndo, keep int) (mdr matchDetailsResponse, err error) {
+	now := time.Now()
+	moves = moves[:keep]
+	undos = append(append([]matchUndo(nil), undos...), matchUndo{Version: version + 1, Keep: keep, At: now})
+	match.GameBoard, err = positionAt(match.GridSize, settings, moves)
+	if err != nil {
+		return
+	}
+	match.TurnCount = keep
+	err = repo.rewindMatch(match.ID, version, matchRewind{
+		Keep:     keep,
+		At:       now,
+		Match:    match,
+		Status:   matchStatus(moves),
+		Deadline: clockDeadline(settings, match.StartTime, moves, undos),
+	})
+	if err == nil {
+		mdr.copyMatch(match, settings, moves, undos)
+		mdr.version = version + 1
+	}
+	return
+}
+
+// placeStone plays move's stone at position through the engine, updating the match board and
+// recording the position and the number of opposing stones captured on the move.
+func placeStone(match *gogo.Match, move *matchMove, position gogo.Coordinate) error {
+	opponentStones := countStones(match.GameBoard.Positions, opponent(move.Player))
+	newBoard, err := match.GameBoard.PerformMove(gogo.Move{Player: move.Player, Position: position})
+	if err != nil {
+		return err
+	}
+	match.GameBoard = newBoard
+	move.Position = &position
+	move.Captures = opponentStones - countStones(newBoard.Positions, opponent(move.Player))
+	return nil
+}
+
+// nextPageLink builds a Link header pointing at the page after the current one, keeping every
+// other query parameter as the client sent it.
+func nextPageLink(req *http.Request, cursor string) string {
+	values := req.URL.Query()
+	values.Set("cursor", cursor)
+	return "<" + req.URL.Path + "?" + values.Encode() + ">; rel=\"next\""
 }
@@ -3,11 +3,16 @@ package service
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/cloudnativego/gogo-engine"
 	"github.com/codegangsta/negroni"
@@ -28,7 +33,7 @@ var (
 func CreateMatchRespondsToBadData(t *testing.T) {
 	client := &http.Client{}
 	repo := newInMemoryRepository()
-	server := httptest.NewServer(http.HandlerFunc(createMatchHandler(formatter, repo)))
+	server := httptest.NewServer(http.HandlerFunc(createMatchHandler(formatter, repo, newBotRunner(repo, newMatchHub()))))
 	defer server.Close()
 
 	body1 := []byte("this is not valid json")
@@ -65,7 +70,7 @@ func CreateMatchRespondsToBadData(t *testing.T) {
 func TestCreateMatch(t *testing.T) {
 	client := &http.Client{}
 	repo := newInMemoryRepository()
-	server := httptest.NewServer(http.HandlerFunc(createMatchHandler(formatter, repo)))
+	server := httptest.NewServer(http.HandlerFunc(createMatchHandler(formatter, repo, newBotRunner(repo, newMatchHub()))))
 	defer server.Close()
 
 	body := []byte("{\n  \"gridsize\": 19,\n  \"playerWhite\": \"bob\",\n  \"playerBlack\": \"alfred\"\n}")
@@ -116,16 +121,16 @@ func TestCreateMatch(t *testing.T) {
 	}
 
 	// After creating a match, match repository should have 1 item in it.
-	matches, err := repo.getMatches()
+	matches, _, err := repo.findMatches(matchQuery{Limit: defaultPageSize})
 	if err != nil {
-		t.Errorf("Unexpected error in getMatches(): %s", err)
+		t.Errorf("Unexpected error in findMatches(): %s", err)
 	}
 	if len(matches) != 1 {
 		t.Errorf("Expected a match repo of 1 match, got size %d", len(matches))
 	}
 
 	var match gogo.Match
-	match = matches[0]
+	match = matches[0].Match
 	if match.GridSize != matchResponse.GridSize {
 		t.Errorf("Expected repo match and HTTP response gridsize to match. Got %d and %d", match.GridSize, matchResponse.GridSize)
 	}
@@ -143,6 +148,39 @@ func TestCreateMatch(t *testing.T) {
 	}
 }
 
+// unavailableRepository fails to store new matches, as a repository that has lost its database
+// connection would. It notes any match handlers try to delete afterwards.
+type unavailableRepository struct {
+	*inMemoryMatchRepository
+	deleted []string
+}
+
+func (repo *unavailableRepository) deleteMatch(id string) error {
+	repo.deleted = append(repo.deleted, id)
+	return repo.inMemoryMatchRepository.deleteMatch(id)
+}
+
+func (repo *unavailableRepository) addMatch(match gogo.Match, settings matchSettings) error {
+	return errors.New("no reachable servers")
+}
+
+func (repo *unavailableRepository) importMatch(match gogo.Match, settings matchSettings, moves []matchMove) error {
+	return errors.New("no reachable servers")
+}
+
+func TestCreateMatchFailsWhenTheMatchCannotBeStored(t *testing.T) {
+	server := MakeTestServer(&unavailableRepository{inMemoryMatchRepository: newInMemoryRepository()})
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches", strings.NewReader("{\"gridsize\": 19, \"playerWhite\": \"bob\", \"playerBlack\": \"alfred\"}"))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected a match that cannot be stored to return 500, got %d", recorder.Code)
+	}
+	if recorder.Header().Get("Location") != "" {
+		t.Error("Expected no Location header for a match that was not stored")
+	}
+}
+
 func TestGetMatchListReturnsEmptyArrayForNoMatches(t *testing.T) {
 	client := &http.Client{}
 	repo := newInMemoryRepository()
@@ -177,9 +215,9 @@ func TestGetMatchListReturnsEmptyArrayForNoMatches(t *testing.T) {
 func TestGetMatchListReturnsWhatsInRepository(t *testing.T) {
 	client := &http.Client{}
 	repo := newInMemoryRepository()
-	repo.addMatch(gogo.NewMatch(19, "black", "white"))
-	repo.addMatch(gogo.NewMatch(13, "bl", "wh"))
-	repo.addMatch(gogo.NewMatch(19, "b", "w"))
+	repo.addMatch(gogo.NewMatch(19, "black", "white"), matchSettings{})
+	repo.addMatch(gogo.NewMatch(13, "bl", "wh"), matchSettings{})
+	repo.addMatch(gogo.NewMatch(19, "b", "w"), matchSettings{})
 	server := httptest.NewServer(http.HandlerFunc(getMatchListHandler(formatter, repo)))
 	defer server.Close()
 	req, _ := http.NewRequest("GET", server.URL, nil)
@@ -203,23 +241,23 @@ func TestGetMatchListReturnsWhatsInRepository(t *testing.T) {
 		t.Errorf("Could not unmarshal payload into []newMatchResponse slice")
 	}
 
-	repoMatches, err := repo.getMatches()
+	repoMatches, _, err := repo.findMatches(matchQuery{Limit: defaultPageSize})
 	if err != nil {
-		t.Errorf("Unexpected error in getMatches(): %s", err)
+		t.Errorf("Unexpected error in findMatches(): %s", err)
 	}
 	if len(matchList) != len(repoMatches) {
 		t.Errorf("Match response size should have equaled repo size, sizes were: %d and %d", len(matchList), len(repoMatches))
 	}
 
 	for idx := 0; idx < 3; idx++ {
-		if matchList[idx].GridSize != repoMatches[idx].GridSize {
-			t.Errorf("Gridsize mismatch at index %d. Got %d and %d", idx, matchList[idx].GridSize, repoMatches[idx].GridSize)
+		if matchList[idx].GridSize != repoMatches[idx].Match.GridSize {
+			t.Errorf("Gridsize mismatch at index %d. Got %d and %d", idx, matchList[idx].GridSize, repoMatches[idx].Match.GridSize)
 		}
 		if matchList[idx].PlayerBlack != matchList[idx].PlayerBlack {
-			t.Errorf("PlayerBlack mismatch at index %d. Got %s and %s", idx, matchList[idx].PlayerBlack, repoMatches[idx].PlayerBlack)
+			t.Errorf("PlayerBlack mismatch at index %d. Got %s and %s", idx, matchList[idx].PlayerBlack, repoMatches[idx].Match.PlayerBlack)
 		}
 		if matchList[idx].PlayerWhite != matchList[idx].PlayerWhite {
-			t.Errorf("PlayerWhite mismatch at index %d. Got %s and %s", idx, matchList[idx].PlayerWhite, repoMatches[idx].PlayerWhite)
+			t.Errorf("PlayerWhite mismatch at index %d. Got %s and %s", idx, matchList[idx].PlayerWhite, repoMatches[idx].Match.PlayerWhite)
 		}
 	}
 }
@@ -251,7 +289,7 @@ func TestGetMatchDetailsReturnsExistingMatch(t *testing.T) {
 	server := MakeTestServer(repo)
 
 	targetMatch := gogo.NewMatch(19, "black", "white")
-	repo.addMatch(targetMatch)
+	repo.addMatch(targetMatch, matchSettings{})
 	targetMatchID := targetMatch.ID
 
 	recorder = httptest.NewRecorder()
@@ -301,12 +339,13 @@ func TestAddMoveIsReflectedInGameBoard(t *testing.T) {
 	repo := newInMemoryRepository()
 	server := MakeTestServer(repo)
 	targetMatch := gogo.NewMatch(19, "black", "white")
-	repo.addMatch(targetMatch)
+	repo.addMatch(targetMatch, matchSettings{})
 	targetMatchID := targetMatch.ID
 	recorder = httptest.NewRecorder()
-	body := []byte("{\n  \"player\": 2,\n  \"position\": {\n    \"x\": 3,\n    \"y\": 10\n  }\n}")
+	body := []byte("{\n  \"player\": 1,\n  \"position\": {\n    \"x\": 3,\n    \"y\": 10\n  }\n}")
 	reader := bytes.NewReader(body)
 	request, _ = http.NewRequest("POST", "/matches/"+targetMatchID+"/moves", reader)
+	request.Header.Set("If-Match", currentETag(server, targetMatchID))
 	server.ServeHTTP(recorder, request)
 
 	if recorder.Code != http.StatusCreated {
@@ -331,14 +370,15 @@ func TestAddMoveIsReflectedInGameBoard(t *testing.T) {
 		t.Errorf("Game board size isn't 19, got %d", len(matchDetails.GameBoard[0]))
 	}
 
-	if matchDetails.GameBoard[3][10] != gogo.PlayerWhite {
+	if matchDetails.GameBoard[3][10] != gogo.PlayerBlack {
 		t.Errorf("Game board did not reflect added move to 3,10. Board: %v", matchDetails.GameBoard)
 	}
 
 	recorder3 := httptest.NewRecorder()
-	body2 := []byte("{\n  \"player\": 1,\n  \"position\": {\n    \"x\": 8,\n    \"y\": 8\n  }\n}")
+	body2 := []byte("{\n  \"player\": 2,\n  \"position\": {\n    \"x\": 8,\n    \"y\": 8\n  }\n}")
 	reader2 := bytes.NewReader(body2)
 	request3, _ := http.NewRequest("POST", "/matches/"+targetMatchID+"/moves", reader2)
+	request3.Header.Set("If-Match", recorder2.Header().Get("ETag"))
 	server.ServeHTTP(recorder3, request3)
 	if recorder3.Code != http.StatusCreated {
 		t.Errorf("Expected 201(Created) for 2nd move, got %d", recorder3.Code)
@@ -350,15 +390,1181 @@ func TestAddMoveIsReflectedInGameBoard(t *testing.T) {
 	if err != nil {
 		t.Errorf("Could not unmarshal response for 2nd move add, %s", err.Error())
 	}
-	if matchDetails2.GameBoard[8][8] != gogo.PlayerBlack {
-		t.Errorf("Added move should belong to black at 8,8 - belongs to %d", matchDetails2.GameBoard[8][8])
+	if matchDetails2.GameBoard[8][8] != gogo.PlayerWhite {
+		t.Errorf("Added move should belong to white at 8,8 - belongs to %d", matchDetails2.GameBoard[8][8])
+	}
+}
+
+func TestGetMoveListReturnsMovesInOrder(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(19, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+	targetMatchID := targetMatch.ID
+
+	for _, body := range []string{
+		"{\n  \"player\": 1,\n  \"position\": {\n    \"x\": 4,\n    \"y\": 10\n  }\n}",
+		"{\n  \"player\": 2,\n  \"position\": {\n    \"x\": 3,\n    \"y\": 5\n  }\n}",
+	} {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/matches/"+targetMatchID+"/moves", strings.NewReader(body))
+		request.Header.Set("If-Match", currentETag(server, targetMatchID))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusCreated {
+			t.Errorf("Expected creation of new move to return 201, got %d", recorder.Code)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/matches/"+targetMatchID+"/moves", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+
+	var moves []moveResponse
+	err := json.Unmarshal(recorder.Body.Bytes(), &moves)
+	if err != nil {
+		t.Errorf("Could not unmarshal payload into []moveResponse slice")
+	}
+	if len(moves) != 2 {
+		t.Fatalf("Expected 2 moves, got %d", len(moves))
+	}
+	if moves[0].Player != "black" || moves[0].Position.X != 4 || moves[0].Position.Y != 10 || moves[0].Turn != 1 {
+		t.Errorf("Unexpected first move: %+v", moves[0])
+	}
+	if moves[1].Player != "white" || moves[1].Position.X != 3 || moves[1].Position.Y != 5 || moves[1].Turn != 2 {
+		t.Errorf("Unexpected second move: %+v", moves[1])
+	}
+}
+
+func TestGetMoveListReturns404ForNonexistentMatch(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/matches/1234/moves", nil)
+	server.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected %v; received %v", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestPassDoesNotPlaceStone(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+
+	recorder := postMove(server, targetMatch.ID, "{\"player\": 1}")
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected a pass to return 201, got %d", recorder.Code)
+	}
+
+	var matchDetails matchDetailsResponse
+	err := json.Unmarshal(recorder.Body.Bytes(), &matchDetails)
+	if err != nil {
+		t.Errorf("Could not unmarshal payload into match details response.")
+	}
+	if matchDetails.GameBoard[0][0] != 0 {
+		t.Errorf("A pass should not place a stone at 0,0. Board: %v", matchDetails.GameBoard)
+	}
+	if matchDetails.Status != matchStatusActive {
+		t.Errorf("Expected match to remain active after a single pass, got %s", matchDetails.Status)
+	}
+
+	moves, _ := repo.getMoves(targetMatch.ID)
+	if len(moves) != 1 || moves[0].Position != nil {
+		t.Errorf("Expected a single pass in the move history, got %+v", moves)
+	}
+}
+
+func TestTwoConsecutivePassesFinishMatch(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+
+	postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 2, \"y\": 2}}")
+	postMove(server, targetMatch.ID, "{\"player\": 2}")
+	recorder := postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": null}")
+
+	var matchDetails matchDetailsResponse
+	json.Unmarshal(recorder.Body.Bytes(), &matchDetails)
+	if matchDetails.Status != matchStatusFinished {
+		t.Errorf("Expected match to be finished after two passes, got %s", matchDetails.Status)
+	}
+
+	recorder = postMove(server, targetMatch.ID, "{\"player\": 2, \"position\": {\"x\": 4, \"y\": 4}}")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected a move on a finished match to return 409, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/matches/"+targetMatch.ID, nil)
+	server.ServeHTTP(recorder, request)
+	json.Unmarshal(recorder.Body.Bytes(), &matchDetails)
+	if matchDetails.Status != matchStatusFinished {
+		t.Errorf("Expected match details to report finished, got %s", matchDetails.Status)
+	}
+}
+
+func TestPlayBetweenPassesKeepsMatchActive(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+
+	postMove(server, targetMatch.ID, "{\"player\": 1}")
+	postMove(server, targetMatch.ID, "{\"player\": 2, \"position\": {\"x\": 4, \"y\": 4}}")
+	recorder := postMove(server, targetMatch.ID, "{\"player\": 1}")
+
+	var matchDetails matchDetailsResponse
+	json.Unmarshal(recorder.Body.Bytes(), &matchDetails)
+	if matchDetails.Status != matchStatusActive {
+		t.Errorf("Expected non-consecutive passes to leave the match active, got %s", matchDetails.Status)
+	}
+}
+
+func TestGetLibertiesFiltersByPlayer(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+	postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 0, \"y\": 0}}")
+	postMove(server, targetMatch.ID, "{\"player\": 2, \"position\": {\"x\": 4, \"y\": 4}}")
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/matches/"+targetMatch.ID+"/liberties", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	var all []libertyResponse
+	err := json.Unmarshal(recorder.Body.Bytes(), &all)
+	if err != nil {
+		t.Errorf("Could not unmarshal payload into []libertyResponse slice")
+	}
+	if len(all) != 6 {
+		t.Errorf("Expected 6 liberties across both players, got %d", len(all))
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/matches/"+targetMatch.ID+"/liberties?player=white", nil)
+	server.ServeHTTP(recorder, request)
+	var white []libertyResponse
+	json.Unmarshal(recorder.Body.Bytes(), &white)
+	if len(white) != 4 {
+		t.Errorf("Expected 4 liberties for white, got %d", len(white))
+	}
+	for _, liberty := range white {
+		if liberty.Player != "white" {
+			t.Errorf("Filtered liberties should only belong to white, got %s", liberty.Player)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/matches/"+targetMatch.ID+"/liberties?player=purple", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown player filter to return 400, got %d", recorder.Code)
+	}
+}
+
+func TestGetChainsReportsLibertyCounts(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+	postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 0, \"y\": 0}}")
+	postMove(server, targetMatch.ID, "{\"player\": 2, \"position\": {\"x\": 1, \"y\": 0}}")
+	postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 0, \"y\": 1}}")
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/matches/"+targetMatch.ID+"/chains", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	var chainList []chainResponse
+	err := json.Unmarshal(recorder.Body.Bytes(), &chainList)
+	if err != nil {
+		t.Errorf("Could not unmarshal payload into []chainResponse slice")
+	}
+	if len(chainList) != 2 {
+		t.Fatalf("Expected 2 chains, got %d", len(chainList))
+	}
+	if chainList[0].Player != "black" || len(chainList[0].Positions) != 2 || chainList[0].Liberties != 2 {
+		t.Errorf("Unexpected black chain: %+v", chainList[0])
+	}
+	if chainList[1].Player != "white" || len(chainList[1].Positions) != 1 || chainList[1].Liberties != 2 {
+		t.Errorf("Unexpected white chain: %+v", chainList[1])
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/matches/"+targetMatch.ID+"/chains?player=white", nil)
+	server.ServeHTTP(recorder, request)
+	var whiteChains []chainResponse
+	json.Unmarshal(recorder.Body.Bytes(), &whiteChains)
+	if len(whiteChains) != 1 || whiteChains[0].Player != "white" {
+		t.Errorf("Expected only white's chain, got %+v", whiteChains)
+	}
+}
+
+func TestCreateMatchDefaultsKomi(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches", strings.NewReader("{\"gridsize\": 9, \"playerWhite\": \"bob\", \"playerBlack\": \"alfred\"}"))
+	server.ServeHTTP(recorder, request)
+	var matchResponse newMatchResponse
+	json.Unmarshal(recorder.Body.Bytes(), &matchResponse)
+	if matchResponse.Komi != defaultKomi {
+		t.Errorf("Expected komi to default to %v, got %v", defaultKomi, matchResponse.Komi)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "/matches", strings.NewReader("{\"gridsize\": 9, \"playerWhite\": \"bob\", \"playerBlack\": \"alfred\", \"komi\": 0.5}"))
+	server.ServeHTTP(recorder, request)
+	json.Unmarshal(recorder.Body.Bytes(), &matchResponse)
+	if matchResponse.Komi != 0.5 {
+		t.Errorf("Expected requested komi of 0.5, got %v", matchResponse.Komi)
+	}
+	state, _ := repo.loadMatch(matchResponse.ID)
+	settings := state.Settings
+	if settings.Komi != 0.5 {
+		t.Errorf("Expected repository to store komi of 0.5, got %v", settings.Komi)
+	}
+}
+
+func TestScoreIsAvailableOnceMatchFinishes(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{Komi: 6.5})
+
+	postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}")
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/matches/"+targetMatch.ID+"/score", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected score of an active match to return 409, got %d", recorder.Code)
+	}
+
+	postMove(server, targetMatch.ID, "{\"player\": 2}")
+	postMove(server, targetMatch.ID, "{\"player\": 1}")
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/matches/"+targetMatch.ID+"/score", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected %v; received %v", http.StatusOK, recorder.Code)
+	}
+	var score scoreResponse
+	err := json.Unmarshal(recorder.Body.Bytes(), &score)
+	if err != nil {
+		t.Errorf("Could not unmarshal payload into scoreResponse")
+	}
+	// A lone black stone owns the rest of the board.
+	if score.Area.Black != 81 || score.Area.White != 6.5 || score.Area.Winner != "black" {
+		t.Errorf("Unexpected area score: %+v", score.Area)
+	}
+	if score.Territory.Black != 80 || score.Territory.Margin != 73.5 {
+		t.Errorf("Unexpected territory score: %+v", score.Territory)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/matches/"+targetMatch.ID, nil)
+	server.ServeHTTP(recorder, request)
+	var matchDetails matchDetailsResponse
+	json.Unmarshal(recorder.Body.Bytes(), &matchDetails)
+	if matchDetails.Score == nil || matchDetails.Score.Area.Winner != "black" {
+		t.Errorf("Expected finished match details to include the score, got %+v", matchDetails.Score)
+	}
+}
+
+func TestCreateHandicapMatchPlacesStones(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches", strings.NewReader("{\"gridsize\": 19, \"playerWhite\": \"bob\", \"playerBlack\": \"alfred\", \"handicap\": 4}"))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected response status 201, received %d", recorder.Code)
+	}
+	var matchResponse newMatchResponse
+	json.Unmarshal(recorder.Body.Bytes(), &matchResponse)
+	if matchResponse.Handicap != 4 || matchResponse.NextPlayer != "white" || matchResponse.Komi != defaultHandicapKomi {
+		t.Errorf("Expected a 4 stone handicap match with white to play and %v komi, got %+v", defaultHandicapKomi, matchResponse)
+	}
+
+	match, _ := repo.getMatch(matchResponse.ID)
+	for _, point := range [][2]int{{3, 3}, {15, 15}, {3, 15}, {15, 3}} {
+		if match.GameBoard.Positions[point[0]][point[1]] != gogo.PlayerBlack {
+			t.Errorf("Expected a black handicap stone at %v", point)
+		}
+	}
+	state, _ := repo.loadMatch(matchResponse.ID)
+	settings := state.Settings
+	if settings.Handicap != 4 {
+		t.Errorf("Expected repository to record a handicap of 4, got %d", settings.Handicap)
+	}
+
+	for _, handicap := range []string{"1", "10"} {
+		recorder = httptest.NewRecorder()
+		request, _ = http.NewRequest("POST", "/matches", strings.NewReader("{\"gridsize\": 19, \"playerWhite\": \"bob\", \"playerBlack\": \"alfred\", \"handicap\": "+handicap+"}"))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("Expected a handicap of %s to be rejected, got %d", handicap, recorder.Code)
+		}
+	}
+}
+
+func TestMovesMustAlternate(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+
+	recorder := postMove(server, targetMatch.ID, "{\"player\": 2, \"position\": {\"x\": 4, \"y\": 4}}")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected white opening the game to return 409, got %d", recorder.Code)
+	}
+	var reply errorResponse
+	err := json.Unmarshal(recorder.Body.Bytes(), &reply)
+	if err != nil || reply.Message == "" {
+		t.Errorf("Expected a structured error message, got %s", recorder.Body.String())
+	}
+
+	recorder = postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}")
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected black's opening move to return 201, got %d", recorder.Code)
+	}
+	recorder = postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 5, \"y\": 5}}")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected black moving twice in a row to return 409, got %d", recorder.Code)
+	}
+	recorder = postMove(server, targetMatch.ID, "{\"player\": 1}")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected black passing out of turn to return 409, got %d", recorder.Code)
+	}
+}
+
+func TestHandicapMatchStartsWithWhite(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{Handicap: 2})
+
+	recorder := postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected black to wait for white in a handicap match, got %d", recorder.Code)
+	}
+	recorder = postMove(server, targetMatch.ID, "{\"player\": 2, \"position\": {\"x\": 4, \"y\": 4}}")
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected white's opening move to return 201, got %d", recorder.Code)
+	}
+}
+
+func TestMalformedMovesAreRejected(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+
+	for _, body := range []string{
+		"this is not valid json",
+		"{\"player\": \"black\", \"position\": {\"x\": 1, \"y\": 1}}",
+		"{\"player\": 3, \"position\": {\"x\": 1, \"y\": 1}}",
+		"{\"position\": {\"x\": 1, \"y\": 1}}",
+		"{\"player\": 1, \"position\": {\"x\": 9, \"y\": 1}}",
+		"{\"player\": 1, \"position\": {\"x\": 1, \"y\": -1}}",
+	} {
+		recorder := postMove(server, targetMatch.ID, body)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected with 400, got %d", body, recorder.Code)
+		}
+	}
+
+	moves, _ := repo.getMoves(targetMatch.ID)
+	if len(moves) != 0 {
+		t.Errorf("Rejected moves should not be recorded, got %d moves", len(moves))
+	}
+}
+
+func TestMovesRequireTheMovingPlayersSeatToken(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches", strings.NewReader("{\"gridsize\": 9, \"playerWhite\": \"bob\", \"playerBlack\": \"alfred\"}"))
+	server.ServeHTTP(recorder, request)
+	var matchResponse newMatchResponse
+	json.Unmarshal(recorder.Body.Bytes(), &matchResponse)
+	if matchResponse.SeatTokens == nil || matchResponse.SeatTokens.Black == "" || matchResponse.SeatTokens.Black == matchResponse.SeatTokens.White {
+		t.Fatalf("Expected distinct seat tokens for each player, got %+v", matchResponse.SeatTokens)
+	}
+	state, _ := repo.loadMatch(matchResponse.ID)
+	settings := state.Settings
+	if settings.BlackSeatHash != hashSeatToken(matchResponse.SeatTokens.Black) {
+		t.Error("Expected the repository to store black's seat token hashed")
+	}
+
+	body := "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}"
+	recorder = postMove(server, matchResponse.ID, body)
+	if recorder.Code != http.StatusUnauthorized || recorder.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected a move without a seat token to return 401, got %d", recorder.Code)
+	}
+
+	recorder = postMoveAs(server, matchResponse.ID, body, matchResponse.SeatTokens.White)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected black's move with white's token to return 403, got %d", recorder.Code)
+	}
+
+	recorder = postMoveAs(server, matchResponse.ID, body, matchResponse.SeatTokens.Black)
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected black's move with black's token to return 201, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/matches/"+matchResponse.ID, nil)
+	server.ServeHTTP(recorder, request)
+	if strings.Contains(recorder.Body.String(), matchResponse.SeatTokens.Black) {
+		t.Error("Seat tokens should only be returned when the match is created")
+	}
+}
+
+func TestMatchETagsFollowOneScheme(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+
+	if etag := currentETag(server, targetMatch.ID); etag != matchETag(targetMatch.ID, 1, jsonVariant) {
+		t.Errorf("Expected a new match to be tagged as version 1, got %s", etag)
+	}
+	recorder := postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}")
+	if etag := recorder.Header().Get("ETag"); etag != matchETag(targetMatch.ID, 2, jsonVariant) || etag != currentETag(server, targetMatch.ID) {
+		t.Errorf("Expected the move response to carry the ETag of version 2, got %s", etag)
+	}
+	state, _ := repo.loadMatch(targetMatch.ID)
+	if etag := getWithHeader(server, "/matches", "", "").Header().Get("ETag"); etag != listETag([]matchState{state}) {
+		t.Errorf("Expected the match list to be tagged by the versions of its matches, got %s", etag)
+	}
+}
+
+func TestChangesWithoutIfMatchAreRejected(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches/"+targetMatch.ID+"/moves", strings.NewReader("{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}"))
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusPreconditionRequired {
+		t.Errorf("Expected a move without If-Match to return 428, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("DELETE", "/matches/"+targetMatch.ID, nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusPreconditionRequired {
+		t.Errorf("Expected a delete without If-Match to return 428, got %d", recorder.Code)
+	}
+	if _, err := repo.getMatch(targetMatch.ID); err != nil {
+		t.Errorf("Expected the match to survive a delete without If-Match, got %v", err)
+	}
+}
+
+func TestContestedMovesAreNotLost(t *testing.T) {
+	const contenders = 16
+
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(19, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+
+	codes := make(chan int, contenders)
+	var wg sync.WaitGroup
+	for i := 0; i < contenders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes <- postMove(server, targetMatch.ID, fmt.Sprintf("{\"player\": 1, \"position\": {\"x\": %d, \"y\": 0}}", i)).Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		if code == http.StatusCreated {
+			created++
+		} else if code != http.StatusConflict {
+			t.Errorf("Expected a contested move to return 201 or 409, got %d", code)
+		}
+	}
+	match, _ := repo.getMatch(targetMatch.ID)
+	moves, _ := repo.getMoves(targetMatch.ID)
+	if created != 1 || len(moves) != 1 || countStones(match.GameBoard.Positions, gogo.PlayerBlack) != 1 {
+		t.Errorf("Expected exactly one of black's racing moves to land, got %d created, %d moves, %d stones",
+			created, len(moves), countStones(match.GameBoard.Positions, gogo.PlayerBlack))
+	}
+}
+
+// racingRepository simulates another request sneaking in a write before each of the first
+// `races` updates it sees.
+type racingRepository struct {
+	*inMemoryMatchRepository
+	races int
+}
+
+func (repo *racingRepository) updateMatch(id string, version int, update matchUpdate) error {
+	if repo.races > 0 {
+		repo.races--
+		current, _ := repo.inMemoryMatchRepository.getMatch(id)
+		repo.inMemoryMatchRepository.updateMatch(id, version, matchUpdate{Match: current, Status: matchStatusActive})
+	}
+	return repo.inMemoryMatchRepository.updateMatch(id, version, update)
+}
+
+func TestMoveIsRetriedAfterVersionConflict(t *testing.T) {
+	repo := &racingRepository{inMemoryMatchRepository: newInMemoryRepository(), races: 1}
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+	anyVersion := func(matchSettings, int) (int, error) { return http.StatusOK, nil }
+
+	_, _, _, err := submitMove(repo, targetMatch.ID, newMoveRequest{Player: gogo.PlayerBlack, Position: &boardPosition{X: 4, Y: 4}}, false, anyVersion)
+	if err != nil {
+		t.Errorf("Expected a move that lost one race to be retried and land, got %v", err)
+	}
+
+	repo.races = maxMoveAttempts
+	_, _, status, err := submitMove(repo, targetMatch.ID, newMoveRequest{Player: gogo.PlayerWhite, Position: &boardPosition{X: 5, Y: 5}}, false, anyVersion)
+	if err != errVersionConflict || status != http.StatusConflict {
+		t.Errorf("Expected a move that keeps losing races to fail with 409, got %d %v", status, err)
+	}
+	moves, _ := repo.getMoves(targetMatch.ID)
+	if len(moves) != 1 {
+		t.Errorf("Expected only the retried move to be recorded, got %d moves", len(moves))
+	}
+
+	// A client names the board it saw, which the race has replaced, so its move is not replayed.
+	repo.races = 1
+	recorder := postMove(MakeTestServer(repo), targetMatch.ID, "{\"player\": 2, \"position\": {\"x\": 5, \"y\": 5}}")
+	if recorder.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected a client's move that lost a race to return 412, got %d", recorder.Code)
+	}
+}
+
+func TestConditionalGetOfMatchDetails(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+
+	backdate(repo, targetMatch.ID)
+	first := getWithHeader(server, "/matches/"+targetMatch.ID, "", "")
+	etag := first.Header().Get("ETag")
+	if etag == "" || first.Header().Get("Last-Modified") == "" {
+		t.Fatalf("Expected match details to carry ETag and Last-Modified, got %v", first.Header())
+	}
+
+	recorder := getWithHeader(server, "/matches/"+targetMatch.ID, "If-None-Match", etag)
+	if recorder.Code != http.StatusNotModified || recorder.Body.Len() != 0 {
+		t.Errorf("Expected an unchanged match to return an empty 304, got %d", recorder.Code)
+	}
+	recorder = getWithHeader(server, "/matches/"+targetMatch.ID, "If-Modified-Since", first.Header().Get("Last-Modified"))
+	if recorder.Code != http.StatusNotModified {
+		t.Errorf("Expected If-Modified-Since on an unchanged match to return 304, got %d", recorder.Code)
+	}
+
+	postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}")
+	recorder = getWithHeader(server, "/matches/"+targetMatch.ID, "If-None-Match", etag)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("ETag") == etag {
+		t.Errorf("Expected a changed match to return 200 with a new ETag, got %d", recorder.Code)
+	}
+}
+
+func TestIfModifiedSinceSeesEveryChange(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+	postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}")
+	postMove(server, targetMatch.ID, "{\"player\": 2, \"position\": {\"x\": 2, \"y\": 2}}")
+	backdate(repo, targetMatch.ID)
+	modified := getWithHeader(server, "/matches/"+targetMatch.ID, "", "").Header().Get("Last-Modified")
+
+	if recorder := postUndoAs(server, targetMatch.ID, "", "{\"player\": 1}", ""); recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected the undo request to be filed, got %d", recorder.Code)
+	}
+	recorder := getWithHeader(server, "/matches/"+targetMatch.ID, "If-Modified-Since", modified)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected an undo request to count as a change, got %d", recorder.Code)
+	}
+	// Written within the current second, the match has no Last-Modified yet for a later write to
+	// hide behind.
+	if recorder.Header().Get("Last-Modified") != "" {
+		t.Errorf("Expected no Last-Modified until the second of the last write is over, got %s", recorder.Header().Get("Last-Modified"))
+	}
+	recorder = getWithHeader(server, "/matches/"+targetMatch.ID, "If-Modified-Since", time.Now().UTC().Format(http.TimeFormat))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected a match written this second to be sent in full, got %d", recorder.Code)
+	}
+}
+
+// backdate makes a match look as if it was last written a minute ago.
+func backdate(repo *inMemoryMatchRepository, matchID string) {
+	repo.mu.Lock()
+	repo.matches[matchID].updated = time.Now().Add(-time.Minute)
+	repo.mu.Unlock()
+}
+
+func TestConditionalGetOfMatchList(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+
+	etag := getWithHeader(server, "/matches", "", "").Header().Get("ETag")
+	recorder := getWithHeader(server, "/matches", "If-None-Match", etag)
+	if recorder.Code != http.StatusNotModified {
+		t.Errorf("Expected an unchanged match list to return 304, got %d", recorder.Code)
+	}
+
+	postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}")
+	recorder = getWithHeader(server, "/matches", "If-None-Match", etag)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected the match list to change after a move, got %d", recorder.Code)
+	}
+}
+
+func TestMoveWithStaleIfMatchIsRejected(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+	seen := getWithHeader(server, "/matches/"+targetMatch.ID, "", "").Header().Get("ETag")
+
+	recorder := postMoveIfMatch(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}", seen)
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected a move against the board the client saw to return 201, got %d", recorder.Code)
+	}
+
+	recorder = postMoveIfMatch(server, targetMatch.ID, "{\"player\": 2, \"position\": {\"x\": 5, \"y\": 5}}", seen)
+	if recorder.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected a move against an outdated board to return 412, got %d", recorder.Code)
+	}
+	moves, _ := repo.getMoves(targetMatch.ID)
+	if len(moves) != 1 {
+		t.Errorf("Expected the stale move not to be recorded, got %d moves", len(moves))
 	}
 }
 
+func TestMatchListIsPagedWithLinkHeaders(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	for i := 0; i < 3; i++ {
+		repo.addMatch(gogo.NewMatch(9, "bob", "alfred"), matchSettings{})
+	}
+	repo.addMatch(gogo.NewMatch(9, "carol", "dave"), matchSettings{})
+
+	path := "/matches?player=bob&limit=2"
+	var pages [][]newMatchResponse
+	for path != "" && len(pages) < 3 {
+		recorder := getWithHeader(server, path, "", "")
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Expected GET %s to return 200, got %d", path, recorder.Code)
+		}
+		var page []newMatchResponse
+		json.Unmarshal(recorder.Body.Bytes(), &page)
+		pages = append(pages, page)
+
+		path = ""
+		if link := recorder.Header().Get("Link"); link != "" {
+			if !strings.HasSuffix(link, ">; rel=\"next\"") || !strings.Contains(link, "player=bob") {
+				t.Errorf("Expected a next link that keeps the filters, got %s", link)
+			}
+			path = link[1:strings.Index(link, ">")]
+		}
+	}
+	if len(pages) != 2 || len(pages[0]) != 2 || len(pages[1]) != 1 {
+		t.Errorf("Expected bob's 3 matches over 2 pages, got %v", pages)
+	}
+
+	recorder := getWithHeader(server, "/matches?sort=colour", "", "")
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown sort to return 400, got %d", recorder.Code)
+	}
+}
+
+// countingRepository counts the reads of single matches.
+type countingRepository struct {
+	*inMemoryMatchRepository
+	reads int
+}
+
+func (repo *countingRepository) loadMatch(id string) (matchState, error) {
+	repo.reads++
+	return repo.inMemoryMatchRepository.loadMatch(id)
+}
+
+func (repo *countingRepository) getMoves(id string) ([]matchMove, error) {
+	repo.reads++
+	return repo.inMemoryMatchRepository.getMoves(id)
+}
+
+func TestMatchListIsBuiltFromASingleQuery(t *testing.T) {
+	repo := &countingRepository{inMemoryMatchRepository: newInMemoryRepository()}
+	server := MakeTestServer(repo)
+	for i := 0; i < 3; i++ {
+		match := gogo.NewMatch(9, "bob", "alfred")
+		repo.addMatch(match, matchSettings{Komi: 6.5})
+		postMove(server, match.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}")
+	}
+
+	repo.reads = 0
+	recorder := getWithHeader(server, "/matches", "", "")
+	var matches []newMatchResponse
+	json.Unmarshal(recorder.Body.Bytes(), &matches)
+	if len(matches) != 3 || matches[0].Turn != 1 || matches[0].NextPlayer != "white" {
+		t.Errorf("Expected every match with its moves applied, got %+v", matches)
+	}
+	if repo.reads != 0 {
+		t.Errorf("Expected the list to need no reads beyond the query, got %d", repo.reads)
+	}
+}
+
+func TestResignFinishesMatchWithOpponentAsWinner(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+	postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}")
+
+	recorder := postResign(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 5, \"y\": 5}}")
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected a resignation with a position to return 400, got %d", recorder.Code)
+	}
+
+	recorder = postResign(server, targetMatch.ID, "{\"player\": 1}")
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected black resigning out of turn to return 201, got %d", recorder.Code)
+	}
+	var details matchDetailsResponse
+	json.Unmarshal(recorder.Body.Bytes(), &details)
+	if details.Status != matchStatusFinished || details.Winner != "white" {
+		t.Errorf("Expected the match to finish with white as winner, got %s and %q", details.Status, details.Winner)
+	}
+
+	recorder = postMove(server, targetMatch.ID, "{\"player\": 2, \"position\": {\"x\": 5, \"y\": 5}}")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected moves after a resignation to return 409, got %d", recorder.Code)
+	}
+	recorder = postResign(server, targetMatch.ID, "{\"player\": 2}")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected resigning a finished match to return 409, got %d", recorder.Code)
+	}
+
+	moves, _ := repo.getMoves(targetMatch.ID)
+	if len(moves) != 2 || !moves[1].Resigned || moves[1].isPass() {
+		t.Errorf("Expected the resignation to be recorded in the history, got %+v", moves)
+	}
+}
+
+func TestPlayersCanAbandonUnplayedMatch(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches", strings.NewReader("{\"gridsize\": 9, \"playerWhite\": \"bob\", \"playerBlack\": \"alfred\"}"))
+	server.ServeHTTP(recorder, request)
+	var matchResponse newMatchResponse
+	json.Unmarshal(recorder.Body.Bytes(), &matchResponse)
+
+	recorder = deleteMatchAs(server, matchResponse.ID, "")
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected deleting without a token to return 401, got %d", recorder.Code)
+	}
+	recorder = deleteMatchAs(server, matchResponse.ID, "guess")
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected deleting with a stranger's token to return 403, got %d", recorder.Code)
+	}
+	recorder = deleteMatchAs(server, matchResponse.ID, matchResponse.SeatTokens.White)
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected white abandoning an unplayed match to return 204, got %d", recorder.Code)
+	}
+	if _, err := repo.getMatch(matchResponse.ID); err == nil {
+		t.Error("Expected the abandoned match to be removed")
+	}
+	recorder = deleteMatchAs(server, matchResponse.ID, matchResponse.SeatTokens.White)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected deleting a removed match to return 404, got %d", recorder.Code)
+	}
+}
+
+func TestStartedMatchCanOnlyBeDeletedByAdmin(t *testing.T) {
+	os.Setenv(adminTokenEnv, "letmein")
+	defer os.Unsetenv(adminTokenEnv)
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+	postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}")
+
+	recorder := deleteMatchAs(server, targetMatch.ID, "")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("Expected a player deleting a started match to return 409, got %d", recorder.Code)
+	}
+	recorder = deleteMatchAs(server, targetMatch.ID, "letmein")
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected the administrator deleting a started match to return 204, got %d", recorder.Code)
+	}
+	matches, _, _ := repo.findMatches(matchQuery{Limit: defaultPageSize})
+	if len(matches) != 0 {
+		t.Errorf("Expected the repository to be empty, got %d matches", len(matches))
+	}
+}
+
+func postResign(server http.Handler, matchID string, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches/"+matchID+"/resign", strings.NewReader(body))
+	request.Header.Set("If-Match", currentETag(server, matchID))
+	server.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func deleteMatchAs(server http.Handler, matchID string, token string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("DELETE", "/matches/"+matchID, nil)
+	request.Header.Set("If-Match", currentETag(server, matchID))
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	server.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestMatchCanBeExportedAsSGF(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{Komi: 6.5})
+	postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 2, \"y\": 3}}")
+
+	byExtension := getWithHeader(server, "/matches/"+targetMatch.ID+".sgf", "", "")
+	byAccept := getWithHeader(server, "/matches/"+targetMatch.ID, "Accept", "application/x-go-sgf")
+	for _, recorder := range []*httptest.ResponseRecorder{byExtension, byAccept} {
+		if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/x-go-sgf" {
+			t.Errorf("Expected an SGF record, got %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+		}
+		if !strings.Contains(recorder.Body.String(), ";B[cd]") {
+			t.Errorf("Expected the record to contain black's move, got %s", recorder.Body.String())
+		}
+	}
+	if byAccept.Header().Get("ETag") == getWithHeader(server, "/matches/"+targetMatch.ID, "", "").Header().Get("ETag") {
+		t.Error("The SGF and JSON representations should carry different ETags")
+	}
+
+	recorder := getWithHeader(server, "/matches/nevergonnahappen.sgf", "", "")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected exporting a nonexistent match to return 404, got %d", recorder.Code)
+	}
+}
+
+func TestMatchCanBeImportedFromSGF(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	record := "(;FF[4]GM[1]SZ[9]PB[alfred]PW[bob]KM[5.5];B[ba];W[aa];B[ab];W[ee];B[])"
+
+	recorder := importSGF(server, "", record)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected import to return 201, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var mr newMatchResponse
+	json.Unmarshal(recorder.Body.Bytes(), &mr)
+	if mr.PlayerBlack != "alfred" || mr.Komi != 5.5 || mr.Turn != 5 || mr.NextPlayer != "white" || mr.SeatTokens == nil {
+		t.Errorf("Expected the imported match to carry the record's settings and position, got %+v", mr)
+	}
+	if recorder.Header().Get("Location") != "/matches/"+mr.ID {
+		t.Errorf("Expected a Location header for the new match, got %s", recorder.Header().Get("Location"))
+	}
+
+	match, _ := repo.getMatch(mr.ID)
+	moves, _ := repo.getMoves(mr.ID)
+	if len(moves) != 5 || match.GameBoard.Positions[1][0] != gogo.PlayerBlack || match.GameBoard.Positions[4][4] != gogo.PlayerWhite {
+		t.Errorf("Expected the full history to be replayed onto the board, got %+v", moves)
+	}
+	exported := getWithHeader(server, "/matches/"+mr.ID+".sgf", "", "").Body.String()
+	for _, expected := range []string{";B[ba]", ";W[aa]", ";B[ab]", ";W[ee]", ";B[]"} {
+		if !strings.Contains(exported, expected) {
+			t.Errorf("Expected the exported record to contain %s, got %s", expected, exported)
+		}
+	}
+
+	recorder = postMoveAs(server, mr.ID, "{\"player\": 2, \"position\": {\"x\": 4, \"y\": 5}}", mr.SeatTokens.White)
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Expected play to continue from the imported position, got %d", recorder.Code)
+	}
+}
+
+func TestFailedImportDeletesNothing(t *testing.T) {
+	repo := &unavailableRepository{inMemoryMatchRepository: newInMemoryRepository()}
+	server := MakeTestServer(repo)
+	recorder := importSGF(server, "", "(;FF[4]GM[1]SZ[9]PB[alfred]PW[bob];B[ba];W[aa])")
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected an import that cannot be stored to return 500, got %d", recorder.Code)
+	}
+	if matches, _, _ := repo.findMatches(matchQuery{Limit: defaultPageSize}); len(matches) != 0 {
+		t.Errorf("Expected the failed import to leave no match behind, got %d", len(matches))
+	}
+	// A write that failed on a duplicate ID must not take the match already holding it with it.
+	if len(repo.deleted) != 0 {
+		t.Errorf("Expected a failed import to delete nothing, got %v", repo.deleted)
+	}
+}
+
+func TestImportCanStopAtRequestedMove(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	record := "(;SZ[9]HA[2]AB[cc][gg];W[ee];B[dd];W[ff])"
+
+	recorder := importSGF(server, "?move=1", record)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected import to return 201, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var mr newMatchResponse
+	json.Unmarshal(recorder.Body.Bytes(), &mr)
+	match, _ := repo.getMatch(mr.ID)
+	moves, _ := repo.getMoves(mr.ID)
+	if mr.Handicap != 2 || mr.Turn != 1 || len(moves) != 1 || mr.NextPlayer != "black" {
+		t.Errorf("Expected the match to stop after white's first move, got %+v with %d moves", mr, len(moves))
+	}
+	if match.GameBoard.Positions[2][2] != gogo.PlayerBlack || match.GameBoard.Positions[4][4] != gogo.PlayerWhite || match.GameBoard.Positions[3][3] != 0 {
+		t.Errorf("Expected the board as it stood after move 1, got\n%s", asciiBoard(match.GameBoard.Positions))
+	}
+
+	if recorder = importSGF(server, "?move=4", record); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected a move number past the end of the record to return 400, got %d", recorder.Code)
+	}
+}
+
+func TestImportRejectsRecordsTheEngineCannotReplay(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	records := map[string]string{
+		"malformed":          "(;SZ[9];B[aa]",
+		"unsupported":        "(;SZ[7];B[aa])",
+		"occupied point":     "(;SZ[9];B[aa];W[aa])",
+		"out of turn":        "(;SZ[9];B[aa];B[bb])",
+		"off the board":      "(;SZ[9];B[jj])",
+		"play after the end": "(;SZ[9];B[aa];W[];B[];W[bb])",
+		"white setup":        "(;SZ[9]AW[aa];B[bb])",
+		"free handicap":      "(;SZ[9]AB[aa][bb];W[cc])",
+	}
+	for name, record := range records {
+		if recorder := importSGF(server, "", record); recorder.Code != http.StatusBadRequest {
+			t.Errorf("Expected a record with %s to return 400, got %d", name, recorder.Code)
+		}
+	}
+	if matches, _, _ := repo.findMatches(matchQuery{Limit: defaultPageSize}); len(matches) != 0 {
+		t.Errorf("Expected rejected records to leave no matches behind, got %d", len(matches))
+	}
+}
+
+func importSGF(server http.Handler, query string, record string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches/import"+query, strings.NewReader(record))
+	request.Header.Set("Content-Type", sgfMediaType)
+	server.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestBoardImagesRenderCurrentAndHistoricalPositions(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{Komi: 6.5})
+	postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 2, \"y\": 3}}")
+
+	recorder := getWithHeader(server, "/matches/"+targetMatch.ID+"/board.svg", "", "")
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Fatalf("Expected an SVG board, got %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	if strings.Count(recorder.Body.String(), "<circle") != 7 {
+		t.Errorf("Expected star points, the stone and its marker, got %s", recorder.Body.String())
+	}
+	if recorder.Header().Get("ETag") == "" {
+		t.Error("Expected board images to carry an ETag")
+	}
+
+	recorder = getWithHeader(server, "/matches/"+targetMatch.ID+"/board.svg?move=0&size=300", "", "")
+	if strings.Count(recorder.Body.String(), "<circle") != 5 || !strings.Contains(recorder.Body.String(), `width="300"`) {
+		t.Errorf("Expected an empty 300 pixel board before the first move, got %s", recorder.Body.String())
+	}
+
+	recorder = getWithHeader(server, "/matches/"+targetMatch.ID+"/board.png", "", "")
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("Expected a PNG board, got %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+
+	for _, query := range []string{"?size=10", "?size=big", "?move=2", "?move=-1"} {
+		if recorder = getWithHeader(server, "/matches/"+targetMatch.ID+"/board.png"+query, "", ""); recorder.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to return 400, got %d", query, recorder.Code)
+		}
+	}
+	if recorder = getWithHeader(server, "/matches/nevergonnahappen/board.svg", "", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected a board image of a nonexistent match to return 404, got %d", recorder.Code)
+	}
+}
+
+func TestMatchCanBeRenderedAsText(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{Komi: 6.5})
+	postMove(server, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 2, \"y\": 3}}")
+
+	byAccept := getWithHeader(server, "/matches/"+targetMatch.ID, "Accept", "text/plain")
+	byFormat := getWithHeader(server, "/matches/"+targetMatch.ID+"?format=ascii", "", "")
+	for _, recorder := range []*httptest.ResponseRecorder{byAccept, byFormat} {
+		if recorder.Code != http.StatusOK || !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain") {
+			t.Errorf("Expected a text board, got %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+		}
+		if !strings.Contains(recorder.Body.String(), "Last move: black C6") || !strings.Contains(recorder.Body.String(), " 6 . . X") {
+			t.Errorf("Expected black's stone on the text board, got\n%s", recorder.Body.String())
+		}
+	}
+	if recorder := getWithHeader(server, "/matches/nevergonnahappen?format=ascii", "", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected rendering a nonexistent match to return 404, got %d", recorder.Code)
+	}
+}
+
+func TestBotRepliesToHumanMoves(t *testing.T) {
+	repo := newInMemoryRepository()
+	bots := newBotRunner(repo, newMatchHub())
+	mx := mux.NewRouter()
+	initRoutes(mx, formatter, repo, newMatchHub(), bots)
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches", strings.NewReader("{\"gridsize\": 9, \"playerBlack\": \"alfred\", \"playerWhite\": \"bot:random\", \"botSeed\": 42}"))
+	mx.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected a match against a bot to be created, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var matchResponse newMatchResponse
+	json.Unmarshal(recorder.Body.Bytes(), &matchResponse)
+	if matchResponse.SeatTokens.Black == "" || matchResponse.SeatTokens.White != "" {
+		t.Errorf("Expected only the human's seat token to be handed out, got %+v", matchResponse.SeatTokens)
+	}
+	state, _ := repo.loadMatch(matchResponse.ID)
+	settings := state.Settings
+	if settings.BotSeed != 42 || settings.BotThinkingTime != 0 {
+		t.Errorf("Expected the bot's seed to be stored without a thinking time, got %+v", settings)
+	}
+
+	recorder = postMoveAs(mx, matchResponse.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}", matchResponse.SeatTokens.Black)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected the human's move to succeed, got %d", recorder.Code)
+	}
+	bots.wait()
+	moves, _ := repo.getMoves(matchResponse.ID)
+	if len(moves) != 2 || moves[1].Player != gogo.PlayerWhite || moves[1].Position == nil {
+		t.Fatalf("Expected the bot to reply with a stone, got %+v", moves)
+	}
+	match, _ := repo.getMatch(matchResponse.ID)
+	if match.GameBoard.Positions[moves[1].Position.X][moves[1].Position.Y] != gogo.PlayerWhite {
+		t.Errorf("Expected the bot's stone at %v on the board", *moves[1].Position)
+	}
+
+	recorder = postMoveAs(mx, matchResponse.ID, "{\"player\": 2}", "")
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected nobody to be able to move for the bot, got %d", recorder.Code)
+	}
+}
+
+func TestBotPlayingBlackOpensTheMatch(t *testing.T) {
+	repo := newInMemoryRepository()
+	bots := newBotRunner(repo, newMatchHub())
+	mx := mux.NewRouter()
+	initRoutes(mx, formatter, repo, newMatchHub(), bots)
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches", strings.NewReader("{\"gridsize\": 9, \"playerBlack\": \"bot:greedy-capture\", \"playerWhite\": \"bob\"}"))
+	mx.ServeHTTP(recorder, request)
+	var matchResponse newMatchResponse
+	json.Unmarshal(recorder.Body.Bytes(), &matchResponse)
+	bots.wait()
+	moves, _ := repo.getMoves(matchResponse.ID)
+	if len(moves) != 1 || moves[0].Player != gogo.PlayerBlack {
+		t.Errorf("Expected the bot to open the match as black, got %+v", moves)
+	}
+}
+
+func TestInvalidBotMatchesAreRejected(t *testing.T) {
+	server := MakeTestServer(newInMemoryRepository())
+	for _, body := range []string{
+		"{\"gridsize\": 9, \"playerBlack\": \"alfred\", \"playerWhite\": \"bot:unknown\"}",
+		"{\"gridsize\": 9, \"playerBlack\": \"bot:random\", \"playerWhite\": \"bot:mcts\"}",
+		"{\"gridsize\": 9, \"playerBlack\": \"alfred\", \"playerWhite\": \"bot:mcts\", \"botThinkingTime\": 60000}",
+		"{\"gridsize\": 9, \"playerBlack\": \"alfred\", \"playerWhite\": \"bot:mcts\", \"botThinkingTime\": -1}",
+		"{\"gridsize\": 9, \"playerBlack\": \"alfred\", \"playerWhite\": \"bot:random\", \"botThinkingTime\": 200}",
+		"{\"gridsize\": 9, \"playerBlack\": \"bot:greedy-capture\", \"playerWhite\": \"bob\", \"botThinkingTime\": 200}",
+	} {
+		recorder := httptest.NewRecorder()
+		request, _ := http.NewRequest("POST", "/matches", strings.NewReader(body))
+		server.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", body, recorder.Code)
+		}
+	}
+}
+
+func getWithHeader(server http.Handler, path string, header string, value string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", path, nil)
+	if header != "" {
+		request.Header.Set(header, value)
+	}
+	server.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func postMoveIfMatch(server http.Handler, matchID string, body string, etag string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches/"+matchID+"/moves", strings.NewReader(body))
+	request.Header.Set("If-Match", etag)
+	server.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func postMoveAs(server http.Handler, matchID string, body string, seatToken string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches/"+matchID+"/moves", strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer "+seatToken)
+	request.Header.Set("If-Match", currentETag(server, matchID))
+	server.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// postMove plays a move against the board as it currently stands.
+func postMove(server http.Handler, matchID string, body string) *httptest.ResponseRecorder {
+	return postMoveIfMatch(server, matchID, body, currentETag(server, matchID))
+}
+
+// currentETag fetches the entity tag a change to the match has to name in If-Match.
+func currentETag(server http.Handler, matchID string) string {
+	return getWithHeader(server, "/matches/"+matchID, "", "").Header().Get("ETag")
+}
+
 func MakeTestServer(repository matchRepository) *negroni.Negroni {
 	server := negroni.New() // don't need all the middleware here or logging.
 	mx := mux.NewRouter()
-	initRoutes(mx, formatter, repository)
+	initRoutes(mx, formatter, repository, newMatchHub(), newBotRunner(repository, newMatchHub()))
 	server.UseHandler(mx)
 	return server
 }
@@ -0,0 +1,69 @@
+package service
+
+import "sync"
+
+// updateBufferSize is how many unsent updates a subscriber may fall behind by before the oldest
+// of them are dropped to make room. Every update is a full snapshot of the match, so a slow
+// client that misses one is still left with the latest state.
+const updateBufferSize = 8
+
+// matchHub fans match updates out to every client subscribed to that match. Subscriptions
+// are held in memory, so only clients connected to this instance of the service are reached.
+type matchHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan matchDetailsResponse]bool
+}
+
+func newMatchHub() *matchHub {
+	return &matchHub{
+		subscribers: make(map[string]map[chan matchDetailsResponse]bool),
+	}
+}
+
+// subscribe registers a new listener for updates to the given match.
+func (hub *matchHub) subscribe(matchID string) chan matchDetailsResponse {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	updates := make(chan matchDetailsResponse, updateBufferSize)
+	if hub.subscribers[matchID] == nil {
+		hub.subscribers[matchID] = make(map[chan matchDetailsResponse]bool)
+	}
+	hub.subscribers[matchID][updates] = true
+	return updates
+}
+
+// unsubscribe removes a listener, forgetting the match entirely once nobody is watching it.
+func (hub *matchHub) unsubscribe(matchID string, updates chan matchDetailsResponse) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	delete(hub.subscribers[matchID], updates)
+	if len(hub.subscribers[matchID]) == 0 {
+		delete(hub.subscribers, matchID)
+	}
+}
+
+// publish sends an update to every listener on the match without blocking on slow ones. A
+// listener whose buffer is full loses its oldest update instead of this one.
+func (hub *matchHub) publish(matchID string, update matchDetailsResponse) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for updates := range hub.subscribers[matchID] {
+		select {
+		case updates <- update:
+			continue
+		default:
+		}
+		select {
+		case <-updates:
+		default:
+		}
+		// Only publishers send, and they hold the lock, so there is room now.
+		updates <- update
+	}
+}
+
+func (hub *matchHub) subscriberCount(matchID string) int {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	return len(hub.subscribers[matchID])
+}
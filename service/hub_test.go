@@ -0,0 +1,65 @@
+package service
+
+import "testing"
+
+func TestHubFansOutToEverySubscriber(t *testing.T) {
+	hub := newMatchHub()
+	first := hub.subscribe("match")
+	second := hub.subscribe("match")
+	other := hub.subscribe("other")
+
+	hub.publish("match", matchDetailsResponse{ID: "match", Turn: 1})
+
+	for _, updates := range []chan matchDetailsResponse{first, second} {
+		select {
+		case update := <-updates:
+			if update.Turn != 1 {
+				t.Errorf("Expected update for turn 1, got %d", update.Turn)
+			}
+		default:
+			t.Error("Expected every subscriber of the match to receive the update")
+		}
+	}
+	select {
+	case <-other:
+		t.Error("Subscribers of another match should not receive the update")
+	default:
+	}
+}
+
+func TestHubDropsUpdatesForSlowSubscribers(t *testing.T) {
+	hub := newMatchHub()
+	updates := hub.subscribe("match")
+
+	for turn := 0; turn < updateBufferSize*2; turn++ {
+		hub.publish("match", matchDetailsResponse{Turn: turn})
+	}
+	if len(updates) != updateBufferSize {
+		t.Fatalf("Expected %d buffered updates, got %d", updateBufferSize, len(updates))
+	}
+	if first := <-updates; first.Turn != updateBufferSize {
+		t.Errorf("Expected the oldest updates to be dropped, got turn %d first", first.Turn)
+	}
+	var last matchDetailsResponse
+	for len(updates) > 0 {
+		last = <-updates
+	}
+	if last.Turn != updateBufferSize*2-1 {
+		t.Errorf("Expected the latest update to be kept, got turn %d last", last.Turn)
+	}
+}
+
+func TestHubForgetsUnsubscribedClients(t *testing.T) {
+	hub := newMatchHub()
+	first := hub.subscribe("match")
+	second := hub.subscribe("match")
+
+	hub.unsubscribe("match", first)
+	if hub.subscriberCount("match") != 1 {
+		t.Errorf("Expected 1 subscriber after unsubscribing, got %d", hub.subscriberCount("match"))
+	}
+	hub.unsubscribe("match", second)
+	if _, ok := hub.subscribers["match"]; ok {
+		t.Error("Expected the hub to forget matches without subscribers")
+	}
+}
@@ -2,56 +2,292 @@ package service
 
 import (
 	"errors"
-	"strings"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/cloudnativego/gogo-engine"
 )
 
+var errMatchNotFound = errors.New("Could not find match in repository")
+
+// inMemoryMatchRepository keeps matches in a map guarded by a read/write lock, so it can be
+// shared by every HTTP handler goroutine. Matches go in and come out as deep copies, which
+// stops callers from mutating a stored board behind the repository's back.
 type inMemoryMatchRepository struct {
-	matches []gogo.Match
+	mu      sync.RWMutex
+	order   []string
+	matches map[string]*inMemoryMatch
+}
+
+type inMemoryMatch struct {
+	match    gogo.Match
+	settings matchSettings
+	moves    []matchMove
+	status   string
+	version  int
+	undo     *undoRequest
+	undos    []matchUndo
+	deadline time.Time
+	updated  time.Time
 }
 
 // NewRepository creates a new in-memory match repository
 func newInMemoryRepository() *inMemoryMatchRepository {
 	repo := &inMemoryMatchRepository{}
-	repo.matches = []gogo.Match{}
+	repo.order = []string{}
+	repo.matches = make(map[string]*inMemoryMatch)
 	return repo
 }
 
-func (repo *inMemoryMatchRepository) addMatch(match gogo.Match) (err error) {
-	repo.matches = append(repo.matches, match)
+func (repo *inMemoryMatchRepository) addMatch(match gogo.Match, settings matchSettings) (err error) {
+	return repo.importMatch(match, settings, nil)
+}
+
+func (repo *inMemoryMatchRepository) importMatch(match gogo.Match, settings matchSettings, moves []matchMove) (err error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if _, exists := repo.matches[match.ID]; exists {
+		return errors.New("Match already exists in repository")
+	}
+	target := &inMemoryMatch{
+		match:    cloneMatch(match),
+		settings: settings,
+		status:   matchStatus(moves),
+		version:  1 + len(moves),
+		deadline: clockDeadline(settings, match.StartTime, moves, nil),
+		updated:  time.Now(),
+	}
+	for idx, move := range moves {
+		move.Version = idx + 2
+		target.moves = append(target.moves, cloneMove(move))
+	}
+	repo.matches[match.ID] = target
+	repo.order = append(repo.order, match.ID)
 	return err
 }
 
-func (repo *inMemoryMatchRepository) getMatches() (matches []gogo.Match, err error) {
-	matches = repo.matches
+func (repo *inMemoryMatchRepository) findMatches(query matchQuery) (matches []matchState, next string, err error) {
+	var after *matchCursor
+	if query.Cursor != "" {
+		cursor, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		after = &cursor
+	}
+
+	repo.mu.RLock()
+	matches = []matchState{}
+	for _, id := range repo.order {
+		target := repo.matches[id]
+		if query.includes(target.match, target.status) && (after == nil || query.before(*after, cursorFor(target.match))) {
+			matches = append(matches, target.state())
+		}
+	}
+	repo.mu.RUnlock()
+
+	sort.Sort(matchOrder{matches: matches, query: query})
+	if len(matches) > query.Limit {
+		matches = matches[:query.Limit]
+		next = encodeCursor(cursorFor(matches[len(matches)-1].Match))
+	}
 	return
 }
 
-func (repo *inMemoryMatchRepository) getMatch(id string) (match gogo.Match, err error) {
-	found := false
-	for _, target := range repo.matches {
-		if strings.Compare(target.ID, id) == 0 {
-			match = target
-			found = true
+func (repo *inMemoryMatchRepository) findExpiredMatches(now time.Time) (matches []matchState, err error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	for _, id := range repo.order {
+		target := repo.matches[id]
+		if target.status == matchStatusActive && !target.deadline.IsZero() && !target.deadline.After(now) {
+			matches = append(matches, target.state())
 		}
 	}
-	if !found {
-		err = errors.New("Could not find match in repository")
+	return
+}
+
+// matchOrder sorts matches in the order requested by a query.
+type matchOrder struct {
+	matches []matchState
+	query   matchQuery
+}
+
+func (o matchOrder) Len() int      { return len(o.matches) }
+func (o matchOrder) Swap(i, j int) { o.matches[i], o.matches[j] = o.matches[j], o.matches[i] }
+func (o matchOrder) Less(i, j int) bool {
+	return o.query.before(cursorFor(o.matches[i].Match), cursorFor(o.matches[j].Match))
+}
+
+func (repo *inMemoryMatchRepository) getMatch(id string) (match gogo.Match, err error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	target, ok := repo.matches[id]
+	if !ok {
+		return match, errMatchNotFound
+	}
+	return cloneMatch(target.match), nil
+}
+
+func (repo *inMemoryMatchRepository) loadMatch(id string) (state matchState, err error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	target, ok := repo.matches[id]
+	if !ok {
+		return state, errMatchNotFound
+	}
+	return target.state(), nil
+}
+
+// state copies out everything stored about the match. The caller must hold the repository lock.
+func (target *inMemoryMatch) state() (state matchState) {
+	state = matchState{
+		Version:   target.version,
+		Match:     cloneMatch(target.match),
+		Settings:  target.settings,
+		Moves:     make([]matchMove, len(target.moves)),
+		UpdatedAt: target.updated,
+	}
+	for idx, move := range target.moves {
+		state.Moves[idx] = cloneMove(move)
+	}
+	if target.undo != nil {
+		copied := *target.undo
+		state.Undo = &copied
 	}
-	return match, err
+	state.Undos = append([]matchUndo(nil), target.undos...)
+	return
 }
 
-func (repo *inMemoryMatchRepository) updateMatch(id string, match gogo.Match) (err error) {
-	found := false
-	for k, v := range repo.matches {
-		if strings.Compare(v.ID, id) == 0 {
-			repo.matches[k] = match
-			found = true
-		}
+func (repo *inMemoryMatchRepository) updateMatch(id string, version int, update matchUpdate) (err error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	target, ok := repo.matches[id]
+	if !ok {
+		return errMatchNotFound
 	}
-	if !found {
-		err = errors.New("Could not find match in repository")
+	if target.version != version {
+		return errVersionConflict
 	}
+	target.match = cloneMatch(update.Match)
+	target.status = update.Status
+	for _, move := range update.Moves {
+		move.Version = version + 1
+		target.moves = append(target.moves, cloneMove(move))
+	}
+	target.deadline = update.Deadline
+	target.undo = nil
+	target.version++
+	target.updated = time.Now()
 	return
 }
+
+func (repo *inMemoryMatchRepository) rewindMatch(id string, version int, rewind matchRewind) (err error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	target, ok := repo.matches[id]
+	if !ok {
+		return errMatchNotFound
+	}
+	if target.version != version {
+		return errVersionConflict
+	}
+	if rewind.Keep < len(target.moves) {
+		target.moves = append([]matchMove(nil), target.moves[:rewind.Keep]...)
+	}
+	target.undos = append(target.undos, matchUndo{Version: version + 1, Keep: rewind.Keep, At: rewind.At})
+	target.match = cloneMatch(rewind.Match)
+	target.status = rewind.Status
+	target.deadline = rewind.Deadline
+	target.undo = nil
+	target.version++
+	target.updated = time.Now()
+	return
+}
+
+func (repo *inMemoryMatchRepository) setUndoRequest(id string, version int, request *undoRequest) (err error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	target, ok := repo.matches[id]
+	if !ok {
+		return errMatchNotFound
+	}
+	if target.version != version {
+		return errVersionConflict
+	}
+	target.undo = nil
+	if request != nil {
+		copied := *request
+		target.undo = &copied
+	}
+	target.version++
+	target.updated = time.Now()
+	return
+}
+
+func (repo *inMemoryMatchRepository) setKomi(id string, version int, komi float64) (err error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	target, ok := repo.matches[id]
+	if !ok {
+		return errMatchNotFound
+	}
+	if target.version != version {
+		return errVersionConflict
+	}
+	target.settings.Komi = komi
+	target.version++
+	target.updated = time.Now()
+	return
+}
+
+func (repo *inMemoryMatchRepository) getMoves(id string) (moves []matchMove, err error) {
+	repo.mu.RLock()
+	defer repo.mu.RUnlock()
+	target, ok := repo.matches[id]
+	if !ok {
+		return nil, errMatchNotFound
+	}
+	moves = make([]matchMove, len(target.moves))
+	for idx, move := range target.moves {
+		moves[idx] = cloneMove(move)
+	}
+	return
+}
+
+func (repo *inMemoryMatchRepository) deleteMatch(id string) (err error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if _, ok := repo.matches[id]; !ok {
+		return errMatchNotFound
+	}
+	delete(repo.matches, id)
+	for idx, candidate := range repo.order {
+		if candidate == id {
+			repo.order = append(repo.order[:idx], repo.order[idx+1:]...)
+			break
+		}
+	}
+	return
+}
+
+func cloneMatch(match gogo.Match) gogo.Match {
+	match.GameBoard = cloneBoard(match.GameBoard)
+	return match
+}
+
+func cloneBoard(board gogo.GameBoard) gogo.GameBoard {
+	positions := make([][]byte, len(board.Positions))
+	for x := range board.Positions {
+		positions[x] = append([]byte(nil), board.Positions[x]...)
+	}
+	return gogo.GameBoard{Positions: positions}
+}
+
+func cloneMove(move matchMove) matchMove {
+	if move.Position != nil {
+		position := *move.Position
+		move.Position = &position
+	}
+	return move
+}
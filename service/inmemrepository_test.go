@@ -1,7 +1,12 @@
 package service
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/cloudnativego/gogo-engine"
 )
@@ -10,24 +15,24 @@ func TestAddMatchShowsUpInRepository(t *testing.T) {
 	match := gogo.NewMatch(19, "bob", "alfred")
 
 	repo := newInMemoryRepository()
-	err := repo.addMatch(match)
+	err := repo.addMatch(match, matchSettings{})
 	if err != nil {
 		t.Error("Got an error adding a match to repository, should not have.")
 	}
 
-	matches, err := repo.getMatches()
+	matches, _, err := repo.findMatches(matchQuery{Limit: defaultPageSize})
 	if err != nil {
-		t.Errorf("Unexpected error in getMatches(): %s", err)
+		t.Errorf("Unexpected error in findMatches(): %s", err)
 	}
 	if len(matches) != 1 {
 		t.Errorf("Expected to have 1 match in the repository, got %d", len(matches))
 	}
 
-	if matches[0].PlayerBlack != "bob" {
-		t.Errorf("Player 1's name should have been bob, got %s", matches[0].PlayerBlack)
+	if matches[0].Match.PlayerBlack != "bob" {
+		t.Errorf("Player 1's name should have been bob, got %s", matches[0].Match.PlayerBlack)
 	}
-	if matches[0].PlayerWhite != "alfred" {
-		t.Errorf("Player 2's name should have been alfred, got %s", matches[0].PlayerWhite)
+	if matches[0].Match.PlayerWhite != "alfred" {
+		t.Errorf("Player 2's name should have been alfred, got %s", matches[0].Match.PlayerWhite)
 	}
 }
 
@@ -35,7 +40,7 @@ func TestGetMatchRetrievesProperMatch(t *testing.T) {
 	match := gogo.NewMatch(19, "bob", "alfred")
 
 	repo := newInMemoryRepository()
-	err := repo.addMatch(match)
+	err := repo.addMatch(match, matchSettings{})
 	if err != nil {
 		t.Error("Got an error adding a match to repository, should not have.")
 	}
@@ -53,9 +58,9 @@ func TestGetMatchRetrievesProperMatch(t *testing.T) {
 func TestNewRepositoryIsEmpty(t *testing.T) {
 	repo := newInMemoryRepository()
 
-	matches, err := repo.getMatches()
+	matches, _, err := repo.findMatches(matchQuery{Limit: defaultPageSize})
 	if err != nil {
-		t.Errorf("Unexpected error in getMatches(): %s", err)
+		t.Errorf("Unexpected error in findMatches(): %s", err)
 	}
 	if len(matches) != 0 {
 		t.Errorf("Expected to have 0 matches in newly created repository, got %d", len(matches))
@@ -67,17 +72,17 @@ func TestUpdateMatch(t *testing.T) {
 	match := gogo.NewMatch(19, "bob", "alfred")
 
 	repo := newInMemoryRepository()
-	err := repo.addMatch(redHerring)
+	err := repo.addMatch(redHerring, matchSettings{})
 	if err != nil {
 		t.Errorf("Error adding match: %s", err)
 	}
-	err = repo.addMatch(match)
+	err = repo.addMatch(match, matchSettings{})
 	if err != nil {
 		t.Errorf("Error adding match: %s", err)
 	}
 
 	match.TurnCount = 37
-	err = repo.updateMatch(match.ID, match)
+	err = repo.updateMatch(match.ID, 1, matchUpdate{Match: match, Status: matchStatusActive})
 	if err != nil {
 		t.Errorf("Error updating match: %s", err)
 	}
@@ -93,3 +98,248 @@ func TestUpdateMatch(t *testing.T) {
 		t.Errorf("Update failed: expected %d; received %d", 37, found.TurnCount)
 	}
 }
+
+func TestMovesAreReturnedInOrder(t *testing.T) {
+	match := gogo.NewMatch(19, "bob", "alfred")
+
+	repo := newInMemoryRepository()
+	err := repo.addMatch(match, matchSettings{})
+	if err != nil {
+		t.Errorf("Error adding match: %s", err)
+	}
+
+	first := matchMove{Player: gogo.PlayerBlack, Position: &gogo.Coordinate{X: 3, Y: 3}, Turn: 1}
+	err = repo.updateMatch(match.ID, 1, matchUpdate{Match: match, Status: matchStatusActive, Moves: []matchMove{first}})
+	if err != nil {
+		t.Errorf("Error adding first move: %s", err)
+	}
+	second := matchMove{Player: gogo.PlayerWhite, Position: &gogo.Coordinate{X: 15, Y: 15}, Turn: 2}
+	err = repo.updateMatch(match.ID, 2, matchUpdate{Match: match, Status: matchStatusActive, Moves: []matchMove{second}})
+	if err != nil {
+		t.Errorf("Error adding second move: %s", err)
+	}
+
+	moves, err := repo.getMoves(match.ID)
+	if err != nil {
+		t.Errorf("Error retrieving moves: %s", err)
+	}
+	if len(moves) != 2 {
+		t.Fatalf("Expected 2 moves; received %d", len(moves))
+	}
+	if moves[0].Player != gogo.PlayerBlack || moves[0].Turn != 1 {
+		t.Errorf("First move should be black's on turn 1, got %+v", moves[0])
+	}
+	if moves[1].Player != gogo.PlayerWhite || moves[1].Position.X != 15 {
+		t.Errorf("Second move should be white's at 15,15, got %+v", moves[1])
+	}
+}
+
+func TestUpdateMissingMatchFails(t *testing.T) {
+	repo := newInMemoryRepository()
+	move := matchMove{Player: gogo.PlayerBlack, Turn: 1}
+	err := repo.updateMatch("nevergonnahappen", 1, matchUpdate{Match: gogo.NewMatch(9, "bob", "alfred"), Moves: []matchMove{move}})
+	if err != errMatchNotFound {
+		t.Errorf("Expected adding a move to a nonexistent match to fail with errMatchNotFound, got %v", err)
+	}
+}
+
+func TestRepositoryReturnsDefensiveCopies(t *testing.T) {
+	match := gogo.NewMatch(9, "bob", "alfred")
+
+	repo := newInMemoryRepository()
+	repo.addMatch(match, matchSettings{})
+	match.GameBoard.Positions[0][0] = gogo.PlayerBlack
+
+	found, _ := repo.getMatch(match.ID)
+	if found.GameBoard.Positions[0][0] != 0 {
+		t.Error("Mutating the added match should not change the stored board")
+	}
+
+	found.GameBoard.Positions[1][1] = gogo.PlayerWhite
+	matches, _, _ := repo.findMatches(matchQuery{Limit: defaultPageSize})
+	if matches[0].Match.GameBoard.Positions[1][1] != 0 {
+		t.Error("Mutating a retrieved match should not change the stored board")
+	}
+
+	matches[0].Match.PlayerBlack = "mallory"
+	matches = append(matches[:0], matchState{Match: gogo.NewMatch(9, "eve", "trent")})
+	again, _, _ := repo.findMatches(matchQuery{Limit: defaultPageSize})
+	if len(again) != 1 || again[0].Match.PlayerBlack != "bob" {
+		t.Errorf("Mutating the match list should not change the repository, got %+v", again)
+	}
+}
+
+func TestConcurrentMovesAreSafe(t *testing.T) {
+	const players = 8
+	const rounds = 10
+
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	shared := gogo.NewMatch(19, "black", "white")
+	repo.addMatch(shared, matchSettings{})
+
+	var wg sync.WaitGroup
+	for p := 0; p < players; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			own := gogo.NewMatch(19, "black", "white")
+			repo.addMatch(own, matchSettings{})
+			for round := 0; round < rounds; round++ {
+				player := round%2 + 1
+				body := fmt.Sprintf("{\"player\": %d, \"position\": {\"x\": %d, \"y\": %d}}", player, p, round)
+				recorder := postMove(server, own.ID, body)
+				if recorder.Code != http.StatusCreated {
+					t.Errorf("Expected move %d on an unshared match to return 201, got %d", round, recorder.Code)
+				}
+
+				body = fmt.Sprintf("{\"player\": %d, \"position\": {\"x\": %d, \"y\": %d}}", player, p+players, round)
+				recorder = postMove(server, shared.ID, body)
+				if recorder.Code != http.StatusCreated && recorder.Code != http.StatusConflict && recorder.Code != http.StatusPreconditionFailed {
+					t.Errorf("Expected a contested move to return 201, 409 or 412, got %d", recorder.Code)
+				}
+
+				for _, path := range []string{"/matches", "/matches/" + shared.ID, "/matches/" + own.ID + "/moves"} {
+					recorder = httptest.NewRecorder()
+					request, _ := http.NewRequest("GET", path, nil)
+					server.ServeHTTP(recorder, request)
+					if recorder.Code != http.StatusOK {
+						t.Errorf("Expected GET %s to return 200, got %d", path, recorder.Code)
+					}
+				}
+			}
+			moves, _ := repo.getMoves(own.ID)
+			if len(moves) != rounds {
+				t.Errorf("Expected %d moves on an unshared match, got %d", rounds, len(moves))
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	matches, _, _ := repo.findMatches(matchQuery{Limit: defaultPageSize})
+	if len(matches) != players+1 {
+		t.Errorf("Expected %d matches in the repository, got %d", players+1, len(matches))
+	}
+}
+
+func TestUpdateMatchRejectsStaleVersion(t *testing.T) {
+	match := gogo.NewMatch(19, "bob", "alfred")
+
+	repo := newInMemoryRepository()
+	repo.addMatch(match, matchSettings{})
+	state, err := repo.loadMatch(match.ID)
+	if err != nil {
+		t.Errorf("Error retrieving version: %s", err)
+	}
+	version := state.Version
+
+	move := matchMove{Player: gogo.PlayerBlack, Position: &gogo.Coordinate{X: 3, Y: 3}, Turn: 1}
+	match.TurnCount = 1
+	err = repo.updateMatch(match.ID, version, matchUpdate{Match: match, Status: matchStatusActive, Moves: []matchMove{move}})
+	if err != nil {
+		t.Errorf("Expected update against the current version to succeed, got %s", err)
+	}
+
+	match.TurnCount = 2
+	err = repo.updateMatch(match.ID, version, matchUpdate{Match: match, Status: matchStatusActive, Moves: []matchMove{move}})
+	if err != errVersionConflict {
+		t.Errorf("Expected update against a stale version to conflict, got %v", err)
+	}
+
+	current, _ := repo.loadMatch(match.ID)
+	if current.Match.TurnCount != 1 || len(current.Moves) != 1 || current.Version != version+1 {
+		t.Errorf("Conflicting update should leave the match untouched, got turn %d, %d moves, version %d", current.Match.TurnCount, len(current.Moves), current.Version)
+	}
+}
+
+func TestFindMatchesFiltersAndPages(t *testing.T) {
+	repo := newInMemoryRepository()
+	started := time.Now()
+	for i := 0; i < 5; i++ {
+		match := gogo.NewMatch(9, "bob", fmt.Sprintf("opponent%d", i))
+		match.StartTime = started.Add(time.Duration(i) * time.Minute)
+		repo.addMatch(match, matchSettings{})
+	}
+	other := gogo.NewMatch(19, "alice", "carol")
+	repo.addMatch(other, matchSettings{})
+
+	query := matchQuery{Player: "bob", Descending: true, Limit: 2}
+	var seen []string
+	for page := 0; page < 3; page++ {
+		matches, next, err := repo.findMatches(query)
+		if err != nil {
+			t.Fatalf("Unexpected error finding matches: %s", err)
+		}
+		for _, match := range matches {
+			seen = append(seen, match.Match.PlayerWhite)
+		}
+		if (next == "") != (page == 2) {
+			t.Errorf("Expected a next cursor on every page but the last, page %d had %q", page, next)
+		}
+		query.Cursor = next
+	}
+	expected := []string{"opponent4", "opponent3", "opponent2", "opponent1", "opponent0"}
+	if fmt.Sprint(seen) != fmt.Sprint(expected) {
+		t.Errorf("Expected bob's matches newest first, got %v", seen)
+	}
+
+	matches, _, _ := repo.findMatches(matchQuery{GridSize: 19, Limit: defaultPageSize})
+	if len(matches) != 1 || matches[0].Match.ID != other.ID {
+		t.Errorf("Expected only the 19x19 match, got %+v", matches)
+	}
+	matches, _, _ = repo.findMatches(matchQuery{Status: matchStatusFinished, Limit: defaultPageSize})
+	if len(matches) != 0 {
+		t.Errorf("Expected no finished matches, got %d", len(matches))
+	}
+	matches, _, _ = repo.findMatches(matchQuery{StartedAfter: started.Add(90 * time.Second), StartedBefore: started.Add(4 * time.Minute), Limit: defaultPageSize})
+	if len(matches) != 2 {
+		t.Errorf("Expected the 2 matches started within the range, got %d", len(matches))
+	}
+}
+
+func TestDeleteMatchRemovesItFromRepository(t *testing.T) {
+	repo := newInMemoryRepository()
+	first := gogo.NewMatch(9, "bob", "alfred")
+	second := gogo.NewMatch(9, "carol", "dave")
+	repo.addMatch(first, matchSettings{})
+	repo.addMatch(second, matchSettings{})
+
+	if err := repo.deleteMatch(first.ID); err != nil {
+		t.Errorf("Error deleting match: %s", err)
+	}
+	if _, err := repo.getMatch(first.ID); err == nil {
+		t.Error("Expected the deleted match to be gone")
+	}
+	matches, _, _ := repo.findMatches(matchQuery{Limit: defaultPageSize})
+	if len(matches) != 1 || matches[0].Match.ID != second.ID {
+		t.Errorf("Expected only the other match to remain, got %+v", matches)
+	}
+	if err := repo.deleteMatch(first.ID); err == nil {
+		t.Error("Expected deleting a missing match to fail")
+	}
+}
+
+func TestRewindMatchKeepsStartOfHistory(t *testing.T) {
+	match := gogo.NewMatch(9, "bob", "alfred")
+	repo := newInMemoryRepository()
+	repo.addMatch(match, matchSettings{})
+	moves := []matchMove{
+		{Player: gogo.PlayerBlack, Turn: 1},
+		{Player: gogo.PlayerWhite, Turn: 2},
+		{Player: gogo.PlayerBlack, Turn: 3},
+	}
+	repo.updateMatch(match.ID, 1, matchUpdate{Match: match, Status: matchStatusActive, Moves: moves})
+
+	if err := repo.rewindMatch(match.ID, 1, matchRewind{Keep: 1, Match: match, Status: matchStatusActive}); err != errVersionConflict {
+		t.Errorf("Expected a rewind against a stale version to conflict, got %v", err)
+	}
+	match.TurnCount = 1
+	if err := repo.rewindMatch(match.ID, 2, matchRewind{Keep: 1, Match: match, Status: matchStatusActive}); err != nil {
+		t.Errorf("Expected the rewind to succeed, got %v", err)
+	}
+
+	state, _ := repo.loadMatch(match.ID)
+	if len(state.Moves) != 1 || state.Moves[0].Turn != 1 || state.Version != 3 {
+		t.Errorf("Expected only the first move to remain at version 3, got %+v at version %d", state.Moves, state.Version)
+	}
+}
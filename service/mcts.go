@@ -0,0 +1,367 @@
+package service
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+const (
+	// defaultMCTSPlayouts caps the search of bot:mcts; its thinking time usually runs out first.
+	defaultMCTSPlayouts = 20000
+
+	// mctsExploration weighs trying rarely visited moves against replaying the best ones so far.
+	mctsExploration = 0.2
+
+	// raveEquivalence is the number of visits after which a move's own results and its
+	// all-moves-as-first results count equally.
+	raveEquivalence = 500
+
+	passPoint = -1
+)
+
+// mctsBot searches with Monte Carlo tree search: it grows a tree of moves using UCT, judging each
+// new position by the result of a random game played out from it. Random games are noisy, so
+// moves are also credited with the results of every playout in which they were played later on
+// (RAVE), which sorts out the promising moves after far fewer playouts. The search stops when its
+// thinking time is up or after the given number of playouts, whichever comes first.
+type mctsBot struct {
+	playouts int
+}
+
+func (mctsBot) searches() {}
+
+func (bot mctsBot) chooseMove(turn botTurn) (*gogo.Coordinate, bool) {
+	board := newPlayoutBoard(turn.Board.Positions)
+	root := newMCTSNode(passPoint, opponent(turn.Player), board)
+	for i := 0; i < bot.playouts && time.Now().Before(turn.Deadline); i++ {
+		position := board.clone()
+		path := []*mctsNode{root}
+		node := root
+		for len(node.untried) == 0 && len(node.children) > 0 {
+			node = node.bestChild()
+			position.play(node.player, node.move)
+			path = append(path, node)
+		}
+		if len(node.untried) > 0 {
+			pick := turn.Rand.Intn(len(node.untried))
+			move := node.untried[pick]
+			node.untried = append(node.untried[:pick], node.untried[pick+1:]...)
+			if !position.play(opponent(node.player), move) {
+				continue
+			}
+			child := newMCTSNode(move, opponent(node.player), position)
+			node.children = append(node.children, child)
+			path = append(path, child)
+		}
+		winner := position.playout(opponent(path[len(path)-1].player), turn.Komi, turn.Rand)
+		recordPlayout(path, position, winner)
+	}
+
+	// Fall back on the next most visited move should the engine know of a rule the playouts don't.
+	sort.Sort(byVisits(root.children))
+	for _, child := range root.children {
+		if child.move == passPoint {
+			return nil, false
+		}
+		point := board.coordinate(child.move)
+		if isLegal(turn.Board, turn.Player, point) {
+			return &point, false
+		}
+	}
+	// Without a single finished playout, say when the thinking time ran out straight away, passing
+	// could hand the opponent the match; a quick legal move keeps the game going instead.
+	return greedyCaptureBot{}.chooseMove(turn)
+}
+
+// recordPlayout credits the winner of the playout that ended in position to each node on the path
+// it took through the tree. The children of those nodes are also credited for every later move
+// of the playout that played their point first, and for the same player.
+func recordPlayout(path []*mctsNode, position *playoutBoard, winner byte) {
+	history := position.history
+	firstPlayer := make([]byte, len(position.points))
+	next := len(history)
+	for depth := len(path) - 1; depth >= 0; depth-- {
+		for ; next > depth; next-- {
+			if move := history[next-1]; move.point != passPoint {
+				firstPlayer[move.point] = move.player
+			}
+		}
+		node := path[depth]
+		node.visits++
+		if winner == node.player {
+			node.wins++
+		}
+		for _, child := range node.children {
+			if child.move != passPoint && firstPlayer[child.move] == child.player {
+				child.amafVisits++
+				if winner == child.player {
+					child.amafWins++
+				}
+			}
+		}
+	}
+}
+
+// mctsNode is a position in the search tree, reached by player playing move.
+type mctsNode struct {
+	move       int
+	player     byte
+	children   []*mctsNode
+	untried    []int
+	visits     int
+	wins       float64
+	amafVisits int
+	amafWins   float64
+}
+
+func newMCTSNode(move int, player byte, position *playoutBoard) *mctsNode {
+	return &mctsNode{
+		move:    move,
+		player:  player,
+		untried: append(position.candidates(opponent(player)), passPoint),
+	}
+}
+
+// bestChild picks the child with the highest upper confidence bound, blending in its
+// all-moves-as-first results while it has few visits of its own.
+func (node *mctsNode) bestChild() (best *mctsNode) {
+	bestScore := math.Inf(-1)
+	for _, child := range node.children {
+		visits := float64(child.visits)
+		value := child.wins / visits
+		if child.amafVisits > 0 {
+			beta := math.Sqrt(raveEquivalence / (3*visits + raveEquivalence))
+			value = (1-beta)*value + beta*child.amafWins/float64(child.amafVisits)
+		}
+		score := value + mctsExploration*math.Sqrt(math.Log(float64(node.visits))/visits)
+		if score > bestScore {
+			best, bestScore = child, score
+		}
+	}
+	return
+}
+
+type byVisits []*mctsNode
+
+func (nodes byVisits) Len() int           { return len(nodes) }
+func (nodes byVisits) Less(i, j int) bool { return nodes[i].visits > nodes[j].visits }
+func (nodes byVisits) Swap(i, j int)      { nodes[i], nodes[j] = nodes[j], nodes[i] }
+
+// playedMove is a move made on a playoutBoard.
+type playedMove struct {
+	point  int
+	player byte
+}
+
+// playoutBoard is a compact board for playouts, which need millions of cheap moves rather than
+// the engine's full rule checking. It knows about captures, suicide and simple ko only.
+type playoutBoard struct {
+	size   int
+	points []byte
+	ko     int
+	passes int
+	// adjacent lists the neighbours of each point. It never changes, so clones share it.
+	adjacent [][]int
+	// seen marks the points visited by the current flood fill: those equal to visit. stack is
+	// kept between fills to save allocating it every time.
+	seen  []int
+	visit int
+	stack []int
+	// history lists the moves played on the board since it was cloned.
+	history []playedMove
+}
+
+func newPlayoutBoard(positions [][]byte) *playoutBoard {
+	board := &playoutBoard{size: len(positions), ko: passPoint}
+	board.points = make([]byte, board.size*board.size)
+	board.seen = make([]int, len(board.points))
+	board.adjacent = make([][]int, len(board.points))
+	for point := range board.points {
+		x, y := point/board.size, point%board.size
+		if x > 0 {
+			board.adjacent[point] = append(board.adjacent[point], point-board.size)
+		}
+		if x < board.size-1 {
+			board.adjacent[point] = append(board.adjacent[point], point+board.size)
+		}
+		if y > 0 {
+			board.adjacent[point] = append(board.adjacent[point], point-1)
+		}
+		if y < board.size-1 {
+			board.adjacent[point] = append(board.adjacent[point], point+1)
+		}
+	}
+	for x := range positions {
+		for y, player := range positions[x] {
+			board.points[x*board.size+y] = player
+		}
+	}
+	return board
+}
+
+func (board *playoutBoard) clone() *playoutBoard {
+	copied := *board
+	copied.points = append([]byte(nil), board.points...)
+	copied.seen = make([]int, len(board.points))
+	copied.visit = 0
+	copied.stack = nil
+	copied.history = nil
+	return &copied
+}
+
+func (board *playoutBoard) coordinate(point int) gogo.Coordinate {
+	return gogo.Coordinate{X: point / board.size, Y: point % board.size}
+}
+
+// hasLiberty reports whether the chain holding point has at least one liberty, stopping as soon
+// as it finds one.
+func (board *playoutBoard) hasLiberty(point int) bool {
+	player := board.points[point]
+	board.visit++
+	board.seen[point] = board.visit
+	board.stack = append(board.stack[:0], point)
+	for len(board.stack) > 0 {
+		stone := board.stack[len(board.stack)-1]
+		board.stack = board.stack[:len(board.stack)-1]
+		for _, n := range board.adjacent[stone] {
+			switch {
+			case board.points[n] == 0:
+				return true
+			case board.points[n] == player && board.seen[n] != board.visit:
+				board.seen[n] = board.visit
+				board.stack = append(board.stack, n)
+			}
+		}
+	}
+	return false
+}
+
+// removeChain takes the chain holding point off the board, returning how many stones it had.
+func (board *playoutBoard) removeChain(point int) (removed int) {
+	player := board.points[point]
+	board.points[point] = 0
+	board.stack = append(board.stack[:0], point)
+	for len(board.stack) > 0 {
+		stone := board.stack[len(board.stack)-1]
+		board.stack = board.stack[:len(board.stack)-1]
+		removed++
+		for _, n := range board.adjacent[stone] {
+			if board.points[n] == player {
+				board.points[n] = 0
+				board.stack = append(board.stack, n)
+			}
+		}
+	}
+	return
+}
+
+// isEye reports whether point is an empty point surrounded by the player's stones.
+func (board *playoutBoard) isEye(player byte, point int) bool {
+	if board.points[point] != 0 {
+		return false
+	}
+	for _, n := range board.adjacent[point] {
+		if board.points[n] != player {
+			return false
+		}
+	}
+	return true
+}
+
+// play places a stone, or passes when point is passPoint, reporting whether the move was legal.
+func (board *playoutBoard) play(player byte, point int) bool {
+	if point == passPoint {
+		board.ko = passPoint
+		board.passes++
+		board.history = append(board.history, playedMove{point: passPoint, player: player})
+		return true
+	}
+	if board.points[point] != 0 || point == board.ko {
+		return false
+	}
+	board.points[point] = player
+	captured, lastCaptured := 0, passPoint
+	for _, n := range board.adjacent[point] {
+		if board.points[n] == opponent(player) && !board.hasLiberty(n) {
+			captured += board.removeChain(n)
+			lastCaptured = n
+		}
+	}
+	if !board.hasLiberty(point) {
+		board.points[point] = 0
+		return false
+	}
+	// Taking a single stone with a lone stone that is left in atari starts a ko.
+	board.ko = passPoint
+	if captured == 1 && board.isKoShape(player, point) {
+		board.ko = lastCaptured
+	}
+	board.passes = 0
+	board.history = append(board.history, playedMove{point: point, player: player})
+	return true
+}
+
+// isKoShape reports whether the stone at point has no friendly neighbours and a single liberty.
+func (board *playoutBoard) isKoShape(player byte, point int) bool {
+	liberties := 0
+	for _, n := range board.adjacent[point] {
+		switch board.points[n] {
+		case player:
+			return false
+		case 0:
+			liberties++
+		}
+	}
+	return liberties == 1
+}
+
+// candidates lists the empty points worth trying for player: everything but its own eyes.
+func (board *playoutBoard) candidates(player byte) (points []int) {
+	for point := range board.points {
+		if board.points[point] == 0 && !board.isEye(player, point) {
+			points = append(points, point)
+		}
+	}
+	return
+}
+
+// playout plays random moves, never filling a player's own eyes, until both players pass, and
+// returns the winner by area scoring.
+func (board *playoutBoard) playout(player byte, komi float64, r *rand.Rand) byte {
+	for moves := 0; board.passes < 2 && moves < 3*len(board.points); moves++ {
+		candidates := board.candidates(player)
+		played := false
+		for len(candidates) > 0 && !played {
+			pick := r.Intn(len(candidates))
+			played = board.play(player, candidates[pick])
+			candidates[pick] = candidates[len(candidates)-1]
+			candidates = candidates[:len(candidates)-1]
+		}
+		if !played {
+			board.play(player, passPoint)
+		}
+		player = opponent(player)
+	}
+	if board.areaScore() > komi {
+		return gogo.PlayerBlack
+	}
+	return gogo.PlayerWhite
+}
+
+// areaScore counts black's stones and eyes less white's. Playouts end with every other empty
+// point filled, so nothing else needs scoring.
+func (board *playoutBoard) areaScore() (score float64) {
+	for point, player := range board.points {
+		switch {
+		case player == gogo.PlayerBlack || board.isEye(gogo.PlayerBlack, point):
+			score++
+		case player == gogo.PlayerWhite || board.isEye(gogo.PlayerWhite, point):
+			score--
+		}
+	}
+	return
+}
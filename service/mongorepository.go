@@ -8,34 +8,190 @@ import (
 	"github.com/cloudnativego/cfmgo"
 	"github.com/cloudnativego/cfmgo/params"
 	"github.com/cloudnativego/gogo-engine"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
+// recordTimeLayout is how start times are stored for filtering and sorting, as server-local wall clock
+// strings. It sorts lexically in chronological order, which lets range filters and sorting on
+// start_time run inside Mongo. The start time itself is kept as a BSON date in started_at, since the
+// string carries neither the zone nor anything finer than a second.
+const recordTimeLayout = "2006-01-02 15:04:05"
+
+var errMongoMatchNotFound = errors.New("Match not found")
+
+// remover is implemented by collections that can delete records. cfmgo has no call for it, so the
+// live collection is a mgoCollection, which deletes through mgo.
+type remover interface {
+	Remove(selector interface{}) error
+}
+
+// mgoCollection is the cfmgo collection the repository reads and writes through, paired with the
+// mgo collection of the same name for what cfmgo does not offer.
+type mgoCollection struct {
+	cfmgo.Collection
+	direct *mgo.Collection
+}
+
+var (
+	_ remover = mgoCollection{}
+	_ indexer = mgoCollection{}
+)
+
+// dialMatchCollection connects to the matches collection both through cfmgo and directly through mgo.
+func dialMatchCollection(uri string) (col mgoCollection, err error) {
+	session, err := mgo.Dial(uri)
+	if err != nil {
+		return col, err
+	}
+	// An empty name picks the database named in the URI, as cfmgo does.
+	col.direct = session.DB("").C(MatchesCollectionName)
+	col.Collection = cfmgo.Connect(cfmgo.NewCollectionDialer, uri, MatchesCollectionName)
+	return col, nil
+}
+
+func (col mgoCollection) Remove(selector interface{}) error {
+	return col.direct.Remove(selector)
+}
+
+func (col mgoCollection) EnsureIndex(index mgo.Index) error {
+	return col.direct.EnsureIndex(index)
+}
+
+// indexer is implemented by collections that can create indexes: the fakes used in tests and the
+// live mgoCollection. Without it match IDs would not be kept unique, so a collection lacking it is
+// reported when the repository is created.
+type indexer interface {
+	EnsureIndex(index mgo.Index) error
+}
+
 type mongoMatchRepository struct {
 	Collection cfmgo.Collection
 }
 
 type matchRecord struct {
-	RecordID    bson.ObjectId `bson:"_id,omitempty" json:"id"`
-	MatchID     string        `bson:"match_id",json:"match_id"`
-	TurnCount   int           `bson:"turn_count",json:"turn_count"`
-	GridSize    int           `bson:"grid_size",json:"grid_size"`
-	StartTime   string        `bson:"start_time",json:"start_time"`
-	GameBoard   [][]byte      `bson:"game_board",json:"game_board"`
-	PlayerBlack string        `bson:"player_black",json:"player_black"`
-	PlayerWhite string        `bson:"player_white",json:"player_white"`
+	RecordID      bson.ObjectId      `bson:"_id,omitempty" json:"id"`
+	MatchID       string             `bson:"match_id" json:"match_id"`
+	TurnCount     int                `bson:"turn_count" json:"turn_count"`
+	GridSize      int                `bson:"grid_size" json:"grid_size"`
+	StartTime     string             `bson:"start_time" json:"start_time"`
+	StartedAt     *time.Time         `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	GameBoard     [][]byte           `bson:"game_board" json:"game_board"`
+	PlayerBlack   string             `bson:"player_black" json:"player_black"`
+	PlayerWhite   string             `bson:"player_white" json:"player_white"`
+	Komi          float64            `bson:"komi" json:"komi"`
+	Handicap      int                `bson:"handicap" json:"handicap"`
+	BlackSeatHash string             `bson:"black_seat_hash" json:"black_seat_hash"`
+	WhiteSeatHash string             `bson:"white_seat_hash" json:"white_seat_hash"`
+	BotThinkingMS int64              `bson:"bot_thinking_ms,omitempty" json:"bot_thinking_ms,omitempty"`
+	BotSeed       int64              `bson:"bot_seed,omitempty" json:"bot_seed,omitempty"`
+	TimeControl   *timeControlRecord `bson:"time_control,omitempty" json:"time_control,omitempty"`
+	UndoRequest   *undoRecord        `bson:"undo_request,omitempty" json:"undo_request,omitempty"`
+	Undos         []undoneRecord     `bson:"undos,omitempty" json:"undos,omitempty"`
+	Moves         []moveRecord       `bson:"moves,omitempty" json:"moves,omitempty"`
+	Status        string             `bson:"status" json:"status"`
+	Version       int                `bson:"version" json:"version"`
+	Deadline      *time.Time         `bson:"deadline,omitempty" json:"deadline,omitempty"`
+	UpdatedAt     time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+type moveRecord struct {
+	Player    byte             `bson:"player" json:"player"`
+	Position  *gogo.Coordinate `bson:"position,omitempty" json:"position,omitempty"`
+	Turn      int              `bson:"turn" json:"turn"`
+	Captures  int              `bson:"captures" json:"captures"`
+	Resigned  bool             `bson:"resigned,omitempty" json:"resigned,omitempty"`
+	TimedOut  bool             `bson:"timed_out,omitempty" json:"timed_out,omitempty"`
+	Timestamp time.Time        `bson:"timestamp" json:"timestamp"`
+	Version   int              `bson:"version" json:"version"`
+}
+
+// timeControlRecord stores a match's time control, with times in milliseconds.
+type timeControlRecord struct {
+	System       string `bson:"system" json:"system"`
+	MainTimeMS   int64  `bson:"main_time_ms" json:"main_time_ms"`
+	IncrementMS  int64  `bson:"increment_ms,omitempty" json:"increment_ms,omitempty"`
+	Periods      int    `bson:"periods,omitempty" json:"periods,omitempty"`
+	PeriodTimeMS int64  `bson:"period_time_ms,omitempty" json:"period_time_ms,omitempty"`
+	PeriodStones int    `bson:"period_stones,omitempty" json:"period_stones,omitempty"`
+}
+
+// undoRecord stores a pending request to take moves back.
+type undoRecord struct {
+	Player      byte      `bson:"player" json:"player"`
+	Keep        int       `bson:"keep" json:"keep"`
+	RequestedAt time.Time `bson:"requested_at" json:"requested_at"`
+}
+
+// undoneRecord stores an undo that was granted.
+type undoneRecord struct {
+	Version int       `bson:"version" json:"version"`
+	Keep    int       `bson:"keep" json:"keep"`
+	At      time.Time `bson:"at" json:"at"`
 }
 
 func newMongoMatchRepository(col cfmgo.Collection) (repo *mongoMatchRepository) {
 	repo = &mongoMatchRepository{
 		Collection: col,
 	}
+	err := repo.ensureIndexes()
+	if err != nil {
+		fmt.Printf("Error ensuring indexes on the matches collection: %v\n", err)
+	}
+	return
+}
+
+// ensureIndexes makes match_id unique, so every per-move update can address a single match
+// directly instead of scanning the collection, and indexes the clock deadlines the sweeper looks
+// for. Only matches with a running clock carry a deadline, so indexing that field alone keeps the
+// index sparse; a compound index would still hold every match that has a status.
+func (r *mongoMatchRepository) ensureIndexes() (err error) {
+	col, ok := r.Collection.(indexer)
+	if !ok {
+		return errors.New("Collection cannot create indexes; match IDs are not enforced to be unique")
+	}
+	r.Collection.Wake()
+	err = col.EnsureIndex(mgo.Index{Key: []string{"match_id"}, Unique: true})
+	if err == nil {
+		err = col.EnsureIndex(mgo.Index{Key: []string{"deadline"}, Sparse: true})
+	}
 	return
 }
 
-func (r *mongoMatchRepository) addMatch(match gogo.Match) (err error) {
+func (r *mongoMatchRepository) addMatch(match gogo.Match, settings matchSettings) (err error) {
+	return r.importMatch(match, settings, nil)
+}
+
+// importMatch writes the match record with its whole history in a single upsert.
+func (r *mongoMatchRepository) importMatch(match gogo.Match, settings matchSettings, moves []matchMove) (err error) {
 	r.Collection.Wake()
 	mr := convertMatchToMatchRecord(match)
+	mr.Komi = settings.Komi
+	mr.Handicap = settings.Handicap
+	mr.BlackSeatHash = settings.BlackSeatHash
+	mr.WhiteSeatHash = settings.WhiteSeatHash
+	mr.BotThinkingMS = int64(settings.BotThinkingTime / time.Millisecond)
+	mr.BotSeed = settings.BotSeed
+	if tc := settings.TimeControl; tc.System != "" {
+		mr.TimeControl = &timeControlRecord{
+			System:       tc.System,
+			MainTimeMS:   int64(tc.MainTime / time.Millisecond),
+			IncrementMS:  int64(tc.Increment / time.Millisecond),
+			Periods:      tc.Periods,
+			PeriodTimeMS: int64(tc.PeriodTime / time.Millisecond),
+			PeriodStones: tc.PeriodStones,
+		}
+	}
+	for idx, move := range moves {
+		move.Version = idx + 2
+		mr.Moves = append(mr.Moves, convertMoveToMoveRecord(move))
+	}
+	mr.Status = matchStatus(moves)
+	mr.Version = 1 + len(moves)
+	mr.UpdatedAt = time.Now()
+	if deadline := clockDeadline(settings, match.StartTime, moves, nil); !deadline.IsZero() {
+		mr.Deadline = &deadline
+	}
 	_, err = r.Collection.UpsertID(mr.RecordID, mr)
 	return
 }
@@ -49,26 +205,236 @@ func (r *mongoMatchRepository) getMatch(id string) (match gogo.Match, err error)
 	return
 }
 
-func (r *mongoMatchRepository) getMatches() (matches []gogo.Match, err error) {
+// loadMatch converts a single match record, so the parts of the state cannot come from different
+// versions of the match.
+func (r *mongoMatchRepository) loadMatch(id string) (state matchState, err error) {
+	r.Collection.Wake()
+	foundMatch, err := r.getMongoMatch(id)
+	if err == nil {
+		state = convertMatchRecordToState(foundMatch)
+	}
+	return
+}
+
+func (r *mongoMatchRepository) findMatches(query matchQuery) (matches []matchState, next string, err error) {
+	r.Collection.Wake()
+	selector, err := matchQuerySelector(query)
+	if err != nil {
+		return
+	}
+	direction := ""
+	if query.Descending {
+		direction = "-"
+	}
+	params := &params.RequestParams{
+		Q: selector,
+		S: []string{direction + "start_time", direction + "match_id"},
+		L: query.Limit + 1,
+	}
+
+	var mr []matchRecord
+	_, err = r.Collection.Find(params, &mr)
+	if err == nil {
+		if len(mr) > query.Limit {
+			mr = mr[:query.Limit]
+			next = encodeCursor(cursorFor(convertMatchRecordToMatch(mr[len(mr)-1])))
+		}
+		matches = make([]matchState, len(mr))
+		for k, v := range mr {
+			matches[k] = convertMatchRecordToState(v)
+		}
+	}
+	return
+}
+
+// findExpiredMatches asks Mongo for the active matches past their deadline, which the sparse index
+// on deadline answers without scanning the matches that still have time or have none.
+func (r *mongoMatchRepository) findExpiredMatches(now time.Time) (matches []matchState, err error) {
 	r.Collection.Wake()
+	params := &params.RequestParams{
+		Q: bson.M{"status": matchStatusActive, "deadline": bson.M{"$lte": now}},
+	}
 	var mr []matchRecord
-	_, err = r.Collection.Find(cfmgo.ParamsUnfiltered, &mr)
+	_, err = r.Collection.Find(params, &mr)
 	if err == nil {
-		matches = make([]gogo.Match, len(mr))
+		matches = make([]matchState, len(mr))
 		for k, v := range mr {
-			matches[k] = convertMatchRecordToMatch(v)
+			matches[k] = convertMatchRecordToState(v)
+		}
+	}
+	return
+}
+
+// matchQuerySelector translates a matchQuery, including the position of its cursor, into a Mongo
+// selector. Start times are filtered on as server-local wall clock strings, so bounds and cursor
+// positions are converted to local time before formatting.
+func matchQuerySelector(query matchQuery) (selector bson.M, err error) {
+	conditions := []bson.M{}
+	if query.Player != "" {
+		conditions = append(conditions, bson.M{"$or": []bson.M{
+			{"player_black": query.Player},
+			{"player_white": query.Player},
+		}})
+	}
+	if query.GridSize != 0 {
+		conditions = append(conditions, bson.M{"grid_size": query.GridSize})
+	}
+	if query.Status != "" {
+		conditions = append(conditions, bson.M{"status": query.Status})
+	}
+	if !query.StartedAfter.IsZero() {
+		conditions = append(conditions, bson.M{"start_time": bson.M{"$gte": query.StartedAfter.Local().Format(recordTimeLayout)}})
+	}
+	if !query.StartedBefore.IsZero() {
+		conditions = append(conditions, bson.M{"start_time": bson.M{"$lt": query.StartedBefore.Local().Format(recordTimeLayout)}})
+	}
+	if query.Cursor != "" {
+		cursor, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		started := cursor.Started.Local().Format(recordTimeLayout)
+		operator := "$gt"
+		if query.Descending {
+			operator = "$lt"
 		}
+		conditions = append(conditions, bson.M{"$or": []bson.M{
+			{"start_time": bson.M{operator: started}},
+			{"start_time": started, "match_id": bson.M{operator: cursor.ID}},
+		}})
+	}
+
+	selector = bson.M{}
+	if len(conditions) > 0 {
+		selector["$and"] = conditions
+	}
+	return
+}
+
+// updateMatch writes the board and appends the moves in a single FindAndModify that only matches the
+// expected version, so a concurrent writer makes it miss rather than be overwritten.
+func (r *mongoMatchRepository) updateMatch(id string, version int, update matchUpdate) (err error) {
+	r.Collection.Wake()
+	records := make([]moveRecord, len(update.Moves))
+	for k, v := range update.Moves {
+		v.Version = version + 1
+		records[k] = convertMoveToMoveRecord(v)
+	}
+	selector := bson.M{"match_id": id, "version": version}
+	change := bson.M{
+		"$set": bson.M{
+			"turn_count":   update.Match.TurnCount,
+			"game_board":   update.Match.GameBoard.Positions,
+			"status":       update.Status,
+			"undo_request": nil,
+			"updated_at":   time.Now(),
+		},
+		"$push": bson.M{"moves": bson.M{"$each": records}},
+		"$inc":  bson.M{"version": 1},
+	}
+	setDeadline(change, update.Deadline)
+	var updated matchRecord
+	_, err = r.Collection.FindAndModify(selector, change, &updated)
+	if err == mgo.ErrNotFound {
+		err = errVersionConflict
+	}
+	return
+}
+
+// rewindMatch truncates the stored history in the same conditional FindAndModify that updates
+// the board and records the undo, pushing nothing with $slice so only the first keep moves remain.
+func (r *mongoMatchRepository) rewindMatch(id string, version int, rewind matchRewind) (err error) {
+	r.Collection.Wake()
+	selector := bson.M{"match_id": id, "version": version}
+	change := bson.M{
+		"$set": bson.M{
+			"turn_count":   rewind.Match.TurnCount,
+			"game_board":   rewind.Match.GameBoard.Positions,
+			"status":       rewind.Status,
+			"undo_request": nil,
+			"updated_at":   time.Now(),
+		},
+		"$push": bson.M{
+			"moves": bson.M{"$each": []moveRecord{}, "$slice": rewind.Keep},
+			"undos": undoneRecord{Version: version + 1, Keep: rewind.Keep, At: rewind.At},
+		},
+		"$inc": bson.M{"version": 1},
+	}
+	setDeadline(change, rewind.Deadline)
+	var updated matchRecord
+	_, err = r.Collection.FindAndModify(selector, change, &updated)
+	if err == mgo.ErrNotFound {
+		err = errVersionConflict
+	}
+	return
+}
+
+// setDeadline adds the clock deadline to a change, removing the field while no clock is running so
+// that the match drops out of the deadline index.
+func setDeadline(change bson.M, deadline time.Time) {
+	if deadline.IsZero() {
+		change["$unset"] = bson.M{"deadline": ""}
+		return
+	}
+	change["$set"].(bson.M)["deadline"] = deadline
+}
+
+// setUndoRequest sets or clears the pending undo request in a conditional FindAndModify, so that
+// it cannot be granted against a match that moved on in the meantime.
+func (r *mongoMatchRepository) setUndoRequest(id string, version int, request *undoRequest) (err error) {
+	r.Collection.Wake()
+	var record *undoRecord
+	if request != nil {
+		record = &undoRecord{Player: request.Player, Keep: request.Keep, RequestedAt: request.RequestedAt}
+	}
+	selector := bson.M{"match_id": id, "version": version}
+	change := bson.M{
+		"$set": bson.M{"undo_request": record, "updated_at": time.Now()},
+		"$inc": bson.M{"version": 1},
+	}
+	var updated matchRecord
+	_, err = r.Collection.FindAndModify(selector, change, &updated)
+	if err == mgo.ErrNotFound {
+		err = errVersionConflict
 	}
 	return
 }
 
-func (r *mongoMatchRepository) updateMatch(id string, match gogo.Match) (err error) {
+// setKomi changes the komi in a conditional FindAndModify, so a match that has seen a move in the
+// meantime keeps the komi it was played with.
+func (r *mongoMatchRepository) setKomi(id string, version int, komi float64) (err error) {
+	r.Collection.Wake()
+	selector := bson.M{"match_id": id, "version": version}
+	change := bson.M{
+		"$set": bson.M{"komi": komi, "updated_at": time.Now()},
+		"$inc": bson.M{"version": 1},
+	}
+	var updated matchRecord
+	_, err = r.Collection.FindAndModify(selector, change, &updated)
+	if err == mgo.ErrNotFound {
+		err = errVersionConflict
+	}
+	return
+}
+
+func (r *mongoMatchRepository) getMoves(id string) (moves []matchMove, err error) {
 	r.Collection.Wake()
 	foundMatch, err := r.getMongoMatch(id)
 	if err == nil {
-		mr := convertMatchToMatchRecord(match)
-		mr.RecordID = foundMatch.RecordID
-		_, err = r.Collection.UpsertID(mr.RecordID, mr)
+		moves = convertMoveRecordsToMoves(foundMatch.Moves)
+	}
+	return
+}
+
+func (r *mongoMatchRepository) deleteMatch(id string) (err error) {
+	col, ok := r.Collection.(remover)
+	if !ok {
+		return errors.New("Deleting matches is not supported by this collection")
+	}
+	r.Collection.Wake()
+	err = col.Remove(bson.M{"match_id": id})
+	if err == mgo.ErrNotFound {
+		err = errMongoMatchNotFound
 	}
 	return
 }
@@ -82,7 +448,7 @@ func (r *mongoMatchRepository) getMongoMatch(id string) (mongoMatch matchRecord,
 
 	count, err := r.Collection.Find(params, &matches)
 	if count == 0 {
-		err = errors.New("Match not found")
+		err = errMongoMatchNotFound
 	}
 	if err == nil {
 		mongoMatch = matches[0]
@@ -91,12 +457,14 @@ func (r *mongoMatchRepository) getMongoMatch(id string) (mongoMatch matchRecord,
 }
 
 func convertMatchToMatchRecord(m gogo.Match) (mr *matchRecord) {
+	started := m.StartTime
 	mr = &matchRecord{
 		RecordID:    bson.NewObjectId(),
 		MatchID:     m.ID,
 		TurnCount:   m.TurnCount,
 		GridSize:    m.GridSize,
-		StartTime:   m.StartTime.Format("2006-01-02 15:04:05"),
+		StartTime:   m.StartTime.Local().Format(recordTimeLayout),
+		StartedAt:   &started,
 		GameBoard:   m.GameBoard.Positions,
 		PlayerBlack: m.PlayerBlack,
 		PlayerWhite: m.PlayerWhite,
@@ -104,8 +472,26 @@ func convertMatchToMatchRecord(m gogo.Match) (mr *matchRecord) {
 	return
 }
 
+func convertMoveToMoveRecord(move matchMove) moveRecord {
+	return moveRecord{
+		Player:    move.Player,
+		Position:  move.Position,
+		Turn:      move.Turn,
+		Captures:  move.Captures,
+		Resigned:  move.Resigned,
+		TimedOut:  move.TimedOut,
+		Timestamp: move.Timestamp,
+		Version:   move.Version,
+	}
+}
+
+// convertMatchRecordToMatch reads the start time from started_at. Records written before it was
+// stored only have the wall clock string, which is read back in the server's zone it was written in.
 func convertMatchRecordToMatch(mr matchRecord) (m gogo.Match) {
-	t, err := time.Parse("2006-01-02 15:04:05", mr.StartTime)
+	t, err := time.ParseInLocation(recordTimeLayout, mr.StartTime, time.Local)
+	if mr.StartedAt != nil {
+		t, err = *mr.StartedAt, nil
+	}
 	if err != nil {
 		fmt.Printf("Error parsing time value in Match Record: %v", err)
 	} else {
@@ -121,3 +507,63 @@ func convertMatchRecordToMatch(mr matchRecord) (m gogo.Match) {
 	}
 	return
 }
+
+func convertMoveRecordsToMoves(records []moveRecord) (moves []matchMove) {
+	moves = make([]matchMove, len(records))
+	for k, v := range records {
+		moves[k] = matchMove{
+			Player:    v.Player,
+			Position:  v.Position,
+			Turn:      v.Turn,
+			Captures:  v.Captures,
+			Resigned:  v.Resigned,
+			TimedOut:  v.TimedOut,
+			Timestamp: v.Timestamp,
+			Version:   v.Version,
+		}
+	}
+	return
+}
+
+func convertMatchRecordToSettings(mr matchRecord) (settings matchSettings) {
+	settings = matchSettings{
+		Komi:            mr.Komi,
+		Handicap:        mr.Handicap,
+		BlackSeatHash:   mr.BlackSeatHash,
+		WhiteSeatHash:   mr.WhiteSeatHash,
+		BotThinkingTime: time.Duration(mr.BotThinkingMS) * time.Millisecond,
+		BotSeed:         mr.BotSeed,
+	}
+	if tc := mr.TimeControl; tc != nil {
+		settings.TimeControl = timeControl{
+			System:       tc.System,
+			MainTime:     time.Duration(tc.MainTimeMS) * time.Millisecond,
+			Increment:    time.Duration(tc.IncrementMS) * time.Millisecond,
+			Periods:      tc.Periods,
+			PeriodTime:   time.Duration(tc.PeriodTimeMS) * time.Millisecond,
+			PeriodStones: tc.PeriodStones,
+		}
+	}
+	return
+}
+
+func convertMatchRecordToState(mr matchRecord) (state matchState) {
+	state = matchState{
+		Version:   mr.Version,
+		Match:     convertMatchRecordToMatch(mr),
+		Settings:  convertMatchRecordToSettings(mr),
+		Moves:     convertMoveRecordsToMoves(mr.Moves),
+		UpdatedAt: mr.UpdatedAt,
+	}
+	if mr.UndoRequest != nil {
+		state.Undo = &undoRequest{
+			Player:      mr.UndoRequest.Player,
+			Keep:        mr.UndoRequest.Keep,
+			RequestedAt: mr.UndoRequest.RequestedAt,
+		}
+	}
+	for _, v := range mr.Undos {
+		state.Undos = append(state.Undos, matchUndo{Version: v.Version, Keep: v.Keep, At: v.At})
+	}
+	return
+}
@@ -1,11 +1,16 @@
 package service
 
 import (
+	"encoding/json"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/cloudnativego/cfmgo"
+	"github.com/cloudnativego/cfmgo/params"
 	"github.com/cloudnativego/gogo-engine"
 	"github.com/cloudnativego/gogo-service/fakes"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var (
@@ -21,12 +26,12 @@ func TestAddMatchShowsUpInMongoRepository(t *testing.T) {
 
 	repo := newMongoMatchRepository(matchesCollection)
 	match := gogo.NewMatch(19, "bob", "alfred")
-	err := repo.addMatch(match)
+	err := repo.addMatch(match, matchSettings{})
 	if err != nil {
 		t.Errorf("Error adding match to mongo: %v", err)
 	}
 
-	matches, err := repo.getMatches()
+	matches, _, err := repo.findMatches(matchQuery{Limit: defaultPageSize})
 	if err != nil {
 		t.Errorf("Got an error retrieving matches: %v", err)
 	}
@@ -45,7 +50,7 @@ func TestGetMatchRetrievesProperMatchFromMongo(t *testing.T) {
 
 	repo := newMongoMatchRepository(matchesCollection)
 	match := gogo.NewMatch(19, "bob", "alfred")
-	err := repo.addMatch(match)
+	err := repo.addMatch(match, matchSettings{})
 	if err != nil {
 		t.Errorf("Error adding match to mongo: %v", err)
 	}
@@ -80,3 +85,470 @@ func TestGetNonExistentMatchReturnsError(t *testing.T) {
 		t.Errorf("Expected 'Match not found' error; received: '%v'", err)
 	}
 }
+
+func TestAddMoveShowsUpInMongoMoveHistory(t *testing.T) {
+	fakes.TargetCount = 1
+	var fakeMatches = []matchRecord{}
+	var matchesCollection = cfmgo.Connect(
+		fakes.FakeNewCollectionDialer(fakeMatches),
+		fakeDBURI,
+		MatchesCollectionName)
+
+	repo := newMongoMatchRepository(matchesCollection)
+	match := gogo.NewMatch(19, "bob", "alfred")
+	err := repo.addMatch(match, matchSettings{})
+	if err != nil {
+		t.Errorf("Error adding match to mongo: %v", err)
+	}
+
+	move := matchMove{Player: gogo.PlayerBlack, Position: &gogo.Coordinate{X: 4, Y: 10}, Turn: 1}
+	err = repo.updateMatch(match.ID, 1, matchUpdate{Match: match, Status: matchStatusActive, Moves: []matchMove{move}})
+	if err != nil {
+		t.Errorf("Error adding move to mongo: %v", err)
+	}
+
+	moves, err := repo.getMoves(match.ID)
+	if err != nil {
+		t.Errorf("Error retrieving moves from mongo: %v", err)
+	}
+	if len(moves) != 1 {
+		t.Fatalf("Expected 1 move in history; received %d", len(moves))
+	}
+	if moves[0].Position == nil || moves[0].Position.X != 4 || moves[0].Position.Y != 10 {
+		t.Errorf("Unexpected move in history: %+v", moves[0])
+	}
+}
+
+func TestSettingsAreStoredInMongo(t *testing.T) {
+	fakes.TargetCount = 1
+	var fakeMatches = []matchRecord{}
+	var matchesCollection = cfmgo.Connect(
+		fakes.FakeNewCollectionDialer(fakeMatches),
+		fakeDBURI,
+		MatchesCollectionName)
+
+	repo := newMongoMatchRepository(matchesCollection)
+	match := gogo.NewMatch(19, "bob", "alfred")
+	err := repo.addMatch(match, matchSettings{Komi: 7.5, Handicap: 3, BlackSeatHash: "b", WhiteSeatHash: "w", BotThinkingTime: 250 * time.Millisecond, BotSeed: 42,
+		TimeControl: timeControl{System: timeByoyomi, MainTime: 10 * time.Minute, Periods: 5, PeriodTime: 30 * time.Second}})
+	if err != nil {
+		t.Errorf("Error adding match to mongo: %v", err)
+	}
+
+	state, err := repo.loadMatch(match.ID)
+	if err != nil {
+		t.Errorf("Error retrieving settings from mongo: %v", err)
+	}
+	settings := state.Settings
+	if settings.Komi != 7.5 {
+		t.Errorf("Expected komi of 7.5; received %v", settings.Komi)
+	}
+	if settings.Handicap != 3 {
+		t.Errorf("Expected handicap of 3; received %d", settings.Handicap)
+	}
+	if settings.BlackSeatHash != "b" || settings.WhiteSeatHash != "w" {
+		t.Errorf("Expected seat hashes to round trip; received %+v", settings)
+	}
+	if settings.BotThinkingTime != 250*time.Millisecond || settings.BotSeed != 42 {
+		t.Errorf("Expected bot settings to round trip; received %+v", settings)
+	}
+	if settings.TimeControl != (timeControl{System: timeByoyomi, MainTime: 10 * time.Minute, Periods: 5, PeriodTime: 30 * time.Second}) {
+		t.Errorf("Expected the time control to round trip; received %+v", settings.TimeControl)
+	}
+}
+
+func TestUpdateMatchInMongoRejectsStaleVersion(t *testing.T) {
+	fakes.TargetCount = 1
+	var fakeMatches = []matchRecord{}
+	var matchesCollection = cfmgo.Connect(
+		fakes.FakeNewCollectionDialer(fakeMatches),
+		fakeDBURI,
+		MatchesCollectionName)
+
+	repo := newMongoMatchRepository(matchesCollection)
+	match := gogo.NewMatch(19, "bob", "alfred")
+	repo.addMatch(match, matchSettings{})
+
+	state, err := repo.loadMatch(match.ID)
+	version := state.Version
+	if err != nil || version != 1 {
+		t.Errorf("Expected a new match to be at version 1, got %d (%v)", version, err)
+	}
+	err = repo.updateMatch(match.ID, version, matchUpdate{Match: match, Status: matchStatusActive, Moves: []matchMove{{Player: gogo.PlayerBlack, Turn: 1}}})
+	if err != nil {
+		t.Errorf("Error updating match in mongo: %v", err)
+	}
+	err = repo.updateMatch(match.ID, version, matchUpdate{Match: match, Status: matchStatusActive, Moves: []matchMove{{Player: gogo.PlayerBlack, Turn: 1}}})
+	if err != errVersionConflict {
+		t.Errorf("Expected update against a stale version to conflict, got %v", err)
+	}
+
+	moves, _ := repo.getMoves(match.ID)
+	if len(moves) != 1 {
+		t.Errorf("Expected exactly 1 move after the conflict, got %d", len(moves))
+	}
+}
+
+func TestMongoKeepsTheExactStartTimeForTheClocks(t *testing.T) {
+	fakes.TargetCount = 1
+	var matchesCollection = cfmgo.Connect(
+		fakes.FakeNewCollectionDialer([]matchRecord{}),
+		fakeDBURI,
+		MatchesCollectionName)
+
+	fake := matchesCollection.(*fakes.FakeCollection)
+
+	repo := newMongoMatchRepository(matchesCollection)
+	settings := matchSettings{TimeControl: timeControl{System: timeAbsolute, MainTime: time.Minute}}
+	match := gogo.NewMatch(9, "bob", "alfred")
+	match.StartTime = time.Now().Add(-59*time.Second - 700*time.Millisecond).Truncate(time.Millisecond).UTC()
+	repo.addMatch(match, settings)
+
+	state, _ := repo.loadMatch(match.ID)
+	if !state.Match.StartTime.Equal(match.StartTime) {
+		t.Errorf("Expected the match to start at %v, got %v", match.StartTime, state.Match.StartTime)
+	}
+	var stored []matchRecord
+	json.Unmarshal(fake.Data, &stored)
+	if deadline := clockDeadline(state.Settings, state.Match.StartTime, state.Moves, state.Undos); len(stored) != 1 || !stored[0].Deadline.Equal(deadline) {
+		t.Errorf("Expected the stored deadline to agree with the clocks, %v, got %+v", deadline, stored)
+	}
+	if _, expired := outOfTime(state.Settings, state.Match.StartTime, state.Moves, state.Undos, time.Now()); expired {
+		t.Error("Expected the clocks worked out from the stored start to agree that black is in time")
+	}
+}
+
+func TestLegacyStartTimesAreReadInTheServerZone(t *testing.T) {
+	started := time.Date(2016, 5, 1, 12, 0, 0, 0, time.Local)
+	match := convertMatchRecordToMatch(matchRecord{StartTime: started.Format(recordTimeLayout)})
+	if !match.StartTime.Equal(started) {
+		t.Errorf("Expected a start time stored without started_at to be read as local time %v, got %v", started, match.StartTime)
+	}
+}
+
+func TestImportMatchIntoMongoWritesOneRecord(t *testing.T) {
+	fakes.TargetCount = 1
+	var matchesCollection = cfmgo.Connect(
+		fakes.FakeNewCollectionDialer([]matchRecord{}),
+		fakeDBURI,
+		MatchesCollectionName)
+	fake := matchesCollection.(*fakes.FakeCollection)
+
+	repo := newMongoMatchRepository(matchesCollection)
+	match := gogo.NewMatch(9, "bob", "alfred")
+	match.TurnCount = 2
+	moves := []matchMove{
+		{Player: gogo.PlayerBlack, Position: &gogo.Coordinate{X: 4, Y: 4}, Turn: 1},
+		{Player: gogo.PlayerWhite, Resigned: true, Turn: 2},
+	}
+	fake.Operations = nil
+	if err := repo.importMatch(match, matchSettings{Komi: 6.5}, moves); err != nil {
+		t.Fatalf("Error importing match into mongo: %v", err)
+	}
+	if len(fake.Operations) != 1 || fake.Operations[0].Name != "UpsertID" {
+		t.Errorf("Expected the match and its moves to be written at once, got %+v", fake.Operations)
+	}
+	state, _ := repo.loadMatch(match.ID)
+	if state.Version != 3 || len(state.Moves) != 2 || !state.Moves[1].Resigned || state.Moves[1].Version != 3 || state.Settings.Komi != 6.5 {
+		t.Errorf("Expected the imported match at version 3 with its history, as if played move by move, got %+v", state)
+	}
+}
+
+func TestLoadMatchFromMongoReadsOneRecord(t *testing.T) {
+	fakes.TargetCount = 1
+	var matchesCollection = cfmgo.Connect(
+		fakes.FakeNewCollectionDialer([]matchRecord{}),
+		fakeDBURI,
+		MatchesCollectionName)
+	fake := matchesCollection.(*fakes.FakeCollection)
+
+	repo := newMongoMatchRepository(matchesCollection)
+	match := gogo.NewMatch(9, "bob", "alfred")
+	repo.addMatch(match, matchSettings{Komi: 6.5})
+	match.TurnCount = 1
+	repo.updateMatch(match.ID, 1, matchUpdate{Match: match, Status: matchStatusActive, Moves: []matchMove{{Player: gogo.PlayerBlack, Turn: 1}}})
+	repo.setUndoRequest(match.ID, 2, &undoRequest{Player: gogo.PlayerBlack})
+
+	fake.Operations = nil
+	state, err := repo.loadMatch(match.ID)
+	if err != nil {
+		t.Fatalf("Error loading match from mongo: %v", err)
+	}
+	if len(fake.Operations) != 1 || fake.Operations[0].Name != "Find" {
+		t.Errorf("Expected the whole match to come from a single Find, got %+v", fake.Operations)
+	}
+	if state.Version != 3 || state.Match.TurnCount != 1 || state.Settings.Komi != 6.5 || len(state.Moves) != 1 || state.Undo == nil {
+		t.Errorf("Expected every part of the match to be loaded, got %+v", state)
+	}
+}
+
+func TestUndoRequestsInMongoAreClearedByMoves(t *testing.T) {
+	fakes.TargetCount = 1
+	var matchesCollection = cfmgo.Connect(
+		fakes.FakeNewCollectionDialer([]matchRecord{}),
+		fakeDBURI,
+		MatchesCollectionName)
+
+	repo := newMongoMatchRepository(matchesCollection)
+	match := gogo.NewMatch(19, "bob", "alfred")
+	repo.addMatch(match, matchSettings{})
+	requestedAt := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := repo.setUndoRequest(match.ID, 1, &undoRequest{Player: gogo.PlayerWhite, Keep: 3, RequestedAt: requestedAt}); err != nil {
+		t.Fatalf("Error storing undo request in mongo: %v", err)
+	}
+	if err := repo.setUndoRequest(match.ID, 1, nil); err != errVersionConflict {
+		t.Errorf("Expected clearing the request against a stale version to conflict, got %v", err)
+	}
+	state, err := repo.loadMatch(match.ID)
+	request := state.Undo
+	if err != nil || request == nil || request.Player != gogo.PlayerWhite || request.Keep != 3 || !request.RequestedAt.Equal(requestedAt) {
+		t.Errorf("Expected the undo request to round trip, got %+v (%v)", request, err)
+	}
+
+	repo.updateMatch(match.ID, 2, matchUpdate{Match: match, Status: matchStatusActive, Moves: []matchMove{{Player: gogo.PlayerBlack, Turn: 1}}})
+	if state, _ = repo.loadMatch(match.ID); state.Undo != nil {
+		t.Errorf("Expected a move to clear the undo request, got %+v", state.Undo)
+	}
+}
+
+func TestMongoRepositoryEnsuresUniqueMatchIndex(t *testing.T) {
+	var matchesCollection = cfmgo.Connect(
+		fakes.FakeNewCollectionDialer([]matchRecord{}),
+		fakeDBURI,
+		MatchesCollectionName)
+
+	newMongoMatchRepository(matchesCollection)
+	indexes := matchesCollection.(*fakes.FakeCollection).Indexes
+	if len(indexes) != 2 || !indexes[0].Unique || len(indexes[0].Key) != 1 || indexes[0].Key[0] != "match_id" {
+		t.Errorf("Expected a unique index on match_id, got %+v", indexes)
+	}
+	if len(indexes) == 2 && (!indexes[1].Sparse || len(indexes[1].Key) != 1 || indexes[1].Key[0] != "deadline") {
+		t.Errorf("Expected a sparse index on deadline for the clock sweeper, got %+v", indexes[1])
+	}
+}
+
+func TestCollectionsThatCannotIndexAreReported(t *testing.T) {
+	var matchesCollection = cfmgo.Connect(
+		fakes.FakeNewCollectionDialer([]matchRecord{}),
+		fakeDBURI,
+		MatchesCollectionName)
+
+	// Embedding the interface hides every method of the fake beyond those of cfmgo.Collection.
+	repo := &mongoMatchRepository{Collection: struct{ cfmgo.Collection }{matchesCollection}}
+	if err := repo.ensureIndexes(); err == nil {
+		t.Error("Expected a collection that cannot create indexes to be reported")
+	}
+}
+
+func TestExpiredMatchesAreFoundByTheirStoredDeadline(t *testing.T) {
+	fakes.TargetCount = 1
+	var matchesCollection = cfmgo.Connect(
+		fakes.FakeNewCollectionDialer([]matchRecord{}),
+		fakeDBURI,
+		MatchesCollectionName)
+	fake := matchesCollection.(*fakes.FakeCollection)
+
+	repo := newMongoMatchRepository(matchesCollection)
+	match := gogo.NewMatch(9, "bob", "alfred")
+	settings := matchSettings{TimeControl: timeControl{System: timeAbsolute, MainTime: time.Minute}}
+	repo.addMatch(match, settings)
+	var stored []matchRecord
+	json.Unmarshal(fake.Data, &stored)
+	if len(stored) != 1 || stored[0].Deadline == nil || !stored[0].Deadline.Equal(match.StartTime.Add(time.Minute)) {
+		t.Fatalf("Expected the match to be stored with black's deadline, got %+v", stored)
+	}
+
+	now := time.Now()
+	fake.Operations = nil
+	if _, err := repo.findExpiredMatches(now); err != nil {
+		t.Fatalf("Error finding expired matches: %v", err)
+	}
+	if len(fake.Operations) != 1 || fake.Operations[0].Name != "Find" {
+		t.Fatalf("Expected a single query for expired matches, got %+v", fake.Operations)
+	}
+	selector := fake.Operations[0].Selector.(*params.RequestParams).Q.(bson.M)
+	if selector["status"] != matchStatusActive || !reflect.DeepEqual(selector["deadline"], bson.M{"$lte": now}) {
+		t.Errorf("Expected the query to select active matches past their deadline, got %+v", selector)
+	}
+
+	repo.updateMatch(match.ID, 1, matchUpdate{Match: match, Status: matchStatusFinished, Moves: []matchMove{{Player: gogo.PlayerBlack, Turn: 1, Resigned: true}}})
+	stored = nil
+	json.Unmarshal(fake.Data, &stored)
+	if stored[0].Deadline != nil {
+		t.Errorf("Expected a finished match to drop its deadline, got %v", stored[0].Deadline)
+	}
+}
+
+func TestUpdateMatchInMongoIssuesOneTargetedUpdate(t *testing.T) {
+	fakes.TargetCount = 1
+	var matchesCollection = cfmgo.Connect(
+		fakes.FakeNewCollectionDialer([]matchRecord{}),
+		fakeDBURI,
+		MatchesCollectionName)
+	fake := matchesCollection.(*fakes.FakeCollection)
+
+	repo := newMongoMatchRepository(matchesCollection)
+	match := gogo.NewMatch(19, "bob", "alfred")
+	repo.addMatch(match, matchSettings{Komi: 7.5})
+
+	fake.Operations = nil
+	match.TurnCount = 1
+	match.GameBoard.Positions[4][10] = gogo.PlayerBlack
+	err := repo.updateMatch(match.ID, 1, matchUpdate{Match: match, Status: matchStatusActive, Moves: []matchMove{{Player: gogo.PlayerBlack, Position: &gogo.Coordinate{X: 4, Y: 10}, Turn: 1}}})
+	if err != nil {
+		t.Errorf("Error updating match in mongo: %v", err)
+	}
+
+	if len(fake.Operations) != 1 || fake.Operations[0].Name != "FindAndModify" {
+		t.Fatalf("Expected a single FindAndModify per move, got %+v", fake.Operations)
+	}
+	selector := fake.Operations[0].Selector.(bson.M)
+	if selector["match_id"] != match.ID || selector["version"] != 1 {
+		t.Errorf("Expected the update to select the match at version 1, got %v", selector)
+	}
+	update := fake.Operations[0].Update.(bson.M)
+	for _, operator := range []string{"$set", "$push", "$inc"} {
+		if _, ok := update[operator]; !ok {
+			t.Errorf("Expected the update to use %s, got %v", operator, update)
+		}
+	}
+
+	state, _ := repo.loadMatch(match.ID)
+	found, settings, moves, version := state.Match, state.Settings, state.Moves, state.Version
+	if found.TurnCount != 1 || found.GameBoard.Positions[4][10] != gogo.PlayerBlack {
+		t.Errorf("Expected the board and turn to be updated in place, got %+v", found)
+	}
+	if settings.Komi != 7.5 || len(moves) != 1 || version != 2 {
+		t.Errorf("Expected the rest of the record to survive the update, got %+v, %d moves, version %d", settings, len(moves), version)
+	}
+}
+
+func TestMoveInMongoIsPushedOntoHistory(t *testing.T) {
+	fakes.TargetCount = 1
+	var matchesCollection = cfmgo.Connect(
+		fakes.FakeNewCollectionDialer([]matchRecord{}),
+		fakeDBURI,
+		MatchesCollectionName)
+	fake := matchesCollection.(*fakes.FakeCollection)
+
+	repo := newMongoMatchRepository(matchesCollection)
+	match := gogo.NewMatch(19, "bob", "alfred")
+	repo.addMatch(match, matchSettings{})
+
+	fake.Operations = nil
+	repo.updateMatch(match.ID, 1, matchUpdate{Match: match, Status: matchStatusActive, Moves: []matchMove{{Player: gogo.PlayerBlack, Turn: 1}}})
+	if len(fake.Operations) != 1 || fake.Operations[0].Name != "FindAndModify" {
+		t.Fatalf("Expected a single FindAndModify per move, got %+v", fake.Operations)
+	}
+	if _, ok := fake.Operations[0].Update.(bson.M)["$push"]; !ok {
+		t.Errorf("Expected the move to be pushed onto the history, got %v", fake.Operations[0].Update)
+	}
+	if err := repo.updateMatch("nevergonnahappen", 1, matchUpdate{Match: match, Moves: []matchMove{{Player: gogo.PlayerBlack, Turn: 1}}}); err == nil {
+		t.Error("Expected adding a move to a nonexistent match to fail")
+	}
+}
+
+func TestFindMatchesInMongoPushesQueryDown(t *testing.T) {
+	fakes.TargetCount = 3
+	var fakeMatches = []matchRecord{
+		*convertMatchToMatchRecord(gogo.NewMatch(19, "bob", "alfred")),
+		*convertMatchToMatchRecord(gogo.NewMatch(19, "bob", "carol")),
+		*convertMatchToMatchRecord(gogo.NewMatch(19, "bob", "dave")),
+	}
+	var matchesCollection = cfmgo.Connect(
+		fakes.FakeNewCollectionDialer(fakeMatches),
+		fakeDBURI,
+		MatchesCollectionName)
+	fake := matchesCollection.(*fakes.FakeCollection)
+
+	repo := newMongoMatchRepository(matchesCollection)
+	matches, next, err := repo.findMatches(matchQuery{Player: "bob", Status: matchStatusActive, Descending: true, Limit: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error finding matches: %s", err)
+	}
+	if len(matches) != 2 || next == "" {
+		t.Errorf("Expected a full page and a cursor when more matches exist, got %d matches and %q", len(matches), next)
+	}
+
+	issued := fake.Operations[len(fake.Operations)-1].Selector.(*params.RequestParams)
+	if issued.L != 3 {
+		t.Errorf("Expected the query to ask for one match past the page, got limit %d", issued.L)
+	}
+	if len(issued.S) != 2 || issued.S[0] != "-start_time" || issued.S[1] != "-match_id" {
+		t.Errorf("Expected sorting by descending start time then ID, got %v", issued.S)
+	}
+	conditions := issued.Q.(bson.M)["$and"].([]bson.M)
+	if len(conditions) != 2 || conditions[1]["status"] != matchStatusActive {
+		t.Errorf("Expected player and status filters in the selector, got %v", conditions)
+	}
+
+	_, _, err = repo.findMatches(matchQuery{Limit: 2, Descending: true, Cursor: next})
+	if err != nil {
+		t.Fatalf("Unexpected error finding the next page: %s", err)
+	}
+	issued = fake.Operations[len(fake.Operations)-1].Selector.(*params.RequestParams)
+	after := issued.Q.(bson.M)["$and"].([]bson.M)[0]["$or"].([]bson.M)
+	if _, ok := after[0]["start_time"].(bson.M)["$lt"]; !ok || after[1]["match_id"] == nil {
+		t.Errorf("Expected the cursor to select matches after the previous page, got %v", after)
+	}
+}
+
+func TestDeleteMatchFromMongo(t *testing.T) {
+	fakes.TargetCount = 1
+	var matchesCollection = cfmgo.Connect(
+		fakes.FakeNewCollectionDialer([]matchRecord{}),
+		fakeDBURI,
+		MatchesCollectionName)
+	fake := matchesCollection.(*fakes.FakeCollection)
+
+	repo := newMongoMatchRepository(matchesCollection)
+	match := gogo.NewMatch(19, "bob", "alfred")
+	repo.addMatch(match, matchSettings{})
+
+	if err := repo.deleteMatch(match.ID); err != nil {
+		t.Errorf("Error deleting match from mongo: %v", err)
+	}
+	last := fake.Operations[len(fake.Operations)-1]
+	if last.Name != "Remove" || last.Selector.(bson.M)["match_id"] != match.ID {
+		t.Errorf("Expected a Remove selecting the match, got %+v", last)
+	}
+	if err := repo.deleteMatch(match.ID); err == nil {
+		t.Error("Expected deleting a missing match to fail")
+	}
+}
+
+func TestRewindMatchInMongoTruncatesHistory(t *testing.T) {
+	fakes.TargetCount = 1
+	var matchesCollection = cfmgo.Connect(
+		fakes.FakeNewCollectionDialer([]matchRecord{}),
+		fakeDBURI,
+		MatchesCollectionName)
+
+	repo := newMongoMatchRepository(matchesCollection)
+	match := gogo.NewMatch(9, "bob", "alfred")
+	repo.addMatch(match, matchSettings{})
+	moves := []matchMove{
+		{Player: gogo.PlayerBlack, Position: &gogo.Coordinate{X: 2, Y: 2}, Turn: 1},
+		{Player: gogo.PlayerWhite, Position: &gogo.Coordinate{X: 6, Y: 6}, Turn: 2},
+	}
+	repo.updateMatch(match.ID, 1, matchUpdate{Match: match, Status: matchStatusActive, Moves: moves})
+
+	match.TurnCount = 1
+	match.GameBoard.Positions[2][2] = gogo.PlayerBlack
+	if err := repo.rewindMatch(match.ID, 1, matchRewind{Keep: 1, Match: match, Status: matchStatusActive}); err != errVersionConflict {
+		t.Errorf("Expected a rewind against a stale version to conflict, got %v", err)
+	}
+	undone := time.Now().UTC().Truncate(time.Millisecond)
+	if err := repo.rewindMatch(match.ID, 2, matchRewind{Keep: 1, At: undone, Match: match, Status: matchStatusActive}); err != nil {
+		t.Errorf("Error rewinding match in mongo: %v", err)
+	}
+
+	state, _ := repo.loadMatch(match.ID)
+	found, stored, version := state.Match, state.Moves, state.Version
+	if len(stored) != 1 || stored[0].Player != gogo.PlayerBlack || found.TurnCount != 1 || found.GameBoard.Positions[6][6] != 0 || version != 3 {
+		t.Errorf("Expected only black's move to remain at version 3, got %+v at turn %d, version %d", stored, found.TurnCount, version)
+	}
+	if stored[0].Version != 2 || len(state.Undos) != 1 || state.Undos[0] != (matchUndo{Version: 3, Keep: 1, At: undone}) {
+		t.Errorf("Expected the move stored at version 2 and the undo at version 3, got %+v and %+v", stored, state.Undos)
+	}
+}
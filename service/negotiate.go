@@ -0,0 +1,28 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptsMediaType reports whether the request's Accept header explicitly asks for mediaType
+// with a non-zero quality. Wildcards are deliberately not honoured, so that clients sending
+// */* keep getting JSON.
+func acceptsMediaType(req *http.Request, mediaType string) bool {
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		params := strings.Split(accepted, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), mediaType) {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				quality, _ = strconv.ParseFloat(kv[1], 64)
+			}
+		}
+		return quality > 0
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+const (
+	// sortStartTime is the only sort key. Matches are paged through by where they sort, so the key
+	// has to stay put while a client pages: a match's turn, say, moves on with every move played.
+	sortStartTime = "started_at"
+
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+var errInvalidCursor = errors.New("Cursor is not valid for this query")
+
+// matchQuery selects a page of matches. Zero values leave the corresponding filter off.
+type matchQuery struct {
+	Player        string
+	GridSize      int
+	Status        string
+	StartedAfter  time.Time
+	StartedBefore time.Time
+	Descending    bool
+	Limit         int
+	Cursor        string
+}
+
+// matchCursor marks the last match of a page by its start time, which never changes, and its ID,
+// which breaks ties.
+type matchCursor struct {
+	Started time.Time `json:"s"`
+	ID      string    `json:"id"`
+}
+
+// parseMatchQuery reads a matchQuery from the query string of a GET /matches request.
+func parseMatchQuery(values url.Values) (query matchQuery, err error) {
+	query = matchQuery{
+		Player: values.Get("player"),
+		Status: values.Get("status"),
+		Limit:  defaultPageSize,
+		Cursor: values.Get("cursor"),
+	}
+	if query.Status != "" && query.Status != matchStatusActive && query.Status != matchStatusFinished {
+		return query, errors.New("Status must be active or finished")
+	}
+	if v := values.Get("gridsize"); v != "" {
+		query.GridSize, err = strconv.Atoi(v)
+		if err != nil {
+			return query, errors.New("Gridsize must be a number")
+		}
+	}
+	if v := values.Get("started_after"); v != "" {
+		query.StartedAfter, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return query, errors.New("started_after must be an RFC 3339 timestamp")
+		}
+	}
+	if v := values.Get("started_before"); v != "" {
+		query.StartedBefore, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return query, errors.New("started_before must be an RFC 3339 timestamp")
+		}
+	}
+	if v := values.Get("sort"); v != "" {
+		query.Descending = strings.HasPrefix(v, "-")
+		if strings.TrimPrefix(v, "-") != sortStartTime {
+			return query, errors.New("Sort must be started_at, optionally prefixed with -")
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		query.Limit, err = strconv.Atoi(v)
+		if err != nil || query.Limit < 1 || query.Limit > maxPageSize {
+			return query, errors.New("Limit must be between 1 and " + strconv.Itoa(maxPageSize))
+		}
+	}
+	if query.Cursor != "" {
+		if _, err = decodeCursor(query.Cursor); err != nil {
+			return query, err
+		}
+	}
+	return query, nil
+}
+
+// includes reports whether a match in the given status passes the query's filters.
+func (query matchQuery) includes(match gogo.Match, status string) bool {
+	if query.Player != "" && match.PlayerBlack != query.Player && match.PlayerWhite != query.Player {
+		return false
+	}
+	if query.GridSize != 0 && match.GridSize != query.GridSize {
+		return false
+	}
+	if query.Status != "" && status != query.Status {
+		return false
+	}
+	if !query.StartedAfter.IsZero() && match.StartTime.Before(query.StartedAfter) {
+		return false
+	}
+	if !query.StartedBefore.IsZero() && !match.StartTime.Before(query.StartedBefore) {
+		return false
+	}
+	return true
+}
+
+// before reports whether a comes before b in the query's sort order.
+func (query matchQuery) before(a matchCursor, b matchCursor) bool {
+	less, equal := a.Started.Before(b.Started), a.Started.Equal(b.Started)
+	if equal {
+		less, equal = a.ID < b.ID, a.ID == b.ID
+	}
+	if query.Descending {
+		return !less && !equal
+	}
+	return less
+}
+
+func cursorFor(match gogo.Match) matchCursor {
+	return matchCursor{Started: match.StartTime, ID: match.ID}
+}
+
+func encodeCursor(cursor matchCursor) string {
+	b, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (cursor matchCursor, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, &cursor)
+	}
+	if err != nil || cursor.ID == "" {
+		err = errInvalidCursor
+	}
+	return
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseMatchQueryDefaults(t *testing.T) {
+	query, err := parseMatchQuery(url.Values{})
+	if err != nil {
+		t.Fatalf("Unexpected error parsing an empty query: %s", err)
+	}
+	if query.Descending || query.Limit != defaultPageSize {
+		t.Errorf("Expected matches oldest first, %d at a time, got %+v", defaultPageSize, query)
+	}
+}
+
+func TestParseMatchQueryReadsFilters(t *testing.T) {
+	values, _ := url.ParseQuery("player=bob&gridsize=13&status=finished&started_after=2016-05-01T00:00:00Z&sort=-started_at&limit=5")
+	query, err := parseMatchQuery(values)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing query: %s", err)
+	}
+	if query.Player != "bob" || query.GridSize != 13 || query.Status != matchStatusFinished {
+		t.Errorf("Filters were not read correctly: %+v", query)
+	}
+	if !query.StartedAfter.Equal(time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)) || !query.StartedBefore.IsZero() {
+		t.Errorf("Start time range was not read correctly: %+v", query)
+	}
+	if !query.Descending || query.Limit != 5 {
+		t.Errorf("Sorting and paging were not read correctly: %+v", query)
+	}
+}
+
+func TestParseMatchQueryRejectsBadValues(t *testing.T) {
+	for _, raw := range []string{
+		"gridsize=big",
+		"status=paused",
+		"started_before=yesterday",
+		"sort=player",
+		"sort=-turn",
+		"limit=0",
+		"limit=100000",
+		"cursor=notacursor",
+	} {
+		values, _ := url.ParseQuery(raw)
+		if _, err := parseMatchQuery(values); err == nil {
+			t.Errorf("Expected %s to be rejected", raw)
+		}
+	}
+}
+
+func TestCursorsRoundTrip(t *testing.T) {
+	cursor := matchCursor{Started: time.Date(2016, 5, 1, 12, 0, 0, 5, time.UTC), ID: "match"}
+	decoded, err := decodeCursor(encodeCursor(cursor))
+	if err != nil || !decoded.Started.Equal(cursor.Started) || decoded.ID != "match" {
+		t.Errorf("Expected cursor to survive encoding, got %+v (%v)", decoded, err)
+	}
+}
+
+func TestQueryOrderBreaksTiesByID(t *testing.T) {
+	started := time.Now()
+	first := matchCursor{Started: started, ID: "a"}
+	second := matchCursor{Started: started, ID: "b"}
+	later := matchCursor{Started: started.Add(time.Second), ID: "0"}
+
+	if !(matchQuery{}).before(first, second) {
+		t.Error("Matches that started together should be ordered by ID")
+	}
+	if !(matchQuery{}).before(second, later) {
+		t.Error("Matches should be ordered by start time before ID")
+	}
+	if !(matchQuery{Descending: true}).before(later, first) || !(matchQuery{Descending: true}).before(second, first) {
+		t.Error("Descending order should put the latest match, then the highest ID, first")
+	}
+	if (matchQuery{}).before(first, first) {
+		t.Error("A match should not sort before itself")
+	}
+}
@@ -0,0 +1,90 @@
+package service
+
+import "github.com/cloudnativego/gogo-engine"
+
+// matchScore holds both the territory (Japanese) and area (Chinese) counts for a board.
+// Every stone left on the board is treated as alive, so players are expected to capture
+// dead stones before passing.
+type matchScore struct {
+	Komi      float64
+	Territory playerScores
+	Area      playerScores
+}
+
+type playerScores struct {
+	Black float64
+	White float64
+}
+
+// winner returns the leading player and the margin of victory. A drawn game has no winner.
+func (s playerScores) winner() (player byte, margin float64) {
+	switch {
+	case s.Black > s.White:
+		player, margin = gogo.PlayerBlack, s.Black-s.White
+	case s.White > s.Black:
+		player, margin = gogo.PlayerWhite, s.White-s.Black
+	}
+	return
+}
+
+// scoreMatch scores the board at the end of a match, counting the prisoners each player took over the move history.
+// Under area scoring white is also compensated one point per handicap stone, as in the Chinese rules.
+func scoreMatch(positions [][]byte, moves []matchMove, settings matchSettings) (score matchScore) {
+	prisoners := make(map[byte]int)
+	for _, move := range moves {
+		prisoners[move.Player] += move.Captures
+	}
+	blackTerritory, whiteTerritory := territory(positions)
+
+	score.Komi = settings.Komi
+	score.Territory = playerScores{
+		Black: float64(blackTerritory + prisoners[gogo.PlayerBlack]),
+		White: float64(whiteTerritory+prisoners[gogo.PlayerWhite]) + settings.Komi,
+	}
+	score.Area = playerScores{
+		Black: float64(blackTerritory + countStones(positions, gogo.PlayerBlack)),
+		White: float64(whiteTerritory+countStones(positions, gogo.PlayerWhite)+settings.Handicap) + settings.Komi,
+	}
+	return
+}
+
+// territory counts the empty points that are surrounded exclusively by each player's stones.
+func territory(positions [][]byte) (black int, white int) {
+	visited := make([][]bool, len(positions))
+	for x := range positions {
+		visited[x] = make([]bool, len(positions[x]))
+	}
+
+	for x := range positions {
+		for y := range positions[x] {
+			if positions[x][y] != 0 || visited[x][y] {
+				continue
+			}
+			region := floodFill(positions, visited, gogo.Coordinate{X: x, Y: y})
+			owner := byte(0)
+			shared := false
+			for _, stone := range region.Stones {
+				for _, n := range neighbours(positions, stone) {
+					color := positions[n.X][n.Y]
+					if color == 0 {
+						continue
+					}
+					if owner != 0 && owner != color {
+						shared = true
+					}
+					owner = color
+				}
+			}
+			if shared {
+				continue
+			}
+			switch owner {
+			case gogo.PlayerBlack:
+				black += len(region.Stones)
+			case gogo.PlayerWhite:
+				white += len(region.Stones)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+func TestTerritoryIgnoresSharedRegions(t *testing.T) {
+	positions := gogo.NewMatch(9, "black", "white").GameBoard.Positions
+	for y := 0; y < 9; y++ {
+		positions[3][y] = gogo.PlayerBlack
+		positions[5][y] = gogo.PlayerWhite
+	}
+
+	black, white := territory(positions)
+	if black != 27 || white != 27 {
+		t.Errorf("Expected 27 points of territory each, got black %d and white %d", black, white)
+	}
+}
+
+func TestEmptyBoardHasNoTerritory(t *testing.T) {
+	positions := gogo.NewMatch(9, "black", "white").GameBoard.Positions
+
+	black, white := territory(positions)
+	if black != 0 || white != 0 {
+		t.Errorf("Expected no territory on an empty board, got black %d and white %d", black, white)
+	}
+}
+
+func TestScoreMatchAppliesKomiAndPrisoners(t *testing.T) {
+	positions := gogo.NewMatch(9, "black", "white").GameBoard.Positions
+	for y := 0; y < 9; y++ {
+		positions[3][y] = gogo.PlayerBlack
+		positions[5][y] = gogo.PlayerWhite
+	}
+	moves := []matchMove{
+		{Player: gogo.PlayerBlack, Captures: 2},
+		{Player: gogo.PlayerWhite},
+		{Player: gogo.PlayerBlack},
+	}
+
+	score := scoreMatch(positions, moves, matchSettings{Komi: 6.5})
+	if score.Territory.Black != 29 || score.Territory.White != 33.5 {
+		t.Errorf("Unexpected territory score: %+v", score.Territory)
+	}
+	if score.Area.Black != 36 || score.Area.White != 42.5 {
+		t.Errorf("Unexpected area score: %+v", score.Area)
+	}
+
+	winner, margin := score.Territory.winner()
+	if winner != gogo.PlayerWhite || margin != 4.5 {
+		t.Errorf("Expected white to win by 4.5 on territory, got %d by %v", winner, margin)
+	}
+	winner, margin = score.Area.winner()
+	if winner != gogo.PlayerWhite || margin != 6.5 {
+		t.Errorf("Expected white to win by 6.5 on area, got %d by %v", winner, margin)
+	}
+}
+
+func TestEvenScoreIsADraw(t *testing.T) {
+	winner, margin := playerScores{Black: 10, White: 10}.winner()
+	if winner != 0 || margin != 0 {
+		t.Errorf("Expected a draw, got %d by %v", winner, margin)
+	}
+}
+
+func TestAreaScoreCompensatesHandicap(t *testing.T) {
+	positions := gogo.NewMatch(9, "black", "white").GameBoard.Positions
+	for _, point := range handicapPoints(9, 4) {
+		positions[point.X][point.Y] = gogo.PlayerBlack
+	}
+
+	score := scoreMatch(positions, nil, matchSettings{Komi: 0.5, Handicap: 4})
+	if score.Area.White != 4.5 {
+		t.Errorf("Expected white to receive 4 points of handicap compensation plus komi, got %v", score.Area.White)
+	}
+	if score.Territory.White != 0.5 {
+		t.Errorf("Expected territory scoring to leave white with komi only, got %v", score.Territory.White)
+	}
+}
@@ -3,10 +3,10 @@ package service
 import (
 	"fmt"
 	"net/http"
+	"os"
 
 	"github.com/cloudfoundry-community/go-cfenv"
 	"github.com/cloudnativego/cf-tools"
-	"github.com/cloudnativego/cfmgo"
 	"github.com/codegangsta/negroni"
 	"github.com/gorilla/mux"
 	"github.com/unrolled/render"
@@ -24,18 +24,47 @@ func NewServer(appEnv *cfenv.App) *negroni.Negroni {
 
 	repo := initRepository(appEnv)
 
-	initRoutes(mx, formatter, repo)
+	if err := registerGTPEngines(os.Getenv(gtpEnginesEnv)); err != nil {
+		fmt.Printf("Failed to register GTP engines: %v\n", err)
+	}
+	hub := newMatchHub()
+	bots := newBotRunner(repo, hub)
+	go newClockSweeper(repo, hub, bots).run(clockSweepPeriod)
+	initRoutes(mx, formatter, repo, hub, bots)
+	if port := os.Getenv(gtpPortEnv); port != "" {
+		go func() {
+			err := listenGTP(":"+port, repo, hub, bots)
+			fmt.Printf("GTP listener stopped: %v\n", err)
+		}()
+	}
 
 	n.UseHandler(mx)
 	return n
 }
 
-func initRoutes(mx *mux.Router, formatter *render.Render, repo matchRepository) {
+func initRoutes(mx *mux.Router, formatter *render.Render, repo matchRepository, hub *matchHub, bots *botRunner) {
 	mx.HandleFunc("/test", testHandler(formatter)).Methods("GET")
-	mx.HandleFunc("/matches", createMatchHandler(formatter, repo)).Methods("POST")
+	mx.HandleFunc("/matches", createMatchHandler(formatter, repo, bots)).Methods("POST")
 	mx.HandleFunc("/matches", getMatchListHandler(formatter, repo)).Methods("GET")
+	mx.HandleFunc("/matches/import", importMatchHandler(formatter, repo, bots)).Methods("POST")
+	// Registered ahead of /matches/{id}, which would otherwise take the extension as part of the ID.
+	mx.HandleFunc("/matches/{id}"+sgfExtension, getMatchSGFHandler(formatter, repo)).Methods("GET")
 	mx.HandleFunc("/matches/{id}", getMatchDetailsHandler(formatter, repo)).Methods("GET")
-	mx.HandleFunc("/matches/{id}/moves", addMoveHandler(formatter, repo)).Methods("POST")
+	mx.HandleFunc("/matches/{id}", deleteMatchHandler(formatter, repo, bots)).Methods("DELETE")
+	mx.HandleFunc("/matches/{id}/board.svg", getBoardImageHandler(formatter, repo, "svg")).Methods("GET")
+	mx.HandleFunc("/matches/{id}/board.png", getBoardImageHandler(formatter, repo, "png")).Methods("GET")
+	mx.HandleFunc("/matches/{id}/liberties", getLibertiesHandler(formatter, repo)).Methods("GET")
+	mx.HandleFunc("/matches/{id}/chains", getChainsHandler(formatter, repo)).Methods("GET")
+	mx.HandleFunc("/matches/{id}/score", getScoreHandler(formatter, repo)).Methods("GET")
+	mx.HandleFunc("/matches/{id}/moves", getMoveListHandler(formatter, repo)).Methods("GET")
+	mx.HandleFunc("/matches/{id}/moves", addMoveHandler(formatter, repo, hub, bots)).Methods("POST")
+	mx.HandleFunc("/matches/{id}/resign", resignHandler(formatter, repo, hub, bots)).Methods("POST")
+	mx.HandleFunc("/matches/{id}/undo", getUndoHandler(formatter, repo)).Methods("GET")
+	mx.HandleFunc("/matches/{id}/undo", requestUndoHandler(formatter, repo, hub)).Methods("POST")
+	mx.HandleFunc("/matches/{id}/undo/accept", acceptUndoHandler(formatter, repo, hub)).Methods("POST")
+	mx.HandleFunc("/matches/{id}/undo/decline", declineUndoHandler(formatter, repo, hub)).Methods("POST")
+	mx.HandleFunc("/matches/{id}/stream", matchStreamHandler(formatter, repo, hub)).Methods("GET")
+	mx.HandleFunc("/matches/{id}/events", matchEventsHandler(formatter, repo, hub)).Methods("GET")
 }
 
 func testHandler(formatter *render.Render) http.HandlerFunc {
@@ -55,8 +84,11 @@ func initRepository(appEnv *cfenv.App) (repo matchRepository) {
 		repo = newInMemoryRepository()
 		return
 	}
-	matchCollection := cfmgo.Connect(cfmgo.NewCollectionDialer, dbServiceURI, MatchesCollectionName)
 	fmt.Printf("Connecting to MongoDB service: %s...\n", dbServiceName)
+	matchCollection, err := dialMatchCollection(dbServiceURI)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to connect to MongoDB: %v", err))
+	}
 	repo = newMongoMatchRepository(matchCollection)
 	return
 }
@@ -0,0 +1,417 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+const (
+	sgfMediaType = "application/x-go-sgf"
+	sgfExtension = ".sgf"
+)
+
+// sgfColor is the property a move or setup stone is recorded under for each player.
+var sgfColor = map[byte]string{
+	gogo.PlayerBlack: "B",
+	gogo.PlayerWhite: "W",
+}
+
+// renderSGF writes a match as an SGF FF[4] game record. Handicap stones are recorded as setup
+// stones, passes as empty moves, and the result of a finished match uses territory scoring, to
+// match the Japanese rules and komi the record declares.
+func renderSGF(match gogo.Match, settings matchSettings, moves []matchMove) []byte {
+	var b bytes.Buffer
+	b.WriteString("(;FF[4]GM[1]CA[UTF-8]AP[gogo-service]RU[Japanese]")
+	fmt.Fprintf(&b, "SZ[%d]", match.GridSize)
+	fmt.Fprintf(&b, "PB[%s]PW[%s]", sgfText(match.PlayerBlack), sgfText(match.PlayerWhite))
+	fmt.Fprintf(&b, "DT[%s]", match.StartTime.Format("2006-01-02"))
+	fmt.Fprintf(&b, "KM[%s]", strconv.FormatFloat(settings.Komi, 'f', -1, 64))
+	if settings.Handicap > 0 {
+		fmt.Fprintf(&b, "HA[%d]AB", settings.Handicap)
+		for _, point := range handicapPoints(match.GridSize, settings.Handicap) {
+			b.WriteString("[" + sgfPoint(point) + "]")
+		}
+	}
+	if tc := settings.TimeControl; tc.System != "" {
+		fmt.Fprintf(&b, "TM[%d]", int(tc.MainTime.Seconds()))
+		if overtime := sgfOvertime(tc); overtime != "" {
+			fmt.Fprintf(&b, "OT[%s]", overtime)
+		}
+	}
+	if result := sgfResult(match, settings, moves); result != "" {
+		fmt.Fprintf(&b, "RE[%s]", result)
+	}
+
+	for _, move := range moves {
+		if move.isForfeit() {
+			continue
+		}
+		point := ""
+		if move.Position != nil {
+			point = sgfPoint(*move.Position)
+		}
+		fmt.Fprintf(&b, "\n;%s[%s]", sgfColor[move.Player], point)
+	}
+	b.WriteString(")\n")
+	return b.Bytes()
+}
+
+// sgfResult renders the RE property of a finished match, e.g. "W+R", "B+T" or "B+3.5"; unfinished
+// matches have no result.
+func sgfResult(match gogo.Match, settings matchSettings, moves []matchMove) string {
+	if matchStatus(moves) != matchStatusFinished {
+		return ""
+	}
+	if last := moves[len(moves)-1]; last.Resigned {
+		return sgfColor[opponent(last.Player)] + "+R"
+	}
+	if last := moves[len(moves)-1]; last.TimedOut {
+		return sgfColor[opponent(last.Player)] + "+T"
+	}
+	return territoryResult(match, settings, moves)
+}
+
+// sgfOvertime describes what follows the main time, in the OT property's customary free form,
+// e.g. "5x30 byo-yomi".
+func sgfOvertime(tc timeControl) string {
+	switch tc.System {
+	case timeFischer:
+		return fmt.Sprintf("%d fischer", int(tc.Increment.Seconds()))
+	case timeByoyomi:
+		return fmt.Sprintf("%dx%d byo-yomi", tc.Periods, int(tc.PeriodTime.Seconds()))
+	case timeCanadian:
+		return fmt.Sprintf("%d/%d canadian", tc.PeriodStones, int(tc.PeriodTime.Seconds()))
+	}
+	return ""
+}
+
+// sgfTimeControl reads a time control back from the TM property and the OT property that goes
+// with it, in the forms sgfOvertime writes. TM[0] with no overtime is the customary way of saying
+// there was no time limit. Overtime in any other form leaves the match untimed, since playing it
+// under the main time alone would be harsher than the record intended.
+func sgfTimeControl(tm string, ot []string) (*timeControlRequest, error) {
+	mainTime, err := strconv.ParseFloat(strings.TrimSpace(tm), 64)
+	if err != nil || mainTime < 0 {
+		return nil, errors.New("SGF time limit must be a number of seconds")
+	}
+	request := &timeControlRequest{System: timeAbsolute, MainTime: int(mainTime)}
+	if len(ot) == 0 || strings.TrimSpace(ot[0]) == "" {
+		if request.MainTime == 0 {
+			return nil, nil
+		}
+		return request, nil
+	}
+	overtime := strings.ToLower(strings.TrimSpace(ot[0]))
+	switch {
+	case strings.HasSuffix(overtime, " fischer"):
+		request.System = timeFischer
+		_, err = fmt.Sscanf(overtime, "%d fischer", &request.Increment)
+	case strings.HasSuffix(overtime, " byo-yomi"):
+		request.System = timeByoyomi
+		_, err = fmt.Sscanf(overtime, "%dx%d byo-yomi", &request.Periods, &request.PeriodTime)
+	case strings.HasSuffix(overtime, " canadian"):
+		request.System = timeCanadian
+		_, err = fmt.Sscanf(overtime, "%d/%d canadian", &request.PeriodStones, &request.PeriodTime)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, nil
+	}
+	return request, nil
+}
+
+// territoryResult scores the board as it stands by territory, in the "B+3.5" form shared by SGF
+// and GTP, or "0" for a draw.
+func territoryResult(match gogo.Match, settings matchSettings, moves []matchMove) string {
+	player, margin := scoreMatch(match.GameBoard.Positions, moves, settings).Territory.winner()
+	if player == 0 {
+		return "0"
+	}
+	return sgfColor[player] + "+" + strconv.FormatFloat(margin, 'f', -1, 64)
+}
+
+// sgfPoint encodes a board coordinate as an SGF point: the column letter followed by the row letter.
+func sgfPoint(position gogo.Coordinate) string {
+	return string([]byte{byte('a' + position.X), byte('a' + position.Y)})
+}
+
+// sgfText escapes a value for use inside an SGF property.
+func sgfText(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	return strings.Replace(s, "]", "\\]", -1)
+}
+
+// sgfNode holds the properties of one node of an SGF game tree, each with its list of values.
+type sgfNode map[string][]string
+
+// sgfGame is the main variation of an SGF record, reduced to what a match can represent.
+type sgfGame struct {
+	request     newMatchRequest
+	setupStones []gogo.Coordinate
+	moves       []matchMove
+}
+
+// sgfParser reads the first game tree of an SGF collection, following the first variation
+// wherever the tree branches.
+type sgfParser struct {
+	data []byte
+	pos  int
+}
+
+var errSGFSyntax = errors.New("SGF record is malformed")
+
+// parseSGFMainLine returns the nodes of the main variation of the first game in an SGF record.
+func parseSGFMainLine(data []byte) (nodes []sgfNode, err error) {
+	p := &sgfParser{data: data}
+	if !p.consume('(') {
+		return nil, errSGFSyntax
+	}
+	nodes, err = p.sequence()
+	if err == nil && len(nodes) == 0 {
+		err = errSGFSyntax
+	}
+	return
+}
+
+// sequence reads nodes up to the end of the current game tree, descending into the first of
+// any variations and skipping the rest.
+func (p *sgfParser) sequence() (nodes []sgfNode, err error) {
+	for p.consume(';') {
+		node, err := p.node()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	first := true
+	for p.consume('(') {
+		variation, err := p.sequence()
+		if err != nil {
+			return nil, err
+		}
+		if first {
+			nodes = append(nodes, variation...)
+			first = false
+		}
+	}
+	if !p.consume(')') {
+		return nil, errSGFSyntax
+	}
+	return nodes, nil
+}
+
+func (p *sgfParser) node() (node sgfNode, err error) {
+	node = sgfNode{}
+	for {
+		p.skipSpace()
+		start := p.pos
+		for p.pos < len(p.data) && unicode.IsLetter(rune(p.data[p.pos])) {
+			p.pos++
+		}
+		if start == p.pos {
+			return node, nil
+		}
+		// FF[3] allowed lower case letters in property names, which are ignored.
+		ident := strings.Map(func(r rune) rune {
+			if unicode.IsUpper(r) {
+				return r
+			}
+			return -1
+		}, string(p.data[start:p.pos]))
+		values := 0
+		for p.peek('[') {
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			node[ident] = append(node[ident], value)
+			values++
+		}
+		if values == 0 {
+			return nil, errSGFSyntax
+		}
+	}
+}
+
+func (p *sgfParser) value() (value string, err error) {
+	p.pos++
+	var b bytes.Buffer
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		p.pos++
+		switch {
+		case c == '\\' && p.pos < len(p.data):
+			b.WriteByte(p.data[p.pos])
+			p.pos++
+		case c == ']':
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errSGFSyntax
+}
+
+func (p *sgfParser) skipSpace() {
+	for p.pos < len(p.data) && unicode.IsSpace(rune(p.data[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *sgfParser) peek(c byte) bool {
+	p.skipSpace()
+	return p.pos < len(p.data) && p.data[p.pos] == c
+}
+
+func (p *sgfParser) consume(c byte) bool {
+	if p.peek(c) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// readSGFGame interprets the main variation of an SGF record. Black setup stones in the root
+// node are taken as handicap stones; any other setup is rejected, since a match can only start
+// from an empty or handicapped board.
+func readSGFGame(data []byte) (game sgfGame, err error) {
+	nodes, err := parseSGFMainLine(data)
+	if err != nil {
+		return
+	}
+	root := nodes[0]
+	if gm := root["GM"]; len(gm) > 0 && gm[0] != "1" {
+		return game, errors.New("SGF record is not a game of Go")
+	}
+	game.request.GridSize = 19
+	if sz := root["SZ"]; len(sz) > 0 {
+		game.request.GridSize, err = strconv.Atoi(sz[0])
+		if err != nil {
+			return game, errors.New("SGF board size must be a single number")
+		}
+	}
+	game.request.PlayerBlack, game.request.PlayerWhite = "black", "white"
+	if pb := root["PB"]; len(pb) > 0 && strings.TrimSpace(pb[0]) != "" {
+		game.request.PlayerBlack = strings.TrimSpace(pb[0])
+	}
+	if pw := root["PW"]; len(pw) > 0 && strings.TrimSpace(pw[0]) != "" {
+		game.request.PlayerWhite = strings.TrimSpace(pw[0])
+	}
+	if km := root["KM"]; len(km) > 0 {
+		komi, err := strconv.ParseFloat(km[0], 64)
+		if err != nil {
+			return game, errors.New("SGF komi must be a number")
+		}
+		game.request.Komi = &komi
+	}
+	if tm := root["TM"]; len(tm) > 0 {
+		game.request.TimeControl, err = sgfTimeControl(tm[0], root["OT"])
+		if err != nil {
+			return
+		}
+	}
+	for _, value := range root["AB"] {
+		point, pass, err := sgfCoordinate(value, game.request.GridSize)
+		if err != nil || pass {
+			return game, errors.New("SGF setup stone " + value + " is not on the board")
+		}
+		game.setupStones = append(game.setupStones, point)
+	}
+	game.request.Handicap = len(game.setupStones)
+	if ha := root["HA"]; len(ha) > 0 && len(game.setupStones) == 0 {
+		// Without explicit stones the handicap goes on the usual star points.
+		game.request.Handicap, err = strconv.Atoi(ha[0])
+		if err != nil {
+			return game, errors.New("SGF handicap must be a number")
+		}
+	}
+
+	for idx, node := range nodes {
+		for _, setup := range []string{"AW", "AE"} {
+			if _, ok := node[setup]; ok {
+				return game, errors.New("SGF setup other than black handicap stones is not supported")
+			}
+		}
+		if _, ok := node["AB"]; ok && idx > 0 {
+			return game, errors.New("SGF setup other than black handicap stones is not supported")
+		}
+		for _, player := range []byte{gogo.PlayerBlack, gogo.PlayerWhite} {
+			values, ok := node[sgfColor[player]]
+			if !ok {
+				continue
+			}
+			move := matchMove{Player: player, Turn: len(game.moves) + 1}
+			point, pass, err := sgfCoordinate(values[0], game.request.GridSize)
+			if err != nil {
+				return game, fmt.Errorf("SGF move %d is not on the board", move.Turn)
+			}
+			if !pass {
+				move.Position = &point
+			}
+			game.moves = append(game.moves, move)
+		}
+	}
+	return game, nil
+}
+
+// sgfCoordinate decodes an SGF point. An empty value, or "tt" on boards up to 19x19, is a pass.
+func sgfCoordinate(value string, gridSize int) (point gogo.Coordinate, pass bool, err error) {
+	if value == "" || (value == "tt" && gridSize <= 19) {
+		return point, true, nil
+	}
+	if len(value) != 2 {
+		return point, false, errSGFSyntax
+	}
+	point = gogo.Coordinate{X: int(value[0] - 'a'), Y: int(value[1] - 'a')}
+	if point.X < 0 || point.X >= gridSize || point.Y < 0 || point.Y >= gridSize {
+		return point, false, errSGFSyntax
+	}
+	return point, false, nil
+}
+
+// replay plays the game's main line out through the engine from its setup position, checking
+// that players alternate and that nothing is played once the match has finished. It returns
+// the match as it stood after the first upTo moves, together with those moves. The record keeps
+// no timings, so every move is stamped with the match's start and the clocks begin full.
+func (game sgfGame) replay(upTo int) (match gogo.Match, moves []matchMove, err error) {
+	board := gogo.NewMatch(game.request.GridSize, game.request.PlayerBlack, game.request.PlayerWhite)
+	for _, point := range handicapPoints(game.request.GridSize, game.request.Handicap) {
+		board.GameBoard.Positions[point.X][point.Y] = gogo.PlayerBlack
+	}
+	// Matches only know the handicap count, so stones anywhere else could not be reproduced.
+	for _, point := range game.setupStones {
+		if board.GameBoard.Positions[point.X][point.Y] != gogo.PlayerBlack {
+			return match, nil, errors.New("SGF handicap stones must be on the standard star points")
+		}
+	}
+	settings := game.request.settings()
+	match = cloneMatch(board)
+	var played []matchMove
+	for _, move := range game.moves {
+		if matchStatus(played) == matchStatusFinished {
+			return match, nil, fmt.Errorf("SGF move %d is played after the match has finished", move.Turn)
+		}
+		if expected := nextPlayer(settings, played); move.Player != expected {
+			return match, nil, fmt.Errorf("SGF move %d should have been played by %s", move.Turn, playerName(expected))
+		}
+		move.Timestamp = board.StartTime
+		if move.Position != nil {
+			if err = placeStone(&board, &move, *move.Position); err != nil {
+				return match, nil, fmt.Errorf("SGF move %d is illegal: %v", move.Turn, err)
+			}
+		}
+		board.TurnCount = move.Turn
+		played = append(played, move)
+		if len(played) == upTo {
+			match = cloneMatch(board)
+		}
+	}
+	return match, played[:upTo], nil
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudnativego/gogo-engine"
+)
+
+func TestRenderSGFRecordsGameInfoAndMoves(t *testing.T) {
+	match := gogo.NewMatch(9, "alfred", "bob [the great]")
+	match.StartTime = time.Date(2016, 5, 21, 10, 30, 0, 0, time.UTC)
+	moves := []matchMove{
+		{Player: gogo.PlayerBlack, Position: &gogo.Coordinate{X: 2, Y: 6}, Turn: 1},
+		{Player: gogo.PlayerWhite, Turn: 2},
+	}
+
+	sgf := string(renderSGF(match, matchSettings{Komi: 6.5}, moves))
+	for _, expected := range []string{"(;FF[4]GM[1]", "SZ[9]", "PB[alfred]", "PW[bob [the great\\]]", "DT[2016-05-21]", "KM[6.5]", ";B[cg]", ";W[]"} {
+		if !strings.Contains(sgf, expected) {
+			t.Errorf("Expected SGF to contain %s, got %s", expected, sgf)
+		}
+	}
+	if strings.Contains(sgf, "RE[") || strings.Contains(sgf, "HA[") {
+		t.Errorf("An unfinished even game should have no result or handicap, got %s", sgf)
+	}
+	if !strings.HasSuffix(sgf, ")\n") {
+		t.Errorf("Expected the game tree to be closed, got %s", sgf)
+	}
+}
+
+func TestRenderSGFRecordsHandicapAndResult(t *testing.T) {
+	match := gogo.NewMatch(9, "alfred", "bob")
+	settings := matchSettings{Komi: 0.5, Handicap: 2}
+	resigned := []matchMove{
+		{Player: gogo.PlayerWhite, Position: &gogo.Coordinate{X: 4, Y: 4}, Turn: 1},
+		{Player: gogo.PlayerBlack, Turn: 2, Resigned: true},
+	}
+
+	sgf := string(renderSGF(match, settings, resigned))
+	if !strings.Contains(sgf, "HA[2]AB[cc][gg]") {
+		t.Errorf("Expected handicap stones as setup stones, got %s", sgf)
+	}
+	if !strings.Contains(sgf, "RE[W+R]") || strings.Count(sgf, ";") != 2 {
+		t.Errorf("Expected a resignation to be recorded as the result only, got %s", sgf)
+	}
+
+	passed := []matchMove{{Player: gogo.PlayerWhite, Turn: 1}, {Player: gogo.PlayerBlack, Turn: 2}}
+	if result := sgfResult(match, settings, passed); result != "W+0.5" {
+		t.Errorf("Expected white to win an empty board by komi, got %s", result)
+	}
+}
+
+func TestAcceptsMediaType(t *testing.T) {
+	cases := map[string]bool{
+		"application/x-go-sgf":                  true,
+		"text/html, application/x-go-sgf;q=0.5": true,
+		"application/x-go-sgf;q=0":              false,
+		"*/*":                                   false,
+		"application/json":                      false,
+		"application/json, APPLICATION/X-GO-SGF; q=1": true,
+	}
+	for accept, expected := range cases {
+		request, _ := http.NewRequest("GET", "/matches/abc", nil)
+		request.Header.Set("Accept", accept)
+		if acceptsMediaType(request, sgfMediaType) != expected {
+			t.Errorf("Expected Accept: %s to give %v", accept, expected)
+		}
+	}
+}
+
+func TestReadSGFGameFollowsMainLine(t *testing.T) {
+	record := `(;GM[1]FF[4]SZ[13]PB[alfred \] the great]PW[bob]KM[0.5]AB[dd][jj]
+		;W[gg]C[a comment with (brackets\)]
+		(;B[tt];W[aa])
+		(;B[bb]))`
+
+	game, err := readSGFGame([]byte(record))
+	if err != nil {
+		t.Fatalf("Expected the record to parse, got %v", err)
+	}
+	if game.request.GridSize != 13 || game.request.PlayerBlack != "alfred ] the great" || *game.request.Komi != 0.5 {
+		t.Errorf("Expected the root properties to be read, got %+v", game.request)
+	}
+	if game.request.Handicap != 2 || len(game.setupStones) != 2 || game.setupStones[1] != (gogo.Coordinate{X: 9, Y: 9}) {
+		t.Errorf("Expected black setup stones to become the handicap, got %+v", game.setupStones)
+	}
+	if len(game.moves) != 3 || !game.moves[1].isPass() || game.moves[2].Player != gogo.PlayerWhite || *game.moves[2].Position != (gogo.Coordinate{}) {
+		t.Errorf("Expected the first variation with tt as a pass, got %+v", game.moves)
+	}
+}
+
+func TestReadSGFGameRejectsMalformedRecords(t *testing.T) {
+	for _, record := range []string{"", "(;SZ[9]", "(;SZ[9];B[aa)", "(;SZ[9];B)", "(;GM[2])", "(;SZ[9];B[zz])"} {
+		if _, err := readSGFGame([]byte(record)); err == nil {
+			t.Errorf("Expected %q to be rejected", record)
+		}
+	}
+}
+
+func TestReadSGFGameRestoresTimeControls(t *testing.T) {
+	for _, tc := range []timeControl{
+		{System: timeAbsolute, MainTime: 30 * time.Minute},
+		{System: timeFischer, MainTime: 5 * time.Minute, Increment: 10 * time.Second},
+		{System: timeByoyomi, MainTime: 10 * time.Minute, Periods: 5, PeriodTime: 30 * time.Second},
+		{System: timeCanadian, PeriodTime: 5 * time.Minute, PeriodStones: 25},
+	} {
+		match := gogo.NewMatch(9, "alfred", "bob")
+		record := renderSGF(match, matchSettings{Komi: 6.5, TimeControl: tc}, nil)
+		game, err := readSGFGame(record)
+		if err != nil {
+			t.Fatalf("Expected %s to parse, got %v", record, err)
+		}
+		if game.request.TimeControl == nil || game.request.TimeControl.timeControl() != tc {
+			t.Errorf("Expected %s to restore %+v, got %+v", record, tc, game.request.TimeControl)
+		}
+	}
+
+	game, err := readSGFGame([]byte("(;SZ[9]TM[600]OT[3 moves / 20 sec])"))
+	if err != nil || game.request.TimeControl != nil {
+		t.Errorf("Expected overtime in an unknown form to leave the match untimed, got %+v (%v)", game.request.TimeControl, err)
+	}
+	game, err = readSGFGame([]byte("(;SZ[9]TM[0])"))
+	if err != nil || game.request.TimeControl != nil {
+		t.Errorf("Expected TM[0] to leave the match untimed, got %+v (%v)", game.request.TimeControl, err)
+	}
+	if _, err := readSGFGame([]byte("(;SZ[9]TM[ten minutes])")); err == nil {
+		t.Error("Expected a time limit that is not a number to be rejected")
+	}
+}
+
+func TestReplayStampsMovesWithTheMatchStart(t *testing.T) {
+	game, err := readSGFGame([]byte("(;SZ[9]TM[600];B[ee];W[cc])"))
+	if err != nil {
+		t.Fatalf("Expected the record to parse, got %v", err)
+	}
+	match, moves, err := game.replay(len(game.moves))
+	if err != nil {
+		t.Fatalf("Expected the record to replay, got %v", err)
+	}
+	for _, move := range moves {
+		if !move.Timestamp.Equal(match.StartTime) {
+			t.Errorf("Expected move %d to be stamped with the match start %v, got %v", move.Turn, match.StartTime, move.Timestamp)
+		}
+	}
+	clocks := runClocks(game.request.settings(), match.StartTime, moves, nil)
+	if clocks.Black.MainTime != 10*time.Minute || clocks.White.MainTime != 10*time.Minute {
+		t.Errorf("Expected both clocks to start full, got %+v", clocks)
+	}
+}
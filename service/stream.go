@@ -0,0 +1,96 @@
+package service
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/unrolled/render"
+)
+
+const (
+	streamWriteWait  = 10 * time.Second
+	streamPongWait   = 60 * time.Second
+	streamPingPeriod = streamPongWait * 9 / 10
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// The stream is read-only and carries nothing GET /matches/{id} doesn't already expose,
+	// so spectators are welcome from any origin.
+	CheckOrigin: func(req *http.Request) bool { return true },
+}
+
+// matchStreamHandler upgrades the request to a WebSocket and pushes the match details to the
+// client whenever a move is made, starting with the current state of the match.
+func matchStreamHandler(formatter *render.Render, repo matchRepository, hub *matchHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		matchID := vars["id"]
+		// Subscribe before reading the current state so no move can slip in between the two.
+		updates := hub.subscribe(matchID)
+		defer hub.unsubscribe(matchID, updates)
+
+		state, err := repo.loadMatch(matchID)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, err.Error())
+			return
+		}
+		var current matchDetailsResponse
+		current.copyMatch(state.Match, state.Settings, state.Moves, state.Undos)
+		if state.Undo != nil {
+			current.UndoRequest = &undoResponse{}
+			current.UndoRequest.copyUndo(*state.Undo, state.Moves, undoPending)
+		}
+
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			conn.SetReadDeadline(time.Now().Add(streamPongWait))
+			conn.SetPongHandler(func(string) error {
+				return conn.SetReadDeadline(time.Now().Add(streamPongWait))
+			})
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		ticker := time.NewTicker(streamPingPeriod)
+		defer ticker.Stop()
+
+		conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+		if conn.WriteJSON(&current) != nil {
+			return
+		}
+		for {
+			select {
+			case update := <-updates:
+				// The snapshot already covers anything published before it was read.
+				if update.version <= state.Version {
+					continue
+				}
+				conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+				if conn.WriteJSON(&update) != nil {
+					return
+				}
+			case <-ticker.C:
+				conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+				if conn.WriteMessage(websocket.PingMessage, nil) != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudnativego/gogo-engine"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func TestStreamPushesMovesToEverySpectator(t *testing.T) {
+	repo := newInMemoryRepository()
+	hub := newMatchHub()
+	mx := mux.NewRouter()
+	mx.HandleFunc("/matches/{id}/moves", addMoveHandler(formatter, repo, hub, newBotRunner(repo, hub))).Methods("POST")
+	mx.HandleFunc("/matches/{id}/stream", matchStreamHandler(formatter, repo, hub)).Methods("GET")
+	mx.HandleFunc("/matches/{id}", getMatchDetailsHandler(formatter, repo)).Methods("GET")
+	server := httptest.NewServer(mx)
+	defer server.Close()
+
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+	streamURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/matches/" + targetMatch.ID + "/stream"
+
+	var spectators []*websocket.Conn
+	for idx := 0; idx < 2; idx++ {
+		conn, _, err := websocket.DefaultDialer.Dial(streamURL, nil)
+		if err != nil {
+			t.Fatalf("Error connecting to match stream: %v", err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		var initial matchDetailsResponse
+		err = conn.ReadJSON(&initial)
+		if err != nil || initial.ID != targetMatch.ID || initial.Turn != 0 {
+			t.Errorf("Expected the current match state on connect, got %+v (%v)", initial, err)
+		}
+		spectators = append(spectators, conn)
+	}
+
+	res, err := postLiveMove(server.URL, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 2, \"y\": 3}}")
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("Error posting move: %v", err)
+	}
+	res.Body.Close()
+
+	for _, conn := range spectators {
+		var update matchDetailsResponse
+		err := conn.ReadJSON(&update)
+		if err != nil {
+			t.Fatalf("Error reading update from stream: %v", err)
+		}
+		if update.Turn != 1 || update.GameBoard[2][3] != gogo.PlayerBlack {
+			t.Errorf("Expected the streamed update to show black's move, got %+v", update)
+		}
+	}
+
+	for _, conn := range spectators {
+		conn.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.subscriberCount(targetMatch.ID) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hub.subscriberCount(targetMatch.ID) != 0 {
+		t.Errorf("Expected disconnected spectators to be unsubscribed, %d remain", hub.subscriberCount(targetMatch.ID))
+	}
+}
+
+func TestStreamReturns404ForNonexistentMatch(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/matches/1234/stream", nil)
+	server.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected %v; received %v", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestStreamSkipsUpdatesCoveredByTheSnapshot(t *testing.T) {
+	repo := newInMemoryRepository()
+	hub := newMatchHub()
+	mx := mux.NewRouter()
+	mx.HandleFunc("/matches/{id}/moves", addMoveHandler(formatter, repo, hub, newBotRunner(repo, hub))).Methods("POST")
+	mx.HandleFunc("/matches/{id}/stream", matchStreamHandler(formatter, repo, hub)).Methods("GET")
+	mx.HandleFunc("/matches/{id}", getMatchDetailsHandler(formatter, repo)).Methods("GET")
+	server := httptest.NewServer(mx)
+	defer server.Close()
+
+	targetMatch := gogo.NewMatch(9, "black", "white")
+	repo.addMatch(targetMatch, matchSettings{})
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/matches/"+targetMatch.ID+"/stream", nil)
+	if err != nil {
+		t.Fatalf("Error connecting to match stream: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var initial matchDetailsResponse
+	conn.ReadJSON(&initial)
+
+	// An update published late for a state the snapshot already showed must not go out after it.
+	hub.publish(targetMatch.ID, matchDetailsResponse{ID: targetMatch.ID, Turn: 42, version: 1})
+	res, err := postLiveMove(server.URL, targetMatch.ID, "{\"player\": 1, \"position\": {\"x\": 2, \"y\": 3}}")
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("Error posting move: %v", err)
+	}
+	res.Body.Close()
+
+	var update matchDetailsResponse
+	if err := conn.ReadJSON(&update); err != nil || update.Turn != 1 {
+		t.Errorf("Expected the stale update to be skipped in favour of black's move, got %+v (%v)", update, err)
+	}
+}
+
+// postLiveMove plays a move on a running server against the board as it currently stands.
+func postLiveMove(serverURL string, matchID string, body string) (*http.Response, error) {
+	current, err := http.Get(serverURL + "/matches/" + matchID)
+	if err != nil {
+		return nil, err
+	}
+	current.Body.Close()
+	request, _ := http.NewRequest("POST", serverURL+"/matches/"+matchID+"/moves", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("If-Match", current.Header.Get("ETag"))
+	return http.DefaultClient.Do(request)
+}
@@ -1,49 +1,175 @@
 package service
 
-import "github.com/cloudnativego/gogo-engine"
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cloudnativego/gogo-engine"
+)
 
 type newMatchResponse struct {
-	ID          string `json:"id"`
-	StartedAt   int64  `json:"started_at"`
-	GridSize    int    `json:"gridsize"`
-	PlayerWhite string `json:"playerWhite"`
-	PlayerBlack string `json:"playerBlack"`
-	Turn        int    `json:"turn,omitempty"`
+	ID          string               `json:"id"`
+	StartedAt   int64                `json:"started_at"`
+	GridSize    int                  `json:"gridsize"`
+	PlayerWhite string               `json:"playerWhite"`
+	PlayerBlack string               `json:"playerBlack"`
+	Turn        int                  `json:"turn,omitempty"`
+	Status      string               `json:"status"`
+	NextPlayer  string               `json:"nextPlayer,omitempty"`
+	Komi        float64              `json:"komi"`
+	Handicap    int                  `json:"handicap,omitempty"`
+	TimeControl *timeControlResponse `json:"timeControl,omitempty"`
+	Winner      string               `json:"winner,omitempty"`
+	SeatTokens  *seats               `json:"seatTokens,omitempty"`
+}
+
+// seats carries the secret seat tokens handed to each player when a match is created. They
+// are only ever returned once. A seat held by a bot has no token to hand out.
+type seats struct {
+	Black string `json:"black,omitempty"`
+	White string `json:"white,omitempty"`
 }
 
-func (m *newMatchResponse) copyMatch(match gogo.Match) {
+func (m *newMatchResponse) copyMatch(match gogo.Match, settings matchSettings, moves []matchMove) {
 	m.ID = match.ID
 	m.StartedAt = match.StartTime.Unix()
 	m.GridSize = match.GridSize
 	m.PlayerWhite = match.PlayerWhite
 	m.PlayerBlack = match.PlayerBlack
 	m.Turn = match.TurnCount
+	m.Status = matchStatus(moves)
+	if m.Status == matchStatusActive {
+		m.NextPlayer = playerName(nextPlayer(settings, moves))
+	}
+	m.Komi = settings.Komi
+	m.Handicap = settings.Handicap
+	if settings.TimeControl.System != "" {
+		m.TimeControl = &timeControlResponse{}
+		m.TimeControl.copyTimeControl(settings.TimeControl)
+	}
+	m.Winner = forfeitWinner(moves)
 }
 
 type matchDetailsResponse struct {
-	ID          string   `json:"id"`
-	StartedAt   int64    `json:"started_at"`
-	GridSize    int      `json:"gridsize"`
-	PlayerWhite string   `json:"playerWhite"`
-	PlayerBlack string   `json:"playerBlack"`
-	Turn        int      `json:"turn,omitempty"`
-	GameBoard   [][]byte `json:"gameboard"`
+	ID          string               `json:"id"`
+	StartedAt   int64                `json:"started_at"`
+	GridSize    int                  `json:"gridsize"`
+	PlayerWhite string               `json:"playerWhite"`
+	PlayerBlack string               `json:"playerBlack"`
+	Turn        int                  `json:"turn,omitempty"`
+	Status      string               `json:"status"`
+	NextPlayer  string               `json:"nextPlayer,omitempty"`
+	Komi        float64              `json:"komi"`
+	Handicap    int                  `json:"handicap,omitempty"`
+	TimeControl *timeControlResponse `json:"timeControl,omitempty"`
+	Clocks      *clocksResponse      `json:"clocks,omitempty"`
+	UndoRequest *undoResponse        `json:"undoRequest,omitempty"`
+	Winner      string               `json:"winner,omitempty"`
+	GameBoard   [][]byte             `json:"gameboard"`
+	Score       *scoreResponse       `json:"score,omitempty"`
+	// version is the version of the match the details describe, so that a subscriber can tell
+	// an update it has already seen in a snapshot from a newer one.
+	version int
 }
 
-func (m *matchDetailsResponse) copyMatch(match gogo.Match) {
+func (m *matchDetailsResponse) copyMatch(match gogo.Match, settings matchSettings, moves []matchMove, undos []matchUndo) {
 	m.ID = match.ID
 	m.StartedAt = match.StartTime.Unix()
 	m.GridSize = match.GridSize
 	m.PlayerWhite = match.PlayerWhite
 	m.PlayerBlack = match.PlayerBlack
 	m.Turn = match.TurnCount
+	m.Status = matchStatus(moves)
+	if m.Status == matchStatusActive {
+		m.NextPlayer = playerName(nextPlayer(settings, moves))
+	}
+	m.Komi = settings.Komi
+	m.Handicap = settings.Handicap
+	if settings.TimeControl.System != "" {
+		m.TimeControl = &timeControlResponse{}
+		m.TimeControl.copyTimeControl(settings.TimeControl)
+		m.Clocks = &clocksResponse{}
+		m.Clocks.copyClocks(runClocks(settings, match.StartTime, moves, undos))
+	}
+	m.Winner = forfeitWinner(moves)
 	m.GameBoard = match.GameBoard.Positions
+	if m.Status == matchStatusFinished {
+		m.Score = &scoreResponse{}
+		m.Score.copyScore(scoreMatch(match.GameBoard.Positions, moves, settings))
+	}
+}
+
+type scoreResponse struct {
+	Komi      float64               `json:"komi"`
+	Territory scoringSystemResponse `json:"territory"`
+	Area      scoringSystemResponse `json:"area"`
+}
+
+type scoringSystemResponse struct {
+	Black  float64 `json:"black"`
+	White  float64 `json:"white"`
+	Winner string  `json:"winner"`
+	Margin float64 `json:"margin"`
+}
+
+func (m *scoreResponse) copyScore(score matchScore) {
+	m.Komi = score.Komi
+	m.Territory.copyScores(score.Territory)
+	m.Area.copyScores(score.Area)
+}
+
+func (m *scoringSystemResponse) copyScores(scores playerScores) {
+	m.Black = scores.Black
+	m.White = scores.White
+	winner, margin := scores.winner()
+	m.Winner = playerName(winner)
+	if winner == 0 {
+		m.Winner = "draw"
+	}
+	m.Margin = margin
 }
 
 type newMatchRequest struct {
-	GridSize    int    `json:"gridsize"`
-	PlayerWhite string `json:"playerWhite"`
-	PlayerBlack string `json:"playerBlack"`
+	GridSize        int                 `json:"gridsize"`
+	PlayerWhite     string              `json:"playerWhite"`
+	PlayerBlack     string              `json:"playerBlack"`
+	Komi            *float64            `json:"komi"`
+	Handicap        int                 `json:"handicap"`
+	BotThinkingTime int                 `json:"botThinkingTime"`
+	BotSeed         *int64              `json:"botSeed"`
+	TimeControl     *timeControlRequest `json:"timeControl"`
+}
+
+// settings returns the match settings requested, filling in defaults for anything omitted.
+// Handicap games default to a half point komi, since black's extra stones already make up
+// for white's disadvantage. A bot's thinking time is given in milliseconds, and only kept for
+// bots that search; without a seed a bot is seeded from the clock. Without a time control, the players have as long as they like.
+func (request newMatchRequest) settings() (settings matchSettings) {
+	settings.Handicap = request.Handicap
+	settings.Komi = defaultKomi
+	if settings.Handicap > 0 {
+		settings.Komi = defaultHandicapKomi
+	}
+	if request.Komi != nil {
+		settings.Komi = *request.Komi
+	}
+	if isThinkingBot(request.PlayerBlack) || isThinkingBot(request.PlayerWhite) {
+		settings.BotThinkingTime = defaultBotThinkingTime
+		if request.BotThinkingTime > 0 {
+			settings.BotThinkingTime = time.Duration(request.BotThinkingTime) * time.Millisecond
+		}
+	}
+	if isBotName(request.PlayerBlack) || isBotName(request.PlayerWhite) {
+		settings.BotSeed = time.Now().UnixNano()
+		if request.BotSeed != nil {
+			settings.BotSeed = *request.BotSeed
+		}
+	}
+	if request.TimeControl != nil {
+		settings.TimeControl = request.TimeControl.timeControl()
+	}
+	return
 }
 
 type boardPosition struct {
@@ -52,15 +178,231 @@ type boardPosition struct {
 }
 
 type newMoveRequest struct {
-	Player   byte          `json:"player"`
+	Player   byte           `json:"player"`
+	Position *boardPosition `json:"position"`
+}
+
+// isPass reports whether the request is a pass, i.e. it carries no position.
+func (request newMoveRequest) isPass() bool {
+	return request.Position == nil
+}
+
+// validate checks that the move names a real player and, unless it is a pass, lands on the board.
+func (request newMoveRequest) validate(gridSize int) (err error) {
+	if request.Player != gogo.PlayerBlack && request.Player != gogo.PlayerWhite {
+		return errors.New("Player must be 1 (black) or 2 (white)")
+	}
+	if !request.isPass() {
+		x, y := request.Position.X, request.Position.Y
+		if x < 0 || x >= gridSize || y < 0 || y >= gridSize {
+			return fmt.Errorf("Position %d,%d is off the %dx%d board", x, y, gridSize, gridSize)
+		}
+	}
+	return
+}
+
+type errorResponse struct {
+	Message string `json:"message"`
+}
+
+type moveResponse struct {
+	Player   string         `json:"player"`
+	Position *boardPosition `json:"position,omitempty"`
+	Turn     int            `json:"turn"`
+	Resigned bool           `json:"resigned,omitempty"`
+	TimedOut bool           `json:"timedOut,omitempty"`
+	PlayedAt int64          `json:"played_at"`
+}
+
+func (m *moveResponse) copyMove(move matchMove) {
+	m.Player = playerName(move.Player)
+	if move.Position != nil {
+		m.Position = &boardPosition{X: move.Position.X, Y: move.Position.Y}
+	}
+	m.Turn = move.Turn
+	m.Resigned = move.Resigned
+	m.TimedOut = move.TimedOut
+	m.PlayedAt = move.Timestamp.Unix()
+}
+
+type libertyResponse struct {
+	Player   string        `json:"player"`
 	Position boardPosition `json:"position"`
 }
 
+type chainResponse struct {
+	Player    string          `json:"player"`
+	Positions []boardPosition `json:"positions"`
+	Liberties int             `json:"liberties"`
+}
+
+func (m *chainResponse) copyChain(c chain) {
+	m.Player = playerName(c.Player)
+	m.Positions = make([]boardPosition, len(c.Stones))
+	for idx, stone := range c.Stones {
+		m.Positions[idx] = boardPosition{X: stone.X, Y: stone.Y}
+	}
+	m.Liberties = len(c.Liberties)
+}
+
+// matchSettings holds the options a match was created with.
+type matchSettings struct {
+	Komi          float64
+	Handicap      int
+	BlackSeatHash string
+	WhiteSeatHash string
+	// BotSeed is only set when one of the players is a bot, and BotThinkingTime when that bot
+	// searches.
+	BotThinkingTime time.Duration
+	BotSeed         int64
+	TimeControl     timeControl
+}
+
+func (settings matchSettings) seatHash(player byte) (hash string) {
+	switch player {
+	case gogo.PlayerBlack:
+		hash = settings.BlackSeatHash
+	case gogo.PlayerWhite:
+		hash = settings.WhiteSeatHash
+	}
+	return
+}
+
+// matchMove is a single entry in a match's move history. A nil Position is a pass. A match that
+// is lost on time ends with a TimedOut move by the player who ran out of it. Version is the
+// version of the match the move brought it to, which the repository sets as it stores the move.
+type matchMove struct {
+	Player    byte
+	Position  *gogo.Coordinate
+	Turn      int
+	Captures  int
+	Resigned  bool
+	TimedOut  bool
+	Timestamp time.Time
+	Version   int
+}
+
+// matchUndo records moves being taken back: the version of the match the undo brought it to, the
+// number of moves it kept, and when it happened, which is when the clock of the player to move
+// restarted. Like a move's, its version is set by the repository.
+type matchUndo struct {
+	Version int
+	Keep    int
+	At      time.Time
+}
+
+// isPass reports whether the move was a pass: it neither placed a stone nor forfeited the match.
+func (move matchMove) isPass() bool {
+	return move.Position == nil && !move.isForfeit()
+}
+
+// isForfeit reports whether the move ended the match by resignation or on time.
+func (move matchMove) isForfeit() bool {
+	return move.Resigned || move.TimedOut
+}
+
+// matchStatus derives the status of a match from its move history. A match finishes once
+// both players pass in succession, or as soon as one resigns or runs out of time.
+func matchStatus(moves []matchMove) (status string) {
+	status = matchStatusActive
+	count := len(moves)
+	if count >= 1 && moves[count-1].isForfeit() {
+		status = matchStatusFinished
+	}
+	if count >= 2 && moves[count-1].isPass() && moves[count-2].isPass() {
+		status = matchStatusFinished
+	}
+	return
+}
+
+// forfeitWinner names the winner of a match that ended in resignation or on time, or returns an
+// empty string for any other match.
+func forfeitWinner(moves []matchMove) string {
+	if count := len(moves); count > 0 && moves[count-1].isForfeit() {
+		return playerName(opponent(moves[count-1].Player))
+	}
+	return ""
+}
+
+// nextPlayer works out whose turn it is. Black moves first unless black was given handicap
+// stones, in which case white does; after that the players alternate.
+func nextPlayer(settings matchSettings, moves []matchMove) byte {
+	first := byte(gogo.PlayerBlack)
+	if settings.Handicap > 0 {
+		first = gogo.PlayerWhite
+	}
+	if len(moves)%2 == 0 {
+		return first
+	}
+	return opponent(first)
+}
+
+// matchUpdate is the new state of a match after a move: its board and turn, the status it is
+// left in, the moves to append to its history, and the deadline of the clock left running.
+type matchUpdate struct {
+	Match    gogo.Match
+	Status   string
+	Moves    []matchMove
+	Deadline time.Time
+}
+
+// matchRewind is the state of a match after moves are taken back: the number of moves its history
+// is cut back to, when that happened, and the board, status and clock deadline they leave it in.
+type matchRewind struct {
+	Keep     int
+	At       time.Time
+	Match    gogo.Match
+	Status   string
+	Deadline time.Time
+}
+
+// matchState is everything stored about a match, read together so that its parts agree with
+// each other and with Version.
+type matchState struct {
+	Version  int
+	Match    gogo.Match
+	Settings matchSettings
+	Moves    []matchMove
+	// Undo is the pending request to take moves back, if there is one.
+	Undo *undoRequest
+	// Undos are the undos granted so far, oldest first.
+	Undos []matchUndo
+	// UpdatedAt is when the match was last written, by whatever change bumped its version.
+	UpdatedAt time.Time
+}
+
+// errVersionConflict is returned by updateMatch when the match has changed since the caller read it.
+var errVersionConflict = errors.New("Match was modified by another request")
+
 type matchRepository interface {
-	addMatch(match gogo.Match) (err error)
-	getMatches() (matches []gogo.Match, err error)
+	addMatch(match gogo.Match, settings matchSettings) (err error)
+	// importMatch adds a match that already has a history, storing it with its moves in one write.
+	// The version of the match and of each move is set as if the moves had been played one by one.
+	importMatch(match gogo.Match, settings matchSettings, moves []matchMove) (err error)
+	// findMatches returns one page of the matches selected by query, each with the rest of its
+	// state, along with the cursor of the next page, which is empty on the last one.
+	findMatches(query matchQuery) (matches []matchState, next string, err error)
+	// findExpiredMatches returns the active matches whose stored clock deadline is no later than
+	// now, without reading any other match.
+	findExpiredMatches(now time.Time) (matches []matchState, err error)
 	getMatch(id string) (match gogo.Match, err error)
-	updateMatch(id string, match gogo.Match) (err error)
+	// loadMatch reads a match with its version, settings, history and pending undo request in a
+	// single read, for callers that need them to agree.
+	loadMatch(id string) (state matchState, err error)
+	// updateMatch applies the update only if the stored version still equals version, bumping it
+	// on success and stamping the new moves with the new version; otherwise it returns
+	// errVersionConflict. Like every write to a match, it records when it happened as UpdatedAt.
+	updateMatch(id string, version int, update matchUpdate) (err error)
+	// rewindMatch takes moves back, keeping only the first rewind.Keep moves of the history, and
+	// records the undo under the new version. Like updateMatch, it is conditional on version.
+	rewindMatch(id string, version int, rewind matchRewind) (err error)
+	// setUndoRequest stores request as the match's pending undo request, or clears it when request
+	// is nil. Like updateMatch, it is conditional on version. Moves and rewinds clear it too.
+	setUndoRequest(id string, version int, request *undoRequest) (err error)
+	// setKomi changes the komi of a match. Like updateMatch, it is conditional on version.
+	setKomi(id string, version int, komi float64) (err error)
+	getMoves(id string) (moves []matchMove, err error)
+	deleteMatch(id string) (err error)
 }
 
 func (request newMatchRequest) isValid() (valid bool) {
@@ -74,5 +416,50 @@ func (request newMatchRequest) isValid() (valid bool) {
 	if request.PlayerBlack == "" {
 		valid = false
 	}
+	if request.Handicap != 0 && (request.Handicap < minHandicap || request.Handicap > maxHandicap) {
+		valid = false
+	}
+	if !isKnownPlayer(request.PlayerBlack) || !isKnownPlayer(request.PlayerWhite) {
+		valid = false
+	}
+	if isBotName(request.PlayerBlack) && isBotName(request.PlayerWhite) {
+		valid = false
+	}
+	if request.BotThinkingTime < 0 || time.Duration(request.BotThinkingTime)*time.Millisecond > maxBotThinkingTime {
+		valid = false
+	}
+	if request.BotThinkingTime != 0 && !isThinkingBot(request.PlayerBlack) && !isThinkingBot(request.PlayerWhite) {
+		valid = false
+	}
+	if request.TimeControl != nil && !request.TimeControl.isValid() {
+		valid = false
+	}
 	return valid
 }
+
+func playerName(player byte) (name string) {
+	switch player {
+	case gogo.PlayerBlack:
+		name = "black"
+	case gogo.PlayerWhite:
+		name = "white"
+	}
+	return
+}
+
+func parsePlayer(name string) (player byte, ok bool) {
+	switch name {
+	case "black":
+		player, ok = gogo.PlayerBlack, true
+	case "white":
+		player, ok = gogo.PlayerWhite, true
+	}
+	return
+}
+
+func opponent(player byte) byte {
+	if player == gogo.PlayerBlack {
+		return gogo.PlayerWhite
+	}
+	return gogo.PlayerBlack
+}
@@ -0,0 +1,254 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cloudnativego/gogo-engine"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+)
+
+const (
+	undoPending  = "pending"
+	undoAccepted = "accepted"
+	undoDeclined = "declined"
+)
+
+var (
+	errUndoPending   = errors.New("An undo request is already pending")
+	errNoUndoPending = errors.New("No undo request is pending")
+)
+
+// undoRequest is a player's pending request to take back their last move. Keep is the number of
+// moves the history is cut back to should the opponent agree, which also takes back any move the
+// opponent has made since.
+type undoRequest struct {
+	Player      byte
+	Keep        int
+	RequestedAt time.Time
+}
+
+type newUndoRequest struct {
+	Player byte `json:"player"`
+}
+
+type undoResponse struct {
+	Player      string `json:"player"`
+	Moves       int    `json:"moves"`
+	Status      string `json:"status"`
+	RequestedAt int64  `json:"requested_at"`
+}
+
+func (m *undoResponse) copyUndo(request undoRequest, moves []matchMove, status string) {
+	m.Player = playerName(request.Player)
+	m.Moves = len(moves) - request.Keep
+	m.Status = status
+	m.RequestedAt = request.RequestedAt.Unix()
+}
+
+// undoState is a match as an undo action finds it, along with the player taking the action.
+type undoState struct {
+	version  int
+	match    gogo.Match
+	settings matchSettings
+	moves    []matchMove
+	undos    []matchUndo
+	pending  *undoRequest
+	player   byte
+}
+
+func newUndoState(stored matchState, player byte) undoState {
+	return undoState{
+		version:  stored.Version,
+		match:    stored.Match,
+		settings: stored.Settings,
+		moves:    stored.Moves,
+		undos:    stored.Undos,
+		pending:  stored.Undo,
+		player:   player,
+	}
+}
+
+// loadUndoState reads the match an undo action applies to and checks that the player named in
+// the request holds their seat.
+func loadUndoState(req *http.Request, repo matchRepository, matchID string) (state undoState, status int, err error) {
+	payload, _ := ioutil.ReadAll(req.Body)
+	var body newUndoRequest
+	if json.Unmarshal(payload, &body) != nil {
+		return state, http.StatusBadRequest, errors.New("Failed to parse undo request")
+	}
+	if body.Player != gogo.PlayerBlack && body.Player != gogo.PlayerWhite {
+		return state, http.StatusBadRequest, errors.New("Player must be 1 (black) or 2 (white)")
+	}
+	stored, err := repo.loadMatch(matchID)
+	if err != nil {
+		return state, http.StatusNotFound, err
+	}
+	state = newUndoState(stored, body.Player)
+	if status, err = authorizeSeat(req, state.settings, state.player); err != nil {
+		return state, status, err
+	}
+	status, err = checkPrecondition(req, matchETag(matchID, state.version, jsonVariant))
+	return state, status, err
+}
+
+func writeUndoError(formatter *render.Render, w http.ResponseWriter, status int, err error) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	formatter.JSON(w, status, errorResponse{Message: err.Error()})
+}
+
+// requestUndoHandler asks the opponent to let the player take back their last move. Bots always
+// agree, so against one the move is taken back straight away.
+func requestUndoHandler(formatter *render.Render, repo matchRepository, hub *matchHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		matchID := mux.Vars(req)["id"]
+		state, status, err := loadUndoState(req, repo, matchID)
+		if err != nil {
+			writeUndoError(formatter, w, status, err)
+			return
+		}
+		_, agreed := botFor(state.match, opponent(state.player))
+		ur, status, err := requestUndo(repo, hub, state, agreed)
+		if err != nil {
+			writeUndoError(formatter, w, status, err)
+			return
+		}
+		w.Header().Set("ETag", matchETag(state.match.ID, state.version+1, jsonVariant))
+		formatter.JSON(w, http.StatusCreated, &ur)
+	}
+}
+
+// requestUndo asks for the player's last move to be taken back, along with any move the opponent
+// has made since. If the opponent has agreed up front, the moves are taken back straight away and
+// the request reported accepted; otherwise it is left pending for the opponent to answer.
+func requestUndo(repo matchRepository, hub *matchHub, state undoState, agreed bool) (ur undoResponse, status int, err error) {
+	if matchStatus(state.moves) == matchStatusFinished {
+		return ur, http.StatusConflict, errors.New("Match is already finished")
+	}
+	if state.pending != nil {
+		return ur, http.StatusConflict, errUndoPending
+	}
+	keep := -1
+	for idx, move := range state.moves {
+		if move.Player == state.player {
+			keep = idx
+		}
+	}
+	if keep < 0 {
+		return ur, http.StatusConflict, errors.New(playerName(state.player) + " has no move to take back")
+	}
+
+	matchID := state.match.ID
+	request := undoRequest{Player: state.player, Keep: keep, RequestedAt: time.Now()}
+	if agreed {
+		mdr, err := rewindMoves(repo, state.version, state.match, state.settings, state.moves, state.undos, keep)
+		if err != nil {
+			return ur, undoErrorStatus(err), err
+		}
+		hub.publish(matchID, mdr)
+		ur.copyUndo(request, state.moves, undoAccepted)
+		return ur, http.StatusCreated, nil
+	}
+
+	if err = repo.setUndoRequest(matchID, state.version, &request); err != nil {
+		return ur, undoErrorStatus(err), err
+	}
+	ur.copyUndo(request, state.moves, undoPending)
+	var mdr matchDetailsResponse
+	mdr.copyMatch(state.match, state.settings, state.moves, state.undos)
+	mdr.UndoRequest = &ur
+	mdr.version = state.version + 1
+	hub.publish(matchID, mdr)
+	return ur, http.StatusCreated, nil
+}
+
+func getUndoHandler(formatter *render.Render, repo matchRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		matchID := mux.Vars(req)["id"]
+		state, err := repo.loadMatch(matchID)
+		if err != nil {
+			formatter.JSON(w, http.StatusNotFound, errorResponse{Message: err.Error()})
+			return
+		}
+		if state.Undo == nil {
+			formatter.JSON(w, http.StatusNotFound, errorResponse{Message: errNoUndoPending.Error()})
+			return
+		}
+		var ur undoResponse
+		ur.copyUndo(*state.Undo, state.Moves, undoPending)
+		formatter.JSON(w, http.StatusOK, &ur)
+	}
+}
+
+// acceptUndoHandler lets the opponent of the player who asked grant the undo request, taking the
+// match back to the position before that player's last move.
+func acceptUndoHandler(formatter *render.Render, repo matchRepository, hub *matchHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		matchID := mux.Vars(req)["id"]
+		state, status, err := loadUndoState(req, repo, matchID)
+		if err != nil {
+			writeUndoError(formatter, w, status, err)
+			return
+		}
+		if state.pending == nil {
+			formatter.JSON(w, http.StatusConflict, errorResponse{Message: errNoUndoPending.Error()})
+			return
+		}
+		if state.pending.Player == state.player {
+			formatter.JSON(w, http.StatusForbidden, errorResponse{Message: "Only " + playerName(opponent(state.player)) + " can accept the undo request"})
+			return
+		}
+		mdr, err := rewindMoves(repo, state.version, state.match, state.settings, state.moves, state.undos, state.pending.Keep)
+		if err != nil {
+			writeUndoError(formatter, w, undoErrorStatus(err), err)
+			return
+		}
+		hub.publish(matchID, mdr)
+		w.Header().Set("ETag", matchETag(matchID, state.version+1, jsonVariant))
+		formatter.JSON(w, http.StatusOK, &mdr)
+	}
+}
+
+// declineUndoHandler turns the undo request down. The player who asked may use it to withdraw
+// their request as well.
+func declineUndoHandler(formatter *render.Render, repo matchRepository, hub *matchHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		matchID := mux.Vars(req)["id"]
+		state, status, err := loadUndoState(req, repo, matchID)
+		if err != nil {
+			writeUndoError(formatter, w, status, err)
+			return
+		}
+		if state.pending == nil {
+			formatter.JSON(w, http.StatusConflict, errorResponse{Message: errNoUndoPending.Error()})
+			return
+		}
+		if err = repo.setUndoRequest(matchID, state.version, nil); err != nil {
+			writeUndoError(formatter, w, undoErrorStatus(err), err)
+			return
+		}
+		var mdr matchDetailsResponse
+		mdr.copyMatch(state.match, state.settings, state.moves, state.undos)
+		mdr.version = state.version + 1
+		hub.publish(matchID, mdr)
+		var ur undoResponse
+		ur.copyUndo(*state.pending, state.moves, undoDeclined)
+		w.Header().Set("ETag", matchETag(matchID, state.version+1, jsonVariant))
+		formatter.JSON(w, http.StatusOK, &ur)
+	}
+}
+
+// undoErrorStatus maps a failure to store an undo action to its response status. Losing a race
+// with a move or another undo action is a conflict for the client to sort out.
+func undoErrorStatus(err error) int {
+	if err == errVersionConflict {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
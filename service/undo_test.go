@@ -0,0 +1,138 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func postUndoAs(server http.Handler, matchID string, action string, body string, seatToken string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches/"+matchID+"/undo"+action, strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer "+seatToken)
+	request.Header.Set("If-Match", currentETag(server, matchID))
+	server.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func createSeatedMatch(t *testing.T, server http.Handler, body string) newMatchResponse {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "/matches", strings.NewReader(body))
+	server.ServeHTTP(recorder, request)
+	var created newMatchResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &created); err != nil || recorder.Code != http.StatusCreated {
+		t.Fatalf("Failed to create match: %d %s", recorder.Code, recorder.Body.String())
+	}
+	return created
+}
+
+func TestUndoIsTakenBackOnceTheOpponentAgrees(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	created := createSeatedMatch(t, server, "{\"gridsize\": 9, \"playerBlack\": \"alfred\", \"playerWhite\": \"bob\"}")
+	black, white := created.SeatTokens.Black, created.SeatTokens.White
+	postMoveAs(server, created.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}", black)
+	postMoveAs(server, created.ID, "{\"player\": 2, \"position\": {\"x\": 5, \"y\": 5}}", white)
+
+	if recorder := postUndoAs(server, created.ID, "", "{\"player\": 1}", white); recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected an undo request with the wrong seat token to return 403, got %d", recorder.Code)
+	}
+	recorder := postUndoAs(server, created.ID, "", "{\"player\": 1}", black)
+	var ur undoResponse
+	json.Unmarshal(recorder.Body.Bytes(), &ur)
+	if recorder.Code != http.StatusCreated || ur.Status != undoPending || ur.Moves != 2 || ur.Player != "black" {
+		t.Fatalf("Expected black's request to take back two moves to be pending, got %d %+v", recorder.Code, ur)
+	}
+	if recorder = postUndoAs(server, created.ID, "", "{\"player\": 2}", white); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected a second undo request to return 409, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/matches/"+created.ID, nil)
+	server.ServeHTTP(recorder, request)
+	var details matchDetailsResponse
+	json.Unmarshal(recorder.Body.Bytes(), &details)
+	if details.UndoRequest == nil || details.UndoRequest.Player != "black" {
+		t.Errorf("Expected the match details to show the pending request, got %+v", details.UndoRequest)
+	}
+
+	if recorder = postUndoAs(server, created.ID, "/accept", "{\"player\": 1}", black); recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected black accepting their own request to return 403, got %d", recorder.Code)
+	}
+	recorder = postUndoAs(server, created.ID, "/accept", "{\"player\": 2}", white)
+	details = matchDetailsResponse{}
+	json.Unmarshal(recorder.Body.Bytes(), &details)
+	if recorder.Code != http.StatusOK || details.Turn != 0 || details.NextPlayer != "black" || details.GameBoard[4][4] != 0 || details.GameBoard[5][5] != 0 {
+		t.Fatalf("Expected the match to be back at the start with black to play, got %d %+v", recorder.Code, details)
+	}
+	if moves, _ := repo.getMoves(created.ID); len(moves) != 0 {
+		t.Errorf("Expected the move history to be taken back, got %+v", moves)
+	}
+	if state, _ := repo.loadMatch(created.ID); state.Undo != nil {
+		t.Errorf("Expected the request to be settled, got %+v", state.Undo)
+	}
+
+	// The position's history went back with the moves, so repeating them is no superko violation.
+	if recorder = postMoveAs(server, created.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}", black); recorder.Code != http.StatusCreated {
+		t.Errorf("Expected black to be able to replay the move taken back, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestUndoRequestsCanBeDeclinedAndLapseOnTheNextMove(t *testing.T) {
+	repo := newInMemoryRepository()
+	server := MakeTestServer(repo)
+	created := createSeatedMatch(t, server, "{\"gridsize\": 9, \"playerBlack\": \"alfred\", \"playerWhite\": \"bob\"}")
+	black, white := created.SeatTokens.Black, created.SeatTokens.White
+
+	if recorder := postUndoAs(server, created.ID, "", "{\"player\": 1}", black); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected an undo request before moving to return 409, got %d", recorder.Code)
+	}
+	postMoveAs(server, created.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}", black)
+	postUndoAs(server, created.ID, "", "{\"player\": 1}", black)
+	recorder := postUndoAs(server, created.ID, "/decline", "{\"player\": 2}", white)
+	var ur undoResponse
+	json.Unmarshal(recorder.Body.Bytes(), &ur)
+	if recorder.Code != http.StatusOK || ur.Status != undoDeclined {
+		t.Errorf("Expected white to decline the request, got %d %+v", recorder.Code, ur)
+	}
+	recorder = httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/matches/"+created.ID+"/undo", nil)
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected no request to be pending after declining, got %d", recorder.Code)
+	}
+
+	postUndoAs(server, created.ID, "", "{\"player\": 1}", black)
+	postMoveAs(server, created.ID, "{\"player\": 2, \"position\": {\"x\": 5, \"y\": 5}}", white)
+	if recorder = postUndoAs(server, created.ID, "/accept", "{\"player\": 2}", white); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected a request overtaken by a move to have lapsed, got %d", recorder.Code)
+	}
+	if moves, _ := repo.getMoves(created.ID); len(moves) != 2 {
+		t.Errorf("Expected both moves to stand, got %+v", moves)
+	}
+}
+
+func TestBotsAgreeToUndo(t *testing.T) {
+	repo := newInMemoryRepository()
+	hub := newMatchHub()
+	bots := newBotRunner(repo, hub)
+	server := mux.NewRouter()
+	initRoutes(server, formatter, repo, hub, bots)
+	created := createSeatedMatch(t, server, "{\"gridsize\": 9, \"playerBlack\": \"alfred\", \"playerWhite\": \"bot:random\"}")
+
+	postMoveAs(server, created.ID, "{\"player\": 1, \"position\": {\"x\": 4, \"y\": 4}}", created.SeatTokens.Black)
+	bots.wait()
+	recorder := postUndoAs(server, created.ID, "", "{\"player\": 1}", created.SeatTokens.Black)
+	var ur undoResponse
+	json.Unmarshal(recorder.Body.Bytes(), &ur)
+	if recorder.Code != http.StatusCreated || ur.Status != undoAccepted || ur.Moves != 2 {
+		t.Errorf("Expected the bot to agree to take back both moves, got %d %+v", recorder.Code, ur)
+	}
+	if moves, _ := repo.getMoves(created.ID); len(moves) != 0 {
+		t.Errorf("Expected the moves to be taken back, got %+v", moves)
+	}
+}